@@ -4,7 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
 	driver "github.com/Datera/datera-csi/pkg/driver"
 	log "github.com/sirupsen/logrus"
 
@@ -12,7 +16,10 @@ import (
 )
 
 var (
-	version = flag.Bool("version", false, "Show version information")
+	version   = flag.Bool("version", false, "Show version information")
+	params    = flag.Bool("print-params", false, "Show the supported StorageClass parameters")
+	logLevel  = flag.String("log-level", os.Getenv(driver.EnvLogLevel), "Log level: debug, info, warning or error (default debug)")
+	logFormat = flag.String("log-format", os.Getenv(driver.EnvLogFormat), "Log format: text or json (default text)")
 )
 
 func Main() int {
@@ -22,17 +29,41 @@ func Main() int {
 		fmt.Printf("Datera CSI Plugin Version: %s-%s\n", driver.Version, driver.Githash)
 		os.Exit(0)
 	}
+	if *params {
+		dc.PrintVolParams(os.Stdout)
+		os.Exit(0)
+	}
+	if err := co.SetupLogging(*logLevel, *logFormat); err != nil {
+		log.Fatal(err)
+	}
+	opts := driver.Options{}
 	conf, err := udc.GetConfig()
-	if err != nil {
+	if err != nil && driver.NeedsApi() {
 		log.Fatal(err)
+	} else if err != nil {
+		// Only pushing logs to the array would need it
+		log.Infof("No Datera config, running the node service without API access: %s", err)
+		opts.NoApi = true
+		conf = &udc.UDC{}
+	} else {
+		log.Info("Using Universal Datera Config")
+		udc.PrintConfig()
 	}
-	log.Info("Using Universal Datera Config")
-	udc.PrintConfig()
-	d, err := driver.NewDateraDriver(conf)
+	d, err := driver.NewDateraDriver(conf, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Drain in-flight operations instead of dying mid-login or mid-format
+	// when Kubernetes stops the pod
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Infof("Received signal %s, shutting down", sig)
+		d.Stop()
+	}()
+
 	if err := d.Run(); err != nil {
 		log.Fatal(err)
 	}
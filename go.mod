@@ -10,12 +10,12 @@ require (
 	github.com/Shopify/sarama v1.21.0 // indirect
 	github.com/aclements/go-gg v0.0.0-20170323211221-abd1f791f5ee // indirect
 	github.com/aclements/go-moremath v0.0.0-20180329182055-b1aff36309c7 // indirect
-	github.com/container-storage-interface/spec v1.2.0
+	github.com/container-storage-interface/spec v1.3.0
 	github.com/coreos/go-systemd v0.0.0-20190318101727-c7c1946145b6 // indirect
 	github.com/docker/go-units v0.4.0
 	github.com/gliderlabs/ssh v0.1.3 // indirect
 	github.com/go-logfmt/logfmt v0.4.0 // indirect
-	github.com/golang/protobuf v1.4.1
+	github.com/golang/protobuf v1.4.2
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/google/pprof v0.0.0-20190309163659-77426154d546 // indirect
 	github.com/google/uuid v1.1.1
@@ -27,11 +27,18 @@ require (
 	github.com/kubernetes-csi/csi-lib-iscsi v0.0.0-20200118015005-959f12c91ca8
 	github.com/kubernetes-csi/csi-lib-utils v0.7.0
 	github.com/kubernetes-csi/csi-test v1.1.1
+	github.com/levigross/grequests v0.0.0-20190908174114-253788527a1a
 	github.com/mattn/go-sqlite3 v1.10.0 // indirect
+	github.com/onsi/ginkgo v1.10.2
 	github.com/openzipkin/zipkin-go v0.1.6 // indirect
+	github.com/prometheus/client_golang v1.7.1
 	github.com/protocolbuffers/protobuf v3.14.0+incompatible
 	github.com/rogpeppe/fastuuid v1.0.0 // indirect
 	github.com/sirupsen/logrus v1.6.0
+	go.opentelemetry.io/otel v0.13.0
+	go.opentelemetry.io/otel/exporters/otlp v0.13.0
+	go.opentelemetry.io/otel/exporters/stdout v0.13.0
+	go.opentelemetry.io/otel/sdk v0.13.0
 	go4.org v0.0.0-20190313082347-94abd6928b1d // indirect
 	golang.org/x/build v0.0.0-20190319162919-ebee6e9d80f9 // indirect
 	golang.org/x/exp v0.0.0-20190316020145-860388717186 // indirect
@@ -39,8 +46,8 @@ require (
 	golang.org/x/mobile v0.0.0-20190319155245-9487ef54b94a // indirect
 	golang.org/x/net v0.0.0-20200602114024-627f9648deb9
 	golang.org/x/perf v0.0.0-20190312170614-0655857e383f // indirect
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
+	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1
 	golang.org/x/tools v0.0.0-20190524140312-2c0ae7006135 // indirect
-	google.golang.org/grpc v1.29.1
+	google.golang.org/grpc v1.32.0
 	honnef.co/go/tools v0.0.0-20190523083050-ea95bdfd59fc // indirect
 )
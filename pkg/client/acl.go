@@ -11,7 +11,7 @@ import (
 )
 
 var (
-	initiatorFile = "/etc/iscsi/initiatorname.iscsi"
+	InitiatorFile = "/etc/iscsi/initiatorname.iscsi"
 )
 
 type Initiator struct {
@@ -25,15 +25,12 @@ type Initiator struct {
 
 // Gets an Initiator path based on IQN.  If that initiator does not exist it creates the Initiator
 // then returns the path to the newly created Initiator
-func (r *DateraClient) CreateGetInitiator() (*Initiator, error) {
+func (r *DateraClient) CreateGetInitiator(iqn string) (*Initiator, error) {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "CreateGetInitiator")
-	co.Debugf(ctxt, "CreateGetInitiator invoked")
-	iqn, err := GetClientIqn(ctxt)
-	if err != nil {
-		co.Error(ctxt, err)
-		return nil, err
-	}
 	co.Debugf(ctxt, "CreateGetInitiator invoked for %s", iqn)
+	if iqn == "" {
+		return nil, fmt.Errorf("Initiator IQN cannot be an empty string")
+	}
 	init, apierr, err := r.sdk.Initiators.Get(&dsdk.InitiatorsGetRequest{
 		Ctxt: ctxt,
 		Id:   iqn,
@@ -68,6 +65,31 @@ func (r *DateraClient) CreateGetInitiator() (*Initiator, error) {
 	}, nil
 }
 
+// Gets an existing Initiator based on IQN without creating it
+func (r *DateraClient) GetInitiator(iqn string) (*Initiator, error) {
+	ctxt := context.WithValue(r.ctxt, co.ReqName, "GetInitiator")
+	co.Debugf(ctxt, "GetInitiator invoked for %s", iqn)
+	init, apierr, err := r.sdk.Initiators.Get(&dsdk.InitiatorsGetRequest{
+		Ctxt: ctxt,
+		Id:   iqn,
+	})
+	if err != nil {
+		co.Error(ctxt, err)
+		return nil, err
+	} else if apierr != nil {
+		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
+		return nil, co.ErrTranslator(apierr)
+	}
+	return &Initiator{
+		ctxt: ctxt,
+		dc:   r,
+		Init: init,
+		Name: init.Name,
+		Path: init.Path,
+		Iqn:  init.Id,
+	}, nil
+}
+
 func (r *Initiator) Delete(quiet bool) error {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "Initiator Delete")
 	co.Debugf(ctxt, "Initiator Delete invoked")
@@ -91,6 +113,20 @@ func (r *Initiator) Delete(quiet bool) error {
 	return nil
 }
 
+// InitiatorIqns returns the IQNs of the initiators in the volume's AclPolicy,
+// as of when the volume was last loaded
+func (r *Volume) InitiatorIqns() []string {
+	iqns := []string{}
+	acl := r.Ai.StorageInstances[0].AclPolicy
+	if acl == nil {
+		return iqns
+	}
+	for _, init := range acl.Initiators {
+		iqns = append(iqns, strings.TrimPrefix(init.Path, "/initiators/"))
+	}
+	return iqns
+}
+
 func (r *Volume) RegisterAcl(cinit *Initiator) error {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "RegisterAcl")
 	co.Debugf(ctxt, "RegisterAcl invoked for %s with initiator %s", r.Name, cinit.Name)
@@ -104,19 +140,24 @@ func (r *Volume) RegisterAcl(cinit *Initiator) error {
 		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
 		return co.ErrTranslator(apierr)
 	}
-	acl.Initiators = append(acl.Initiators, &dsdk.Initiator{
-		Path: cinit.Path,
-	})
-	// copy the acl.Initiators to another list and remove
-	// initiator entries which has 'Tenant' in them since
-	// Datera API expects only 'Path' to be present
+	// Registering is idempotent, ControllerPublishVolume may be retried
+	for _, init := range acl.Initiators {
+		if init.Path == cinit.Path {
+			co.Debugf(ctxt, "Initiator %s already registered for %s", cinit.Name, r.Name)
+			return nil
+		}
+	}
+	// Datera API expects only 'Path' to be present, multi-tenant arrays
+	// list the initiators with their 'Tenant'
 	initiators := []*dsdk.Initiator{}
 	for _, initiator := range acl.Initiators {
-		if initiator.Tenant == "" {
-			initiators = append(initiators, initiator)
-		}
+		initiators = append(initiators, &dsdk.Initiator{
+			Path: initiator.Path,
+		})
 	}
-	acl.Initiators = initiators
+	acl.Initiators = append(initiators, &dsdk.Initiator{
+		Path: cinit.Path,
+	})
 
 	if _, apierr, err = acl.Set(&dsdk.AclPolicySetRequest{
 		Ctxt:       ctxt,
@@ -146,14 +187,21 @@ func (r *Volume) UnregisterAcl(cinit *Initiator) error {
 	}
 
 	// Remove the matching initiator from the initiators list
+	found := false
 	newInits := []*dsdk.Initiator{}
 	for _, init := range acl.Initiators {
-		if init.Path != cinit.Path {
+		if init.Path == cinit.Path {
+			found = true
+		} else {
 			newInits = append(newInits, &dsdk.Initiator{
-				Path: cinit.Path,
+				Path: init.Path,
 			})
 		}
 	}
+	if !found {
+		co.Debugf(ctxt, "Initiator %s not registered for %s", cinit.Name, r.Name)
+		return nil
+	}
 	acl.Initiators = newInits
 
 	if _, apierr, err = acl.Set(&dsdk.AclPolicySetRequest{
@@ -171,9 +219,9 @@ func (r *Volume) UnregisterAcl(cinit *Initiator) error {
 
 func GetClientIqn(ctxt context.Context) (string, error) {
 	// Parse InitiatorName
-	dat, err := ioutil.ReadFile(initiatorFile)
+	dat, err := ioutil.ReadFile(InitiatorFile)
 	if err != nil {
-		co.Debugf(ctxt, "Could not read file %s", initiatorFile)
+		co.Debugf(ctxt, "Could not read file %s", InitiatorFile)
 		return "", err
 	}
 	iqn := strings.Split(strings.TrimSpace(string(dat)), "=")[1]
@@ -2,9 +2,13 @@ package client
 
 import (
 	"context"
+	"net/http"
 
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 	udc "github.com/Datera/go-udc/pkg/udc"
+
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
+	tracing "github.com/Datera/datera-csi/pkg/tracing"
 )
 
 type DateraClient struct {
@@ -12,10 +16,22 @@ type DateraClient struct {
 	udc           *udc.UDC
 	ctxt          context.Context
 	vendorVersion string
+	host          HostExecutor
+	// Whether the array has a tenant wide snapshots endpoint, shared by all
+	// copies of the client.  0: unknown, 1: yes, -1: no
+	tenantSnaps *int32
 }
 
 func NewDateraClient(udc *udc.UDC, healthcheck bool, driver string) (*DateraClient, error) {
-	sdk, err := dsdk.NewSDK(udc, true)
+	return NewDateraClientWithHTTPClient(udc, healthcheck, driver, nil)
+}
+
+// NewDateraClientWithHTTPClient allows the underlying http.Client to be
+// overridden, eg: to talk to the fake API server in tests.  A nil client
+// uses the SDK default.  Either way every request is recorded in the API
+// metrics and traced
+func NewDateraClientWithHTTPClient(udc *udc.UDC, healthcheck bool, driver string, client *http.Client) (*DateraClient, error) {
+	sdk, err := dsdk.NewSDKWithHTTPClient(udc, true, metrics.InstrumentClient(tracing.InstrumentClient(client)))
 	if err != nil {
 		return nil, err
 	}
@@ -26,8 +42,10 @@ func NewDateraClient(udc *udc.UDC, healthcheck bool, driver string) (*DateraClie
 		}
 	}
 	return &DateraClient{
-		sdk: sdk,
-		udc: udc,
+		sdk:         sdk,
+		udc:         udc,
+		ctxt:        sdk.NewContext(),
+		tenantSnaps: new(int32),
 	}, nil
 }
 
@@ -36,14 +54,22 @@ func (r *DateraClient) NewContext() context.Context {
 	return r.ctxt
 }
 
+// WithContext returns ctxt with the SDK connection attached
 func (r *DateraClient) WithContext(ctxt context.Context) context.Context {
-	r.ctxt = r.sdk.WithContext(ctxt)
-	return r.ctxt
+	return r.sdk.WithContext(ctxt)
+}
+
+// ForContext returns a copy of the client whose requests and log lines carry
+// the trace id of ctxt.  The client is shared by concurrent RPCs, so each RPC
+// should use its own copy
+func (r *DateraClient) ForContext(ctxt context.Context) *DateraClient {
+	c := *r
+	c.ctxt = r.WithContext(ctxt)
+	return &c
 }
 
 func (r *DateraClient) HealthCheck(ctxt context.Context) (*Manifest, error) {
-	r.ctxt = r.WithContext(ctxt)
-	return r.GetManifest()
+	return r.ForContext(ctxt).GetManifest()
 }
 
 func (r *DateraClient) LogPush(ctxt context.Context, rule, rotated string) error {
@@ -1,20 +1,56 @@
 package client
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	co "github.com/Datera/datera-csi/pkg/common"
+	fake "github.com/Datera/datera-csi/pkg/fakeapi"
+	fh "github.com/Datera/datera-csi/pkg/fakehost"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 	udc "github.com/Datera/go-udc/pkg/udc"
+	units "github.com/docker/go-units"
 )
 
-const WIM = 500
+const (
+	WIM = 500
+	// Tests needing a live array and iscsiadm only run when this is set
+	EnvLiveTest = "DAT_LIVE_TEST"
+	FakeIqn     = "iqn.1993-08.org.debian:01:fake"
+)
+
+var (
+	srv *fake.Server
+
+	_ HostExecutor = fh.New()
+)
+
+func TestMain(m *testing.M) {
+	srv = fake.NewServer()
+	dir, err := ioutil.TempDir("", "csi-client-test")
+	if err != nil {
+		panic(err)
+	}
+	InitiatorFile = filepath.Join(dir, "initiatorname.iscsi")
+	if err = ioutil.WriteFile(InitiatorFile, []byte("InitiatorName="+FakeIqn+"\n"), 0644); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	srv.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
 
 func createVolume(t *testing.T, client *DateraClient, v *VolOpts) (string, *Volume, func()) {
 	name := "my-test-vol-" + dsdk.RandString(5)
-	vol, err := client.CreateVolume(name, v, true)
+	vol, err := client.CreateVolume(name, v, true, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -27,7 +63,11 @@ func createVolume(t *testing.T, client *DateraClient, v *VolOpts) (string, *Volu
 }
 
 func createRegisterInitiator(t *testing.T, client *DateraClient, vol *Volume) func() {
-	init, err := client.CreateGetInitiator()
+	iqn, err := GetClientIqn(context.WithValue(client.ctxt, co.ReqName, "GetClientIqn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	init, err := client.CreateGetInitiator(iqn)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,7 +83,7 @@ func createRegisterInitiator(t *testing.T, client *DateraClient, vol *Volume) fu
 
 func createSnapshot(t *testing.T, client *DateraClient, vol *Volume) (*Snapshot, func()) {
 	name := "my-test-snap-" + dsdk.RandString(5)
-	snap, err := vol.CreateSnapshot(name)
+	snap, err := vol.CreateSnapshot(name, &SnapOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -69,6 +109,18 @@ func createSnapshot(t *testing.T, client *DateraClient, vol *Volume) (*Snapshot,
 }
 
 func getClient(t *testing.T) *DateraClient {
+	client, err := NewDateraClientWithHTTPClient(srv.UDC(), true, "csi-client-test", srv.HTTPClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.NewContext()
+	return client
+}
+
+func getLiveClient(t *testing.T) *DateraClient {
+	if os.Getenv(EnvLiveTest) == "" {
+		t.Skipf("%s not set, skipping test requiring a live array", EnvLiveTest)
+	}
 	conf, err := udc.GetConfig()
 	if err != nil {
 		t.Fatal(err)
@@ -111,9 +163,11 @@ func TestManifest(t *testing.T) {
 func TestVolumeCreate(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	name, vol, cleanf := createVolume(t, client, v)
 	defer cleanf()
@@ -128,9 +182,11 @@ func TestVolumeCreate(t *testing.T) {
 func TestListVolumes(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	names := []string{}
 	for i := 0; i < 5; i++ {
@@ -167,9 +223,11 @@ func TestListVolumes(t *testing.T) {
 func TestVolumeMetadata(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanf := createVolume(t, client, v)
 	defer cleanf()
@@ -194,9 +252,11 @@ func TestVolumeMetadata(t *testing.T) {
 func TestACL(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	cleani := createRegisterInitiator(t, client, vol)
@@ -207,9 +267,11 @@ func TestACL(t *testing.T) {
 func TestIpPools(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	ipp, err := client.GetIpPoolFromName("default")
@@ -224,42 +286,46 @@ func TestIpPools(t *testing.T) {
 }
 
 func TestLoginLogout(t *testing.T) {
-	client := getClient(t)
+	client := getLiveClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	cleani := createRegisterInitiator(t, client, vol)
 	defer cleani()
 	defer cleanv()
-	vol.Login(false, false)
+	vol.Login(false, false, nil)
 	if vol.DevicePath == "" {
 		t.Fatal("Device Path not populated")
 	}
 	t.Logf("Device Path: %s", vol.DevicePath)
-	vol.Logout()
+	vol.Logout(false, false)
 }
 
 func TestMountUnmount(t *testing.T) {
-	client := getClient(t)
+	client := getLiveClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	cleani := createRegisterInitiator(t, client, vol)
 	defer cleani()
 	defer cleanv()
-	vol.Login(false, false)
-	defer vol.Logout()
+	vol.Login(false, false, nil)
+	defer vol.Logout(false, false)
 
-	if err := vol.Format("xfs", []string{}, 5); err != nil {
+	if err := vol.Format("xfs", []string{}, 5, false); err != nil {
 		t.Fatal(err)
 	}
-	if err := vol.Mount(fmt.Sprintf("/mnt/my-dir-%s", dsdk.RandString(5)), []string{}); err != nil {
+	if err := vol.Mount(fmt.Sprintf("/mnt/my-dir-%s", dsdk.RandString(5)), []string{}, "xfs"); err != nil {
 		t.Fatal(err)
 	}
 	if err := vol.Unmount(); err != nil {
@@ -268,29 +334,31 @@ func TestMountUnmount(t *testing.T) {
 }
 
 func TestBindMountUnBindMount(t *testing.T) {
-	client := getClient(t)
+	client := getLiveClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	cleani := createRegisterInitiator(t, client, vol)
 	defer cleani()
 	defer cleanv()
-	vol.Login(false, false)
-	defer vol.Logout()
+	vol.Login(false, false, nil)
+	defer vol.Logout(false, false)
 
-	if err := vol.Format("ext4", []string{}, 5); err != nil {
+	if err := vol.Format("ext4", []string{}, 5, false); err != nil {
 		t.Fatal(err)
 	}
 	r := dsdk.RandString(5)
-	if err := vol.Mount(fmt.Sprintf("/mnt/my-dir-%s", r), []string{}); err != nil {
+	if err := vol.Mount(fmt.Sprintf("/mnt/my-dir-%s", r), []string{}, "ext4"); err != nil {
 		t.Fatal(err)
 	}
 	defer vol.Unmount()
 
-	if err := vol.BindMount(fmt.Sprintf("/mnt/my-bind-dir-%s", r)); err != nil {
+	if err := vol.BindMount(fmt.Sprintf("/mnt/my-bind-dir-%s", r), "ext4"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -303,9 +371,11 @@ func TestBindMountUnBindMount(t *testing.T) {
 func TestCreateDeleteSnapshot(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	defer cleanv()
@@ -316,9 +386,11 @@ func TestCreateDeleteSnapshot(t *testing.T) {
 func TestListSnapshotsSingle(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	defer cleanv()
@@ -338,9 +410,11 @@ func TestListSnapshotsSingle(t *testing.T) {
 func TestListSnapshotsMany(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	defer cleanv()
@@ -364,9 +438,11 @@ func TestListSnapshotsMany(t *testing.T) {
 func TestCreateFromSnapshot(t *testing.T) {
 	client := getClient(t)
 	v := &VolOpts{
-		Size:         5,
-		Replica:      1,
-		WriteIopsMax: WIM,
+		Size:            5,
+		Replica:         1,
+		WriteIopsMax:    WIM,
+		IpPool:          "default",
+		PlacementPolicy: "default",
 	}
 	_, vol, cleanv := createVolume(t, client, v)
 	defer cleanv()
@@ -377,8 +453,9 @@ func TestCreateFromSnapshot(t *testing.T) {
 
 	v2 := &VolOpts{
 		CloneSnapSrc: snap.Snap.Path,
+		IpPool:       "default",
 	}
-	vol, err := client.CreateVolume(name, v2, true)
+	_, err := client.CreateVolume(name, v2, true, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -388,3 +465,575 @@ func TestCreateFromSnapshot(t *testing.T) {
 		}
 	}()
 }
+
+func TestVolumeCreateApiError(t *testing.T) {
+	client := getClient(t)
+	v := &VolOpts{
+		Size:            5,
+		Replica:         1,
+		IpPool:          "default",
+		PlacementPolicy: "default",
+	}
+	srv.InjectFault("POST", "^/app_instances$", 1, &dsdk.ApiErrorResponse{
+		Name:    "InternalError",
+		Message: "injected",
+	})
+	name := "my-test-vol-" + dsdk.RandString(5)
+	if _, err := client.CreateVolume(name, v, true, nil); err == nil {
+		t.Fatal("Expected CreateVolume to fail on injected ApiError")
+	}
+	if ai := srv.AppInstance(name); ai != nil {
+		t.Fatalf("AppInstance %s was created despite injected ApiError", name)
+	}
+	// The fault only fires once, so a retry succeeds
+	_, _, cleanf := createVolume(t, client, v)
+	cleanf()
+}
+
+func TestCreateSnapshotDuplicate(t *testing.T) {
+	client := getClient(t)
+	v := &VolOpts{
+		Size:            5,
+		Replica:         1,
+		IpPool:          "default",
+		PlacementPolicy: "default",
+	}
+	_, vol, cleanv := createVolume(t, client, v)
+	defer cleanv()
+	name := "my-test-snap-" + dsdk.RandString(5)
+	snap, err := vol.CreateSnapshot(name, &SnapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.DeleteSnapshot(snap.Id)
+	snap2, err := vol.CreateSnapshot(name, &SnapOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Id != snap2.Id {
+		t.Fatalf("Duplicate snapshot create returned a different snapshot: [%s] != [%s]", snap.Id, snap2.Id)
+	}
+}
+
+func TestListSnapshotsPaged(t *testing.T) {
+	defer func() { srv.NoTenantSnapshots = false }()
+	for _, noTenant := range []bool{false, true} {
+		srv.NoTenantSnapshots = noTenant
+		client := getClient(t)
+		v := &VolOpts{
+			Size:            5,
+			Replica:         1,
+			IpPool:          "default",
+			PlacementPolicy: "default",
+		}
+		want := map[string]bool{}
+		var snaps []*Snapshot
+		for i := 0; i < 2; i++ {
+			_, vol, cleanv := createVolume(t, client, v)
+			defer cleanv()
+			for j := 0; j < 2; j++ {
+				snap, err := vol.CreateSnapshot("my-test-snap-"+dsdk.RandString(5), &SnapOpts{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				snaps = append(snaps, snap)
+				want[snap.CsiId()] = true
+			}
+			// Not created by the plugin, so never listed
+			other, apierr, err := vol.Ai.StorageInstances[0].Volumes[0].SnapshotsEp.Create(&dsdk.SnapshotsCreateRequest{
+				Ctxt: vol.ctxt,
+			})
+			if err != nil || apierr != nil {
+				t.Fatal(err, apierr)
+			}
+			defer vol.DeleteSnapshot(other.UtcTs)
+		}
+		defer func() {
+			for _, snap := range snaps {
+				snap.Vol.DeleteSnapshot(snap.Id)
+			}
+		}()
+
+		perVol := "^/app_instances/[^/]+/storage_instances/[^/]+/volumes/[^/]+/snapshots$"
+		tenantCalls, volCalls := srv.Calls("GET", "^/snapshots$"), srv.Calls("GET", perVol)
+		listCalls, getCalls := srv.Calls("GET", "^/app_instances$"), 0
+		seen := map[string]bool{}
+		token := ""
+		for page := 0; ; page++ {
+			gets := srv.Calls("GET", "^/app_instances/[^/]+$")
+			rsnaps, next, err := client.ListSnapshots("", "", 1, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			getCalls += srv.Calls("GET", "^/app_instances/[^/]+$") - gets
+			for _, snap := range rsnaps {
+				if seen[snap.CsiId()] {
+					t.Fatalf("Snapshot %s listed twice", snap.CsiId())
+				}
+				seen[snap.CsiId()] = true
+				if !want[snap.CsiId()] {
+					continue
+				}
+				// Deleting entries already returned must not shift later pages
+				if err = snap.Vol.DeleteSnapshot(snap.Id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if next == "" {
+				break
+			}
+			if page > 20 {
+				t.Fatalf("Too many pages, last token: %s", next)
+			}
+			token = next
+		}
+		for id := range want {
+			if !seen[id] {
+				t.Errorf("Snapshot %s was not listed (tenant listing disabled: %t)", id, noTenant)
+			}
+		}
+		if n := len(seen) - len(want); n != 0 {
+			t.Errorf("Listed %d snapshots not created by the plugin", n)
+		}
+		tenantCalls = srv.Calls("GET", "^/snapshots$") - tenantCalls
+		volCalls = srv.Calls("GET", perVol) - volCalls
+		if !noTenant && (tenantCalls == 0 || volCalls != 0) {
+			t.Errorf("Expected only tenant wide listings, got %d tenant and %d volume listings", tenantCalls, volCalls)
+		}
+		if noTenant && (tenantCalls != 1 || volCalls == 0) {
+			t.Errorf("Expected a single tenant wide attempt before falling back, got %d tenant and %d volume listings", tenantCalls, volCalls)
+		}
+		// Tenant wide, only the parents of the snapshots on each page are
+		// fetched
+		listCalls = srv.Calls("GET", "^/app_instances$") - listCalls
+		if !noTenant && (listCalls != 0 || getCalls > tenantCalls) {
+			t.Errorf("Expected no volume listing and a volume per page, got %d listings and %d volumes for %d pages", listCalls, getCalls, tenantCalls)
+		}
+	}
+}
+
+func TestFormatMountFakeHost(t *testing.T) {
+	client := getClient(t)
+	h := fh.New()
+	client.SetHostExecutor(h)
+	v := &VolOpts{
+		Size:            5,
+		Replica:         1,
+		IpPool:          "default",
+		PlacementPolicy: "default",
+	}
+	_, vol, cleanv := createVolume(t, client, v)
+	defer cleanv()
+	if err := vol.Login(false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if vol.DevicePath != h.DevicePath {
+		t.Fatalf("Device Path not populated from iSCSI login: [%s] != [%s]", vol.DevicePath, h.DevicePath)
+	}
+	if err := vol.Format("xfs", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	// A second format must detect the existing filesystem and skip mkfs
+	if err := vol.Format("xfs", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.Ran("mkfs.xfs"); n != 1 {
+		t.Fatalf("Expected 1 mkfs.xfs call, found %d", n)
+	}
+	dest := "/mnt/my-dir-" + dsdk.RandString(5)
+	if err := vol.Mount(dest, []string{}, "xfs"); err != nil {
+		t.Fatal(err)
+	}
+	if dev := h.Mounted(dest); dev != h.DevicePath {
+		t.Fatalf("Volume not mounted at %s: [%s] != [%s]", dest, dev, h.DevicePath)
+	}
+	if err := vol.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.Logout(false, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsMountPointFakeHost(t *testing.T) {
+	h := fh.New()
+	ctxt := context.Background()
+	dev := "/dev/sdz"
+	h.AddDevice(dev, 0, "ext4")
+	for _, dir := range []string{"/mnt/my dir", "/mnt/it's"} {
+		if err := h.MkdirAll(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := h.Run(ctxt, "mount", dev, dir); err != nil {
+			t.Fatal(out, err)
+		}
+	}
+	for path, want := range map[string]bool{
+		"/mnt/my dir": true,
+		"/mnt/it's":   true,
+		"/mnt/my":     false,
+		"/mnt":        false,
+	} {
+		if got, err := isMountPoint(ctxt, h, path); err != nil || got != want {
+			t.Errorf("isMountPoint(%q) = %t, %v; want %t", path, got, err, want)
+		}
+	}
+	if got, err := deviceFromMount(ctxt, h, "/mnt/my dir"); err != nil || got != dev {
+		t.Errorf("deviceFromMount = %s, %v; want %s", got, err, dev)
+	}
+}
+
+func TestSelectPortals(t *testing.T) {
+	ips := []string{"172.28.0.1", "172.28.0.2", "172.28.0.3", "172.28.0.4"}
+	if sel := SelectPortals(ips[:1], "node-a/vol"); !reflect.DeepEqual(sel, ips[:1]) {
+		t.Fatalf("A single portal must always be selected, got %v", sel)
+	}
+	sel := SelectPortals(ips, "node-a/vol")
+	if len(sel) != 2 {
+		t.Fatalf("Expected 2 of 4 portals to be selected, got %v", sel)
+	}
+	reversed := []string{ips[3], ips[2], ips[1], ips[0]}
+	if again := SelectPortals(reversed, "node-a/vol"); !reflect.DeepEqual(again, sel) {
+		t.Fatalf("Selection changed with the portal order: %v != %v", again, sel)
+	}
+	used := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		for _, ip := range SelectPortals(ips, fmt.Sprintf("node-%d/vol", i)) {
+			used[ip] = true
+		}
+	}
+	if len(used) != len(ips) {
+		t.Fatalf("Expected nodes to be spread over every portal, only %v were used", used)
+	}
+}
+
+func TestLoginMultipathFakeHost(t *testing.T) {
+	client := getClient(t)
+	h := fh.New()
+	client.SetHostExecutor(h)
+	vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", Iqn: "iqn.fake", Ips: []string{"172.28.0.1", "172.28.0.2"}}
+	if err := vol.Login(true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if vol.DevicePath != h.MultipathDevice() {
+		t.Fatalf("Device Path is not the multipath device: [%s] != [%s]", vol.DevicePath, h.MultipathDevice())
+	}
+	if paths := h.MultipathPaths(h.MultipathMap); len(paths) != 2 {
+		t.Fatalf("Expected a path per portal, got %v", paths)
+	}
+	h.FailPath(h.MultipathPaths(h.MultipathMap)[1])
+	st, err := client.MultipathStatus(vol.DevicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st == nil || len(st.Paths) != 2 || st.Active() != 1 {
+		t.Fatalf("Expected 1 of 2 paths to be active, got %#v", st)
+	}
+	if err := vol.Logout(true, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.Ran("multipath -f " + h.MultipathMap); n != 1 {
+		t.Fatalf("Expected the map to be flushed once, found %d calls", n)
+	}
+	if paths := h.MultipathPaths(h.MultipathMap); paths != nil {
+		t.Fatalf("Multipath map left behind with paths %v", paths)
+	}
+
+	// round_robin only logs out of the portals it logged into
+	vol.Ips = []string{"172.28.0.1", "172.28.0.2", "172.28.0.3", "172.28.0.4"}
+	if err := vol.Login(true, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.Logout(true, true); err != nil {
+		t.Fatal(err)
+	}
+	loggedIn := []string{}
+	for _, target := range h.Connects()[1].Targets {
+		loggedIn = append(loggedIn, target.Portal)
+	}
+	disconnects := h.DisconnectPortals()
+	if got := disconnects[len(disconnects)-1]; len(loggedIn) != 2 || !reflect.DeepEqual(got, loggedIn) {
+		t.Fatalf("Logged into %v but out of %v", loggedIn, got)
+	}
+
+	// round_robin with a single portal
+	vol.Ips = vol.Ips[:1]
+	if err := vol.Login(true, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := vol.Logout(true, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// multipathd not running
+	defer func(r int) { multipathRetries = r }(multipathRetries)
+	multipathRetries = 0
+	h.MultipathMap = ""
+	if err := vol.Login(true, false, nil); err == nil || !strings.Contains(err.Error(), "No multipath device") {
+		t.Fatalf("Expected login to fail without a multipath device, got %v", err)
+	}
+}
+
+func TestLoginIscsiSettings(t *testing.T) {
+	client := getClient(t)
+	h := fh.New()
+	client.SetHostExecutor(h)
+	vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", Iqn: "iqn.fake", Ips: []string{"172.28.0.1"}}
+	if err := vol.Login(false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := h.Connects()[0]; !c.DoDiscovery || c.RetryCount != 3 || c.Targets[0].Port != "3260" {
+		t.Fatalf("Login without settings changed: %#v", c)
+	}
+	if n := len(h.Discovers()) + h.Ran("iscsiadm -m node -T iqn.fake -p 172.28.0.1:3260 -o update"); n != 0 {
+		t.Fatalf("Expected node records to be left alone without settings")
+	}
+	vol.Iscsi = &IscsiSettings{Port: 3261, ReplacementTimeout: 5, QueueDepth: 64, LoginRetryCount: 10}
+	if err := vol.Login(false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(h.Discovers()); n != 1 {
+		t.Fatalf("Expected node records to be discovered before updating them, found %d discoveries", n)
+	}
+	update := "iscsiadm -m node -T iqn.fake -p 172.28.0.1:3261 -o update" +
+		" -n node.session.timeo.replacement_timeout -v 5" +
+		" -n node.session.queue_depth -v 64" +
+		" -n node.session.initial_login_retry_max -v 10"
+	if n := h.Ran(update); n != 1 {
+		t.Fatalf("Expected the settings to be applied once, found %d updates in %v", n, h.Commands())
+	}
+	if c := h.Connects()[1]; c.DoDiscovery || c.RetryCount != 10 || c.Targets[0].Port != "3261" {
+		t.Fatalf("Login did not use the settings: %#v", c)
+	}
+}
+
+func TestLoginIscsiSettingsUndiscoveredPortal(t *testing.T) {
+	client := getClient(t)
+	h := fh.New()
+	client.SetHostExecutor(h)
+	vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", Iqn: "iqn.fake", Ips: []string{"172.28.0.1", "172.28.0.2"}}
+	vol.Iscsi = &IscsiSettings{QueueDepth: 64}
+	noRecord := fh.Response{Out: "iscsiadm: No records found", Err: &fh.ExitError{Cmd: "iscsiadm", Code: 21}}
+	h.On("iscsiadm -m node -T iqn.fake -p 172.28.0.2:3260 -o update", noRecord)
+	if err := vol.Login(false, false, nil); err != nil {
+		t.Fatalf("Expected login to skip the undiscovered portal, got %v", err)
+	}
+	if n := h.Ran("iscsiadm -m node -T iqn.fake -p 172.28.0.1:3260 -o update"); n != 1 {
+		t.Fatalf("Expected the settings to be applied to the discovered portal, found %d updates", n)
+	}
+	if n := len(h.Connects()); n != 1 {
+		t.Fatalf("Expected a single login, found %d", n)
+	}
+
+	// No portal was discovered
+	h.On("iscsiadm -m node -T iqn.fake -p 172.28.0.1:3260 -o update", noRecord)
+	if err := vol.Login(false, false, nil); err == nil || !strings.Contains(err.Error(), "No records found") {
+		t.Fatalf("Expected login to fail without any node records, got %v", err)
+	}
+	if n := len(h.Connects()); n != 1 {
+		t.Fatalf("Expected no login without any node records, found %d", n)
+	}
+}
+
+func TestFormatRetry(t *testing.T) {
+	client := getClient(t)
+	h := fh.New()
+	client.SetHostExecutor(h)
+	h.AddDevice("/dev/sdz", 5*1024*1024*1024, "")
+	busy := fh.Response{Out: "/dev/sdz: Device or resource busy while setting up superblock", Err: fmt.Errorf("exit status 1")}
+	h.On("mkfs.ext4", busy, fh.Response{})
+	vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", DevicePath: "/dev/sdz"}
+	if err := vol.Format("ext4", []string{}, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.Ran("mkfs.ext4"); n != 2 {
+		t.Fatalf("Expected mkfs.ext4 to be retried once, found %d calls", n)
+	}
+	if n := h.Ran("blkid"); n != 2 {
+		t.Fatalf("Expected the device to be probed again before the retry, found %d blkid calls", n)
+	}
+}
+
+func TestFormatNoRetry(t *testing.T) {
+	client := getClient(t)
+	busy := fh.Response{Out: "/dev/sdz: Device or resource busy while setting up superblock", Err: fmt.Errorf("exit status 1")}
+	for _, tc := range []struct {
+		name  string
+		mkfs  fh.Response
+		blkid []fh.Response
+	}{
+		{"not retryable", fh.Response{Out: "mkfs.ext4: invalid blocks '-E' on device", Err: fmt.Errorf("exit status 1")}, nil},
+		// Something formatted the device after mkfs failed
+		{"formatted meanwhile", busy, []fh.Response{
+			{Err: &fh.ExitError{Cmd: "blkid", Code: 2}},
+			{Out: "TYPE=xfs\nUSAGE=filesystem\n"},
+		}},
+	} {
+		h := fh.New()
+		client.SetHostExecutor(h)
+		h.AddDevice("/dev/sdz", 5*1024*1024*1024, "")
+		h.On("mkfs.ext4", tc.mkfs)
+		if tc.blkid != nil {
+			h.On("blkid", tc.blkid...)
+		}
+		vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", DevicePath: "/dev/sdz"}
+		if err := vol.Format("ext4", []string{}, 5, false); err == nil {
+			t.Errorf("%s: expected Format to fail", tc.name)
+		}
+		if n := h.Ran("mkfs.ext4"); n != 1 {
+			t.Errorf("%s: expected mkfs.ext4 to run once, found %d calls", tc.name, n)
+		}
+	}
+}
+
+func TestFormatRefusesNonEmpty(t *testing.T) {
+	client := getClient(t)
+	tests := []struct {
+		name  string
+		setup func(h *fh.Host, dev string)
+		sig   string
+	}{
+		{"gpt", func(h *fh.Host, dev string) { h.SetDeviceData(dev, 512, []byte("EFI PART")) }, "gpt partition table"},
+		{"lvm", func(h *fh.Host, dev string) { h.SetDeviceData(dev, 512, []byte("LABELONE")) }, "LVM2 member"},
+		{"luks", func(h *fh.Host, dev string) { h.SetDeviceData(dev, 0, []byte("LUKS\xba\xbe")) }, "LUKS header"},
+		{"raid", func(h *fh.Host, dev string) { h.SetDeviceData(dev, 4096, []byte{0xfc, 0x4e, 0x2b, 0xa9}) }, "linux raid member"},
+		{"data", func(h *fh.Host, dev string) { h.SetDeviceData(dev, 8192, []byte("hello")) }, "non-zero data"},
+		{"blkid", func(h *fh.Host, dev string) {
+			h.On("blkid", fh.Response{Out: "DEVNAME=" + dev + "\nTYPE=crypto_LUKS\nUSAGE=crypto\n"})
+		}, "crypto_LUKS"},
+		{"wipefs", func(h *fh.Host, dev string) {
+			h.On("wipefs", fh.Response{Out: "# offset,uuid,label,type\n0x218,,,LVM2_member\n"})
+		}, "LVM2_member"},
+	}
+	for _, test := range tests {
+		h := fh.New()
+		client.SetHostExecutor(h)
+		h.AddDevice("/dev/sdz", 5*1024*1024*1024, "")
+		test.setup(h, "/dev/sdz")
+		vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", DevicePath: "/dev/sdz"}
+		err := vol.Format("ext4", []string{}, 5, false)
+		if _, ok := err.(*DeviceNotEmptyError); !ok || !strings.Contains(err.Error(), test.sig) {
+			t.Errorf("%s: expected a DeviceNotEmptyError mentioning %q, got: %v", test.name, test.sig, err)
+		}
+		if n := h.Ran("mkfs.ext4"); n != 0 {
+			t.Errorf("%s: non-empty device was formatted", test.name)
+		}
+		if err = vol.Format("ext4", []string{}, 5, true); err != nil {
+			t.Errorf("%s: forced format failed: %s", test.name, err)
+		}
+		if n := h.Ran("mkfs.ext4"); n != 1 {
+			t.Errorf("%s: expected forced format to run mkfs once, found %d calls", test.name, n)
+		}
+	}
+	// A failed probe never formats, even when forced
+	h := fh.New()
+	client.SetHostExecutor(h)
+	h.AddDevice("/dev/sdz", 5*1024*1024*1024, "")
+	h.On("blkid", fh.Response{Err: &fh.ExitError{Cmd: "blkid", Code: 4}})
+	vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", DevicePath: "/dev/sdz"}
+	if err := vol.Format("ext4", []string{}, 5, true); err == nil || h.Ran("mkfs.ext4") != 0 {
+		t.Fatalf("Device was formatted after blkid failed: %v", err)
+	}
+	client.SetHostExecutor(nil)
+}
+
+func TestFsckReplaysXfsLog(t *testing.T) {
+	client := getClient(t)
+	h := fh.New()
+	client.SetHostExecutor(h)
+	defer client.SetHostExecutor(nil)
+	h.AddDevice("/dev/sdz", 5*1024*1024*1024, "xfs")
+	// The -n check ignores the dirty log and finds spurious inconsistencies
+	h.On("xfs_repair -n", fh.Response{
+		Out: "ALERT: The filesystem has valuable metadata changes in a log which is being ignored because the -n option was used.  Expect spurious inconsistencies which may be resolved by first mounting the filesystem to replay the log.\nagi unlinked bucket 3 is 67 (should be null)",
+		Err: &fh.ExitError{Cmd: "xfs_repair", Code: 1},
+	}, fh.Response{})
+	vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", DevicePath: "/dev/sdz"}
+	res, err := vol.Fsck("xfs", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != co.FsckClean {
+		t.Fatalf("Unexpected fsck result after log replay: %s", res)
+	}
+	if n := h.Ran("mount -t xfs /dev/sdz"); n != 1 {
+		t.Fatalf("Expected the log to be replayed by mounting once, found %d mounts", n)
+	}
+	if n := h.Ran("xfs_repair -n /dev/sdz"); n != 2 {
+		t.Fatalf("Expected xfs_repair before and after the log replay, found %d calls", n)
+	}
+	h.On("xfs_repair -n", fh.Response{Out: "agi unlinked bucket 3 is 67 (should be null)", Err: &fh.ExitError{Cmd: "xfs_repair", Code: 1}})
+	if _, err = vol.Fsck("xfs", true); err == nil {
+		t.Fatal("Expected an FsckError for a corrupted filesystem")
+	} else if _, ok := err.(*FsckError); !ok {
+		t.Fatalf("Expected an FsckError, got: %s", err)
+	}
+}
+
+func TestFsckReplaysExt4Journal(t *testing.T) {
+	client := getClient(t)
+	h := fh.New()
+	client.SetHostExecutor(h)
+	defer client.SetHostExecutor(nil)
+	h.AddDevice("/dev/sdz", 5*1024*1024*1024, "ext4")
+	h.On("e2fsck -n",
+		fh.Response{Out: "Warning: skipping journal recovery because doing a read-only filesystem check.\n/dev/sdz: clean, 11/65536 files, 12955/262144 blocks"},
+		fh.Response{Out: "/dev/sdz: clean, 11/65536 files, 12955/262144 blocks"})
+	vol := &Volume{ctxt: client.ctxt, dc: client, Name: "fake", DevicePath: "/dev/sdz"}
+	res, err := vol.Fsck("ext4", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != co.FsckClean {
+		t.Fatalf("Unexpected fsck result after journal recovery: %s", res)
+	}
+	if n := h.Ran("mount -t ext4 /dev/sdz"); n != 1 {
+		t.Fatalf("Expected the journal to be recovered by mounting once, found %d mounts", n)
+	}
+	if n := h.Ran("e2fsck -n /dev/sdz"); n != 2 {
+		t.Fatalf("Expected e2fsck before and after the journal recovery, found %d calls", n)
+	}
+}
+
+func TestCheckDeviceSize(t *testing.T) {
+	defer func(r int, i time.Duration) { deviceSizeRetries, deviceSizeInterval = r, i }(deviceSizeRetries, deviceSizeInterval)
+	deviceSizeRetries, deviceSizeInterval = 2, time.Millisecond
+	client := getClient(t)
+	h := fh.New()
+	h.AddDevice("/dev/sdz", 5*units.GiB, "")
+	if err := checkDeviceSize(client.ctxt, h, "/dev/sdz", 5); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.Ran("blockdev --getsize64 /dev/sdz"); n != 1 {
+		t.Fatalf("Expected a single size check, found %d", n)
+	}
+	if err := checkDeviceSize(client.ctxt, h, "/dev/sdz", 10); err == nil {
+		t.Fatal("Expected a device smaller than requested to time out")
+	}
+	if n := h.Ran("iscsiadm -m session -R"); n != 4 {
+		t.Fatalf("Expected the sessions to be rescanned on every check, found %d rescans", n)
+	}
+}
+
+func TestForContext(t *testing.T) {
+	client := getClient(t)
+	shared := client.ctxt
+	c1 := client.ForContext(co.WithCtxt(context.Background(), "CreateVolume", "trace-1"))
+	c2 := client.ForContext(co.WithCtxt(context.Background(), "DeleteVolume", "trace-2"))
+	if client.ctxt != shared {
+		t.Fatal("ForContext modified the shared client")
+	}
+	if tid := c1.ctxt.Value(co.TraceId); tid != "trace-1" {
+		t.Fatalf("Client copy lost its trace id: [%v] != [trace-1]", tid)
+	}
+	_, vol, cleanf := createVolume(t, c2, &VolOpts{
+		Size:            5,
+		Replica:         1,
+		IpPool:          "default",
+		PlacementPolicy: "default",
+	})
+	defer cleanf()
+	if tid := vol.ctxt.Value(co.TraceId); tid != "trace-2" {
+		t.Fatalf("Volume did not inherit the client trace id: [%v] != [trace-2]", tid)
+	}
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"os"
+
+	iscsi "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	unix "golang.org/x/sys/unix"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// HostExecutor is everything the node side of the driver does to the host
+// it's running on.  Swapping it out (see pkg/fakehost) allows the node
+// operations to be exercised without root, iscsiadm or real block devices
+type HostExecutor interface {
+	// Run a command, returning the combined stdout/stderr
+	Run(ctxt context.Context, cmd ...string) (string, error)
+	Stat(path string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	RemoveAll(path string) error
+	// Major and minor numbers of a block device
+	MajorMinor(device string) (uint32, uint32, error)
+	Statfs(path string, buf *unix.Statfs_t) error
+	// Read from a file or block device at offset off
+	ReadAt(path string, buf []byte, off int64) (int, error)
+	// Create the node records IscsiConnect would, without logging in
+	IscsiDiscover(c iscsi.Connector) error
+	IscsiConnect(c iscsi.Connector) (string, error)
+	IscsiDisconnect(iqn string, portals []string) error
+}
+
+// DefaultHost executes everything against the real host
+var DefaultHost HostExecutor = &osHost{}
+
+type osHost struct{}
+
+func (h *osHost) Run(ctxt context.Context, cmd ...string) (string, error) {
+	return co.RunCmd(ctxt, cmd...)
+}
+
+func (h *osHost) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (h *osHost) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (h *osHost) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (h *osHost) MajorMinor(device string) (uint32, uint32, error) {
+	s := unix.Stat_t{}
+	if err := unix.Stat(device, &s); err != nil {
+		return 0, 0, err
+	}
+	dev := uint64(s.Rdev)
+	return unix.Major(dev), unix.Minor(dev), nil
+}
+
+func (h *osHost) Statfs(path string, buf *unix.Statfs_t) error {
+	return unix.Statfs(path, buf)
+}
+
+func (h *osHost) ReadAt(path string, buf []byte, off int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(buf, off)
+}
+
+// IscsiDiscover runs the discovery (or CHAP record creation) iscsi.Connect
+// does for each target.  Like iscsi.Connect it only fails if every target
+// does
+func (h *osHost) IscsiDiscover(c iscsi.Connector) error {
+	iface := "default"
+	if c.Interface != "" {
+		iface = c.Interface
+	}
+	var lastErr error
+	found := false
+	for _, t := range c.Targets {
+		p := t.Portal + ":" + t.Port
+		var err error
+		if c.DoDiscovery {
+			err = iscsi.Discoverydb(p, iface, c.DiscoverySecrets, c.DoCHAPDiscovery)
+		}
+		if err == nil && c.DoCHAPDiscovery {
+			err = iscsi.CreateDBEntry(t.Iqn, p, iface, c.DiscoverySecrets, c.SessionSecrets)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return lastErr
+	}
+	return nil
+}
+
+func (h *osHost) IscsiConnect(c iscsi.Connector) (string, error) {
+	return iscsi.Connect(c)
+}
+
+func (h *osHost) IscsiDisconnect(iqn string, portals []string) error {
+	return iscsi.Disconnect(iqn, portals)
+}
+
+// SetHostExecutor replaces the executor used by every Volume returned from
+// this client.  Passing nil restores DefaultHost
+func (r *DateraClient) SetHostExecutor(h HostExecutor) {
+	r.host = h
+}
+
+func (v *Volume) host() HostExecutor {
+	if v.dc != nil {
+		return v.dc.hostExecutor()
+	}
+	return DefaultHost
+}
+
+func (r *DateraClient) hostExecutor() HostExecutor {
+	if r.host != nil {
+		return r.host
+	}
+	return DefaultHost
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	iscsi "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+const (
+	DefaultIscsiPort = 3260
+	// Times csi-lib-iscsi checks for the device after logging into a portal
+	defaultLoginRetries = 3
+)
+
+// IscsiSettings tunes the iSCSI sessions of a volume.  Zero values keep the
+// node's iscsid.conf settings
+type IscsiSettings struct {
+	// Port of the volume's portals, DefaultIscsiPort if 0
+	Port int
+	// node.session.timeo.replacement_timeout
+	ReplacementTimeout int
+	// node.conn[0].timeo.noop_out_interval
+	NoopOutInterval int
+	// node.session.queue_depth
+	QueueDepth int
+	// node.session.initial_login_retry_max, also how many times the device
+	// is checked for after logging in
+	LoginRetryCount int
+}
+
+// Parameters IscsiSettingsFromMetadata reads
+var iscsiParams = map[string]bool{
+	"iscsi_port":          true,
+	"replacement_timeout": true,
+	"noop_out_interval":   true,
+	"queue_depth":         true,
+	"login_retry_count":   true,
+}
+
+// IscsiSettingsFromMetadata returns the iSCSI settings stored with a volume.
+// Volumes created before they existed get the defaults
+func IscsiSettingsFromMetadata(md VolMetadata) (*IscsiSettings, error) {
+	vo := &VolOpts{}
+	for _, p := range VolParams {
+		if !iscsiParams[p.Name] {
+			continue
+		}
+		v, ok := md[p.MdKey]
+		if !ok || v == "" {
+			v = p.Default
+		}
+		if err := p.validate(v); err != nil {
+			return nil, err
+		}
+		p.set(vo, v)
+	}
+	return &IscsiSettings{
+		Port:               vo.IscsiPort,
+		ReplacementTimeout: vo.ReplacementTimeout,
+		NoopOutInterval:    vo.NoopOutInterval,
+		QueueDepth:         vo.QueueDepth,
+		LoginRetryCount:    vo.LoginRetryCount,
+	}, nil
+}
+
+func (s *IscsiSettings) port() string {
+	if s == nil || s.Port == 0 {
+		return strconv.Itoa(DefaultIscsiPort)
+	}
+	return strconv.Itoa(s.Port)
+}
+
+func (s *IscsiSettings) retries() int {
+	if s == nil || s.LoginRetryCount == 0 {
+		return defaultLoginRetries
+	}
+	return s.LoginRetryCount
+}
+
+// updates returns the iscsiadm arguments setting every non-zero value
+func (s *IscsiSettings) updates() []string {
+	args := []string{}
+	if s == nil {
+		return args
+	}
+	add := func(name string, v int) {
+		if v > 0 {
+			args = append(args, "-n", name, "-v", strconv.Itoa(v))
+		}
+	}
+	add("node.session.timeo.replacement_timeout", s.ReplacementTimeout)
+	add("node.conn[0].timeo.noop_out_interval", s.NoopOutInterval)
+	add("node.session.queue_depth", s.QueueDepth)
+	add("node.session.initial_login_retry_max", s.LoginRetryCount)
+	return args
+}
+
+// applyIscsiSettings writes the volume's settings to the node records of
+// c's targets before they're logged into.  Discovery (or creating the CHAP
+// records) would reset the records to the iscsid.conf defaults, so it's done
+// first and c is left to only log in.  Sessions that already exist keep
+// their settings until they're logged into again
+func (v *Volume) applyIscsiSettings(ctxt context.Context, c *iscsi.Connector) error {
+	updates := v.Iscsi.updates()
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := v.host().IscsiDiscover(*c); err != nil {
+		return err
+	}
+	// Discovery succeeds if any portal answered.  Like iscsi.Connect, skip
+	// the portals that have no node record rather than failing the login
+	var lastErr error
+	applied := false
+	for _, t := range c.Targets {
+		cmd := append([]string{"iscsiadm", "-m", "node", "-T", t.Iqn, "-p", t.Portal + ":" + t.Port, "-o", "update"}, updates...)
+		if out, err := v.host().Run(ctxt, cmd...); err != nil {
+			lastErr = fmt.Errorf("Could not apply iSCSI settings to %s: %s %s", t.Portal, err, out)
+			co.Warning(ctxt, lastErr)
+			continue
+		}
+		applied = true
+	}
+	if !applied {
+		return lastErr
+	}
+	co.Debugf(ctxt, "Applied iSCSI settings %v to %s", updates, v.Iqn)
+	c.DoDiscovery = false
+	c.DoCHAPDiscovery = false
+	return nil
+}
@@ -3,41 +3,36 @@ package client
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"os"
-	"time"
+	"regexp"
+	"strconv"
+	"strings"
 
 	iscsi "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
 
 	co "github.com/Datera/datera-csi/pkg/common"
+	tracing "github.com/Datera/datera-csi/pkg/tracing"
 )
 
-func robin() int {
-	// Gen new source each time
-	s := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(s)
-	return r.Intn(2)
-}
-
+// Login connects this node to the volume's target.  With multipath every
+// portal (or with round_robin, this node's share of them) is logged into and
+// DevicePath is the /dev/mapper device multipathd assembles from them
 func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string) error {
 	ctxt := context.WithValue(v.ctxt, co.ReqName, "Login")
 	co.Debugf(ctxt, "Login invoked for %s.  Multipath: %t", v.Name, multipath)
-	var ips []string
-	if multipath {
-		if round_robin {
-			ips = []string{v.Ips[robin()]}
-		} else {
-			ips = v.Ips
-		}
-	} else {
-		if round_robin {
-			co.Warningf(ctxt, "round_robin not supported on non-multipath environments")
-		}
-		ips = []string{v.Ips[0]}
+	if len(v.Ips) == 0 {
+		err := fmt.Errorf("Volume %s has no portals to log into", v.Name)
+		co.Error(ctxt, err)
+		return err
 	}
+	if !multipath && round_robin {
+		co.Warningf(ctxt, "round_robin not supported on non-multipath environments")
+	}
+	ips := v.portals(multipath, round_robin)
+	co.Debugf(ctxt, "Logging into portals %s of %s", ips, v.Ips)
 	var targets []iscsi.TargetInfo
 	for _, Ip := range ips {
-		targets = append(targets, iscsi.TargetInfo{v.Iqn, Ip, "3260"})
+		targets = append(targets, iscsi.TargetInfo{Iqn: v.Iqn, Portal: Ip, Port: v.Iscsi.port()})
 	}
 
 	secrets := iscsi.Secrets{}
@@ -46,7 +41,7 @@ func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string
 	c.Targets = targets
 	c.Lun = 0
 	c.Multipath = multipath
-	c.RetryCount = 3
+	c.RetryCount = int32(v.Iscsi.retries())
 
 	if len(chapParams) != 0 {
 		secrets.SecretsType = "chap"
@@ -84,7 +79,14 @@ func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string
 	}
 
 	co.Debugf(ctxt, "ISCSI Connector: %#v", iscsi_conn)
-	path, err := iscsi.Connect(c)
+	if err := v.applyIscsiSettings(ctxt, &c); err != nil {
+		co.Error(ctxt, err)
+		return err
+	}
+	sctxt, end := tracing.Start(ctxt, "iscsi.Connect", tracing.Internal)
+	tracing.Annotate(sctxt, "iscsi.iqn", v.Iqn, "iscsi.portals", strings.Join(ips, ","))
+	path, err := v.host().IscsiConnect(c)
+	end(err)
 	if err != nil {
 		co.Error(ctxt, err)
 		return err
@@ -94,15 +96,53 @@ func (v *Volume) Login(multipath, round_robin bool, chapParams map[string]string
 		co.Error(ctxt, err)
 		return err
 	}
+	if multipath {
+		if path, err = waitMultipath(ctxt, v.host(), path, len(ips)); err != nil {
+			co.Error(ctxt, err)
+			return err
+		}
+	}
 	v.DevicePath = path
 	co.Debugf(ctxt, "DevicePath for volume %s: %s", v.Name, v.DevicePath)
 	return nil
 }
 
-func (v *Volume) Logout() error {
+// portals returns the portals Login logs into and Logout disconnects from
+func (v *Volume) portals(multipath, round_robin bool) []string {
+	if len(v.Ips) == 0 {
+		return nil
+	}
+	if !multipath {
+		return []string{v.Ips[0]}
+	}
+	if round_robin {
+		return SelectPortals(v.Ips, co.GetHost()+"/"+v.Name)
+	}
+	return v.Ips
+}
+
+// Logout disconnects this node from the volume's target, flushing the
+// multipath map first if DevicePath is one.  multipath and round_robin must
+// be what the volume was logged in with
+func (v *Volume) Logout(multipath, round_robin bool) error {
 	ctxt := context.WithValue(v.ctxt, co.ReqName, "Logout")
 	co.Debugf(ctxt, "Logout invoked for %s", v.Name)
-	err := iscsi.Disconnect(v.Iqn, v.Ips)
+	if err := flushMultipath(ctxt, v.host(), v.DevicePath); err != nil {
+		co.Error(ctxt, err)
+		return err
+	}
+	ips := v.portals(multipath, round_robin)
+	sctxt, end := tracing.Start(ctxt, "iscsi.Disconnect", tracing.Internal)
+	tracing.Annotate(sctxt, "iscsi.iqn", v.Iqn, "iscsi.portals", strings.Join(ips, ","))
+	portals := ips
+	if port := v.Iscsi.port(); port != strconv.Itoa(DefaultIscsiPort) {
+		portals = []string{}
+		for _, ip := range ips {
+			portals = append(portals, ip+":"+port)
+		}
+	}
+	err := v.host().IscsiDisconnect(v.Iqn, portals)
+	end(err)
 	if err != nil {
 		co.Error(ctxt, err)
 		return err
@@ -111,6 +151,55 @@ func (v *Volume) Logout() error {
 	return nil
 }
 
+// The udev link of an iSCSI path: portal ip, port and target iqn
+var byPathRe = regexp.MustCompile(`^disk/by-path/ip-(.+):(\d+)-iscsi-(.+)-lun-\d+$`)
+
+// FindTarget sets the volume's Iqn, Ips and port from the iSCSI paths of the
+// device mounted at path, so a volume whose target wasn't recorded can still
+// be logged out of.  DevicePath is set to the device, its multipath map if
+// it's part of one
+func (v *Volume) FindTarget(path string) error {
+	ctxt := context.WithValue(v.ctxt, co.ReqName, "FindTarget")
+	co.Debugf(ctxt, "FindTarget invoked for %s at %s", v.Name, path)
+	h := v.host()
+	device, err := deviceFromMount(ctxt, h, path)
+	if err != nil {
+		return err
+	}
+	paths := []string{device}
+	st, err := multipathStatus(ctxt, h, device)
+	if err != nil {
+		co.Warning(ctxt, err)
+	} else if st != nil {
+		device, paths = st.Device(), []string{}
+		for _, p := range st.Paths {
+			paths = append(paths, p.Device)
+		}
+	}
+	iqn, port, ips := "", 0, []string{}
+	for _, p := range paths {
+		out, err := h.Run(ctxt, "udevadm", "info", "--query=symlink", "--name="+p)
+		if err != nil {
+			co.Warningf(ctxt, "Could not read the udev links of %s: %s %s", p, err, out)
+			continue
+		}
+		for _, link := range strings.Fields(out) {
+			if m := byPathRe.FindStringSubmatch(link); m != nil {
+				ips = append(ips, m[1])
+				port, _ = strconv.Atoi(m[2])
+				iqn = m[3]
+			}
+		}
+	}
+	if iqn == "" {
+		return fmt.Errorf("Could not find the iSCSI target of %s mounted at %s", device, path)
+	}
+	v.Iqn, v.Ips, v.DevicePath = iqn, ips, device
+	v.Iscsi = &IscsiSettings{Port: port}
+	co.Debugf(ctxt, "Volume %s is target %s at %s", v.Name, iqn, ips)
+	return nil
+}
+
 func init() {
 	iscsi.EnableDebugLogging(os.Stdout)
 }
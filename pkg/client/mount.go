@@ -2,9 +2,10 @@ package client
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -13,57 +14,184 @@ import (
 	units "github.com/docker/go-units"
 	co "github.com/Datera/datera-csi/pkg/common"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
-	unix "golang.org/x/sys/unix"
 )
 
 var (
 	fsTypeDetect = regexp.MustCompile(`TYPE="(?P<fs>.*?)"`)
 )
 
-func (v *Volume) Format(fsType string, fsArgs []string, timeout int) error {
+// Format creates a filesystem on the volume's device.  A device that already
+// has a supported filesystem is left as it is, anything else found on it
+// (partition tables, LVM, LUKS, RAID or unrecognised data) is a
+// DeviceNotEmptyError unless force is set
+func (v *Volume) Format(fsType string, fsArgs []string, timeout int, force bool) error {
 	ctxt := context.WithValue(v.ctxt, co.ReqName, "Format")
 	co.Debugf(ctxt, "Format invoked for %s", v.Name)
 	if v.Formatted {
 		co.Warningf(ctxt, "Volume %s already formatted: %s, %s", v.Name, v.FsType, v.FsArgs)
 		return nil
-	} else if fs, err := findFs(ctxt, v.DevicePath); err == nil {
+	} else if mnt, err := findMnt(ctxt, v.host(), v.DevicePath); err == nil {
 		v.Formatted = true
-		v.FsType = fs
-		co.Warningf(ctxt, "Volume %s already formatted: %s", v.Name, v.FsType)
+		co.Warningf(ctxt, "Volume %s already formatted and mounted: %s", v.Name, mnt)
 		return nil
-	} else if mnt, err := findMnt(ctxt, v.DevicePath); err == nil {
+	}
+	// Never format without knowing what's on the device, a failed probe
+	// isn't an empty device
+	p, err := probeDevice(ctxt, v.host(), v.DevicePath)
+	if err != nil {
+		err = fmt.Errorf("Could not check %s for existing data, not formatting it: %s", v.DevicePath, err)
+		co.Error(ctxt, err)
+		return err
+	}
+	if p.Fs != "" {
 		v.Formatted = true
-		co.Warningf(ctxt, "Volume %s already formatted and mounted: %s", v.Name, mnt)
+		v.FsType = p.Fs
+		co.Warningf(ctxt, "Volume %s already formatted: %s", v.Name, v.FsType)
 		return nil
 	}
-	if err := format(ctxt, v.DevicePath, fsType, fsArgs, timeout); err != nil {
+	if len(p.Signatures) > 0 {
+		if !force {
+			err = &DeviceNotEmptyError{Device: v.DevicePath, Signatures: p.Signatures}
+			co.Error(ctxt, err)
+			return err
+		}
+		co.Warningf(ctxt, "Formatting %s for volume %s despite existing data (%s), force_format is set",
+			v.DevicePath, v.Name, strings.Join(p.Signatures, ", "))
+	}
+	if err := format(ctxt, v.host(), v.DevicePath, fsType, fsArgs, timeout, force); err != nil {
 		return err
 	}
 	v.FsType = fsType
 	v.FsArgs = fsArgs
+	if len(fsArgs) == 0 {
+		fsp, _ := co.GetFs(fsType)
+		v.FsArgs = fsp.DefaultArgs
+	}
 	return nil
 }
 
-func format(ctxt context.Context, device, fsType string, fsArgs []string, timeout int) error {
-	cmd := append(append([]string{fmt.Sprintf("mkfs.%s", fsType)}, fsArgs...), device)
+// mkfsRetryable are the mkfs failures of a device that isn't ready yet, for
+// a moment after login.  Anything else won't go away by trying again
+var mkfsRetryable = []string{
+	"Device or resource busy",
+	"No such file or directory",
+	"No such device or address",
+}
+
+func isMkfsRetryable(out string) bool {
+	for _, msg := range mkfsRetryable {
+		if strings.Contains(out, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// format runs mkfs on device, retrying for up to timeout seconds while the
+// device isn't ready.  The default mkfs arguments force formatting, so the
+// device is probed again before each retry in case anything was written to
+// it meanwhile
+func format(ctxt context.Context, h HostExecutor, device, fsType string, fsArgs []string, timeout int, force bool) error {
+	fsp, ok := co.GetFs(fsType)
+	if !ok {
+		return fmt.Errorf("Unsupported filesystem type: %s, supported types are %s", fsType, co.FsTypes())
+	}
+	cmd := fsp.MkfsCmd(device, fsArgs)
 	for {
-		if out, err := co.RunCmd(ctxt, cmd...); err != nil {
-			co.Info(ctxt, err)
-			if out != "" && strings.Contains(out, "will not make a filesystem here") {
-				co.Warningf(ctxt, "Device %s is already mounted", device)
-				return err
-			}
-			if timeout < 0 {
-				co.Errorf(ctxt, "Could not format device %s, before timeout reached: %s", device, err.Error())
-				return err
+		out, err := h.Run(ctxt, cmd...)
+		if err == nil {
+			return nil
+		}
+		co.Info(ctxt, err)
+		if !isMkfsRetryable(out) {
+			err = fmt.Errorf("Could not format device %s: %s %s", device, err, out)
+			co.Error(ctxt, err)
+			return err
+		}
+		if timeout < 0 {
+			co.Errorf(ctxt, "Could not format device %s, before timeout reached: %s", device, err.Error())
+			return err
+		}
+		timeout--
+		time.Sleep(time.Second)
+		p, err := probeDevice(ctxt, h, device)
+		if err != nil {
+			err = fmt.Errorf("Could not check %s for existing data, not formatting it: %s", device, err)
+			co.Error(ctxt, err)
+			return err
+		}
+		if p.Fs != "" {
+			err = fmt.Errorf("Device %s has a %s filesystem after mkfs failed, not formatting it again", device, p.Fs)
+			co.Error(ctxt, err)
+			return err
+		}
+		if len(p.Signatures) > 0 && !force {
+			err = &DeviceNotEmptyError{Device: device, Signatures: p.Signatures}
+			co.Error(ctxt, err)
+			return err
+		}
+	}
+}
+
+// FsckError is returned by Fsck for a filesystem left with errors
+type FsckError struct {
+	Device string
+	Output string
+}
+
+func (e *FsckError) Error() string {
+	return fmt.Sprintf("Filesystem on %s has errors: %s", e.Device, e.Output)
+}
+
+// Fsck checks the volume's unmounted filesystem.  Nothing is changed unless
+// repair is set, except that a dirty log is replayed by mounting the
+// filesystem, as mounting it would anyway.  Errors left on the filesystem are
+// returned as an FsckError
+func (v *Volume) Fsck(fs string, repair bool) (co.FsckResult, error) {
+	ctxt := context.WithValue(v.ctxt, co.ReqName, "Fsck")
+	co.Debugf(ctxt, "Fsck invoked for %s.  Repair: %t", v.Name, repair)
+	fsp, ok := co.GetFs(fs)
+	if !ok {
+		return co.FsckFailed, fmt.Errorf("Unsupported filesystem type: %s, supported types are %s", fs, co.FsTypes())
+	}
+	if v.DevicePath == "" {
+		return co.FsckFailed, fmt.Errorf("No device path found for volume %s.  Is the volume logged in?", v.Name)
+	}
+	replayed := false
+	for {
+		cmd := fsp.FsckCmd(v.DevicePath, repair)
+		out, err := v.host().Run(ctxt, cmd...)
+		code := 0
+		if ec, ok := err.(exitCoder); ok {
+			code = ec.ExitCode()
+		} else if err != nil {
+			return co.FsckFailed, err
+		}
+		res := fsp.FsckResult(code, out)
+		co.Infof(ctxt, "%s on %s: %s", fsp.Name, v.DevicePath, res)
+		switch {
+		case res == co.FsckDirtyLog && !replayed:
+			if err = replayLog(ctxt, v.host(), v.DevicePath, fs); err != nil {
+				return co.FsckFailed, err
 			}
-			timeout--
-			time.Sleep(time.Second)
-		} else {
-			break
+			replayed = true
+			continue
+		case res == co.FsckErrors || res == co.FsckDirtyLog:
+			return res, &FsckError{Device: v.DevicePath, Output: strings.TrimSpace(out)}
+		case res == co.FsckFailed:
+			return res, fmt.Errorf("%s failed: %s %s", strings.Join(cmd, " "), err, out)
 		}
+		return res, nil
 	}
-	return nil
+}
+
+// replayLog mounts and unmounts the filesystem on device
+func replayLog(ctxt context.Context, h HostExecutor, device, fs string) error {
+	dir := filepath.Join(os.TempDir(), "dat-log-replay-"+filepath.Base(device))
+	if err := mount(ctxt, h, device, dir, nil, fs); err != nil {
+		return err
+	}
+	return unmount(ctxt, h, dir)
 }
 
 func (v *Volume) Mount(dest string, options []string, fs string) error {
@@ -72,7 +200,7 @@ func (v *Volume) Mount(dest string, options []string, fs string) error {
 	if v.DevicePath == "" {
 		return fmt.Errorf("No device path found for volume %s.  Is the volume logged in?", v.Name)
 	}
-	if err := mount(ctxt, v.DevicePath, dest, options, fs); err != nil {
+	if err := mount(ctxt, v.host(), v.DevicePath, dest, options, fs); err != nil {
 		co.Error(ctxt, err)
 		return err
 	}
@@ -80,6 +208,19 @@ func (v *Volume) Mount(dest string, options []string, fs string) error {
 	return nil
 }
 
+// FindMount sets the volume's MountPath and DevicePath from the filesystem
+// mounted at path
+func (v *Volume) FindMount(path string) error {
+	ctxt := context.WithValue(v.ctxt, co.ReqName, "FindMount")
+	co.Debugf(ctxt, "FindMount invoked for %s at %s", v.Name, path)
+	device, err := deviceFromMount(ctxt, v.host(), path)
+	if err != nil {
+		return err
+	}
+	v.DevicePath, v.MountPath = device, path
+	return nil
+}
+
 func (v *Volume) BindMount(dest, fs string) error {
 	ctxt := context.WithValue(v.ctxt, co.ReqName, "BindMount")
 	co.Debugf(ctxt, "BindMount invoked for %s", v.Name)
@@ -88,7 +229,7 @@ func (v *Volume) BindMount(dest, fs string) error {
 	} else if v.MountPath == "" {
 		return fmt.Errorf("Mount path doesn't exist for volume %s, cannot bind-mount an unmounted volume", v.Name)
 	}
-	if err := mount(ctxt, v.MountPath, dest, []string{"--bind"}, fs); err != nil {
+	if err := mount(ctxt, v.host(), v.MountPath, dest, []string{"--bind"}, fs); err != nil {
 		co.Error(ctxt, err)
 		return err
 	}
@@ -100,10 +241,22 @@ func (v *Volume) BindMount(dest, fs string) error {
 	return nil
 }
 
+// RemountReadOnly makes the mount at path read-only, leaving the other mounts
+// of the volume (eg: its staging mount) writable
+func (v *Volume) RemountReadOnly(path string) error {
+	ctxt := context.WithValue(v.ctxt, co.ReqName, "RemountReadOnly")
+	co.Debugf(ctxt, "RemountReadOnly invoked for %s at %s", v.Name, path)
+	if _, err := v.host().Run(ctxt, "mount", "-o", "remount,bind,ro", path); err != nil {
+		co.Error(ctxt, err)
+		return err
+	}
+	return nil
+}
+
 func (v *Volume) UnBindMount(path string) error {
 	ctxt := context.WithValue(v.ctxt, co.ReqName, "UnBindMount")
 	co.Debugf(ctxt, "UnBindMount invoked for %s", v.Name)
-	if err := unmount(ctxt, path); err != nil {
+	if err := unmount(ctxt, v.host(), path); err != nil {
 		co.Info(ctxt, err)
 		return nil
 	}
@@ -117,7 +270,7 @@ func (v *Volume) Unmount() error {
 	if v.MountPath == "" {
 		return fmt.Errorf("Volume is already unmounted")
 	}
-	if err := unmount(ctxt, v.MountPath); err != nil {
+	if err := unmount(ctxt, v.host(), v.MountPath); err != nil {
 		co.Error(ctxt, err)
 		return err
 	}
@@ -125,38 +278,43 @@ func (v *Volume) Unmount() error {
 	return nil
 }
 
-func (v *Volume) ExpandFs(path, fs string, size int64) error {
+// ExpandFs grows the filesystem mounted at path once its device has reached
+// size GiB, returning the size of the device in bytes.  A size of 0 skips
+// waiting for the device and an empty fs is read from the device
+func (v *Volume) ExpandFs(path, fs string, size int64) (int64, error) {
 	ctxt := context.WithValue(v.ctxt, co.ReqName, "ExpandFs")
 	co.Debugf(ctxt, "ExpandFs invoked for %s", v.Name)
-	device, err := deviceFromMount(ctxt, path)
+	device, err := deviceFromMount(ctxt, v.host(), path)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	co.Debugf(ctxt, "Expand to size requested = %d", size * units.GiB)
-	if err := checkDeviceSize(ctxt, device, size); err != nil {
-		return err
+	if size > 0 {
+		co.Debugf(ctxt, "Expand to size requested = %d", size * units.GiB)
+		if err := checkDeviceSize(ctxt, v.host(), device, size); err != nil {
+			return 0, err
+		}
 	}
-	return expandFs(ctxt, device, fs)
-}
-
-func getMajorMinor(device string) (uint32, uint32, error) {
-	s := unix.Stat_t{}
-	if err := unix.Stat(device, &s); err != nil {
-		return 0, 0, err
+	if fs == "" {
+		p, err := probeDevice(ctxt, v.host(), device)
+		if err != nil {
+			return 0, err
+		}
+		fs = p.Fs
 	}
-
-	dev := uint64(s.Rdev)
-	return unix.Major(dev), unix.Minor(dev), nil
+	if err = expandFs(ctxt, v.host(), device, path, fs); err != nil {
+		return 0, err
+	}
+	return blockdevSize(ctxt, v.host(), device)
 }
 
 // This function is for linking a block device to a new location.  This is for raw block-mode support in kubernetes
-func devLink(ctxt context.Context, device, dest string) error {
-	major, minor, err := getMajorMinor(device)
+func devLink(ctxt context.Context, h HostExecutor, device, dest string) error {
+	major, minor, err := h.MajorMinor(device)
 	if err != nil {
 		return err
 	}
 	cmd := []string{"mknod", dest, "b", strconv.FormatUint(uint64(major), 10), strconv.FormatUint(uint64(minor), 10)}
-	_, err = co.RunCmd(ctxt, cmd...)
+	_, err = h.Run(ctxt, cmd...)
 	if err != nil {
 		return err
 	}
@@ -175,68 +333,87 @@ type LsBlkEntry struct {
 	MountPoint string
 }
 
-func findFs(ctxt context.Context, device string) (string, error) {
-	cmd := []string{"lsblk", "-f", device, "--json"}
-	out, err := co.RunCmd(ctxt, cmd...)
-	if err != nil {
-		return "", err
-	}
-	co.Debugf(ctxt, "lsblk output: %s", out)
-	data := &LsBlk{}
-	if err := json.Unmarshal([]byte(out), &data); err != nil {
-		return "", err
-	}
-	if len(data.BlockDevices) < 1 {
-		cmd := []string{"lsblk", "-f"}
-		out, err := co.RunCmd(ctxt, cmd...)
-		if err != nil {
-			return "", err
+// procMountsEscapes undoes the octal escaping of whitespace and backslashes
+// in /proc/mounts
+var procMountsEscapes = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// procMounts returns the device, mount point, fs type and options of every
+// entry in /proc/mounts.  It's read directly rather than grepped so paths
+// are never handed to a shell
+func procMounts(h HostExecutor) ([][]string, error) {
+	data := []byte{}
+	buf := make([]byte, 64*1024)
+	for off := int64(0); ; {
+		n, err := h.ReadAt("/proc/mounts", buf, off)
+		data = append(data, buf[:n]...)
+		off += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
 		}
-		co.Debugf(ctxt, "lsblk full output: %s", out)
-		return "", fmt.Errorf("No block devices returned from lsblk")
 	}
-	fs := data.BlockDevices[0].FsType
-	if fs == "" {
-		return "", fmt.Errorf("No filesystem found")
+	mounts := [][]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		for i := range fields[:4] {
+			fields[i] = procMountsEscapes.Replace(fields[i])
+		}
+		mounts = append(mounts, fields[:4])
 	}
-	return fs, nil
+	return mounts, nil
 }
 
-func findMnt(ctxt context.Context, device string) (string, error) {
-	cmd := []string{"grep", fmt.Sprintf("'%s'", device), "/proc/mounts"}
-	out, err := co.RunCmd(ctxt, cmd...)
+// findMnt returns the /proc/mounts entry for device, if it's mounted
+func findMnt(ctxt context.Context, h HostExecutor, device string) (string, error) {
+	mounts, err := procMounts(h)
 	if err != nil {
 		return "", err
 	}
-	co.Debugf(ctxt, "%s result: %s", cmd, out)
-	return out, nil
+	for _, fields := range mounts {
+		if fields[0] == device {
+			co.Debugf(ctxt, "Found mount of %s: %s", device, fields)
+			return strings.Join(fields, " "), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not mounted", device)
 }
 
-func isDevice(ctxt context.Context, file string) bool {
-	f, _ := os.Stat(file)
+func isDevice(ctxt context.Context, h HostExecutor, file string) bool {
+	f, _ := h.Stat(file)
 	if !f.IsDir() && strings.HasPrefix(file, "/dev/") {
 		return true
 	}
 	return false
 }
 
-func readlink(ctxt context.Context, device string) (string, error) {
+func readlink(ctxt context.Context, h HostExecutor, device string) (string, error) {
 	cmd := []string{"readlink", "-f", device}
-	return co.RunCmd(ctxt, cmd...)
+	return h.Run(ctxt, cmd...)
 }
 
-func deviceFromMount(ctxt context.Context, file string) (string, error) {
-
-	cmd :=  []string{"sh", "-c", fmt.Sprintf("grep '%s' /proc/mounts", file)}
-	out, err := co.RunCmd(ctxt, cmd...)
+// deviceFromMount returns the device mounted at file, or file itself if it's
+// a mounted device
+func deviceFromMount(ctxt context.Context, h HostExecutor, file string) (string, error) {
+	mounts, err := procMounts(h)
 	if err != nil {
 		return "", err
 	}
+	device := ""
+	for _, fields := range mounts {
+		if fields[1] == file || fields[0] == file {
+			device = fields[0]
+			break
+		}
+	}
+	if device == "" {
+		return "", fmt.Errorf("Nothing is mounted at %s", file)
+	}
 
-	components := strings.Fields(out)
-	device := components[0]
-
-	dev, err := readlink(ctxt, device)
+	dev, err := readlink(ctxt, h, device)
 	// If readlink fails, we'll assume the device we pulled from /proc/mounts
 	// is correct.  Some versions of readlink won't error out and instead will
 	// return the file/directory that was passed in, in which case we'll just
@@ -251,18 +428,18 @@ func deviceFromMount(ctxt context.Context, file string) (string, error) {
 // /dev/disk/by-path/some-ip-and-iqn /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-<uuid>/globalmount
 // /var/lib/kubelet/plugins/kubernetes.io/csi/pv/pvc-<uuid>/globalmount /var/lib/kubelet/plugins/kubernetes.io/csi/pv/new_mount
 
-func mount(ctxt context.Context, source, dest string, options []string, fs string) error {
+func mount(ctxt context.Context, h HostExecutor, source, dest string, options []string, fs string) error {
 	co.Debugf(ctxt, "Mount called. source: %s, dest: %s, options: %s, fs: %s", source, dest, options, fs)
 
 	// Create destination directory if it doesn't exist
-	if _, err := os.Stat(dest); os.IsNotExist(err) {
-		err = os.MkdirAll(dest, os.ModePerm)
+	if _, err := h.Stat(dest); os.IsNotExist(err) {
+		err = h.MkdirAll(dest, os.ModePerm)
 		if err != nil {
 			return err
 		}
 	}
 	// Get the original device if this is a mount
-	dev, err := deviceFromMount(ctxt, source)
+	dev, err := deviceFromMount(ctxt, h, source)
 
 	// If we couldn't resolve, then we're probably working with the device already
 	cmd := []string{}
@@ -293,60 +470,71 @@ func mount(ctxt context.Context, source, dest string, options []string, fs strin
 		cmd = append([]string{"mount", dev, dest}, options...)
 	}
 
-	_, err = co.RunCmd(ctxt, cmd...)
+	_, err = h.Run(ctxt, cmd...)
 	return err
 }
 
-func unmount(ctxt context.Context, path string) error {
+func unmount(ctxt context.Context, h HostExecutor, path string) error {
 	cmd := []string{"umount", path}
-	_, err := co.RunCmd(ctxt, cmd...)
+	_, err := h.Run(ctxt, cmd...)
 	if err != nil {
 		co.Info(ctxt, err)
 	}
-	return os.RemoveAll(path)
+	return h.RemoveAll(path)
+}
+
+// blockdevSize returns the size of device in bytes
+func blockdevSize(ctxt context.Context, h HostExecutor, device string) (int64, error) {
+	out, err := h.Run(ctxt, "blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
 }
 
-func checkDeviceSize(ctxt context.Context, device string, expectedSize int64) error {
+// How long checkDeviceSize waits for a device to show its new size
+var (
+	deviceSizeRetries  = 60
+	deviceSizeInterval = time.Second
+)
+
+// checkDeviceSize rescans the iSCSI sessions until device is at least
+// sizeGiB large
+func checkDeviceSize(ctxt context.Context, h HostExecutor, device string, sizeGiB int64) error {
 	iscsiCmd := []string{"iscsiadm", "-m", "session", "-R"}
-	blockdevCmd := []string{"blockdev", "--getsize64", device}
-	timeout := 60
-	for {
-		_, err := co.RunCmd(ctxt, iscsiCmd...)
+	expectedSize := sizeGiB * units.GiB
+	for i := 0; ; i++ {
+		_, err := h.Run(ctxt, iscsiCmd...)
 		if err != nil {
 			co.Warningf(ctxt, err.Error())
 		}
-		out, err := co.RunCmd(ctxt, blockdevCmd...)
+		resizeMultipath(ctxt, h, device)
+		size, err := blockdevSize(ctxt, h, device)
 		if err != nil {
 			co.Warningf(ctxt, err.Error())
 		}
-		out = strings.TrimSuffix(out, "\n")
-		expectedSize = int64(expectedSize * units.GiB)
-		size, err := strconv.ParseInt(out, 10, 0)
-		if err != nil {
-			co.Warningf(ctxt, "Could not parse int: %s", err.Error())
-		}
-		if size == expectedSize {
+		// The array may have grown the volume past what was asked for
+		if size >= expectedSize {
 			return nil
-		} else {
-			co.Warningf(ctxt, "Blockdevice %s size did not match expected size [%s != %s]", device, size, expectedSize)
 		}
-		timeout--
-		if timeout < 0 {
+		co.Warningf(ctxt, "Blockdevice %s size did not match expected size [%d != %d]", device, size, expectedSize)
+		if i >= deviceSizeRetries {
 			return fmt.Errorf("Blockdevice %s did not resolve to expected size before timeout reached", device)
 		}
+		time.Sleep(deviceSizeInterval)
 	}
-	return nil
 }
 
 // This is going to always grow the filesystem to the maximum possible size
-func expandFs(ctxt context.Context, path string, fs string) error {
-	cmd := []string{}
-	if fs == co.Ext4 {
-		cmd = []string{"resize2fs", path}
-	} else if fs == co.Xfs {
-		cmd = []string{"xfs_growfs", path}
+func expandFs(ctxt context.Context, h HostExecutor, device, mountPath, fs string) error {
+	if fs == "" {
+		fs = co.Ext4
+	}
+	fsp, ok := co.GetFs(fs)
+	if !ok {
+		return fmt.Errorf("Unsupported filesystem type: %s, supported types are %s", fs, co.FsTypes())
 	}
-	_, err := co.RunCmd(ctxt, cmd...)
+	_, err := h.Run(ctxt, fsp.GrowCmd(device, mountPath)...)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// How long Login waits for multipathd to assemble a map with every path
+var (
+	multipathRetries  = 10
+	multipathInterval = time.Second
+)
+
+// Path lines of `multipath -ll`, eg: "|- 3:0:0:0 sdb 8:16 active ready running"
+var mpathPathRe = regexp.MustCompile(`\d+:\d+:\d+:\d+\s+(\S+)\s+\d+:\d+\s+(\S+)\s+(\S+)\s+(\S+)`)
+
+// MultipathPath is one iSCSI session backing a multipath map
+type MultipathPath struct {
+	// Block device of the path, eg: "sdb"
+	Device string
+	// Device mapper's view of the path, "active" or "failed"
+	DmState string
+	// multipathd's checker result, eg: "ready", "faulty", "ghost"
+	CheckerState string
+}
+
+// MultipathStatus is the health of a dm-multipath map
+type MultipathStatus struct {
+	Map   string
+	Paths []MultipathPath
+}
+
+// Device is the /dev/mapper path of the map
+func (s *MultipathStatus) Device() string {
+	return "/dev/mapper/" + s.Map
+}
+
+// Active is the number of paths IO can currently go through
+func (s *MultipathStatus) Active() int {
+	n := 0
+	for _, p := range s.Paths {
+		if p.DmState == "active" && p.CheckerState == "ready" {
+			n++
+		}
+	}
+	return n
+}
+
+// SelectPortals deterministically picks about half of ips for key, so
+// round_robin volumes are spread over the portals while a volume is always
+// logged into the same ones from the same node.  The order ips come in
+// doesn't matter
+func SelectPortals(ips []string, key string) []string {
+	if len(ips) < 2 {
+		return ips
+	}
+	sorted := append([]string{}, ips...)
+	sort.Strings(sorted)
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	start := int(hash.Sum32() % uint32(len(sorted)))
+	n := (len(sorted) + 1) / 2
+	result := []string{}
+	for i := 0; i < n; i++ {
+		result = append(result, sorted[(start+i)%len(sorted)])
+	}
+	return result
+}
+
+// MultipathStatus returns the health of the multipath map device is, or is
+// a path of.  It's nil if device isn't part of a map
+func (r *DateraClient) MultipathStatus(device string) (*MultipathStatus, error) {
+	ctxt := context.WithValue(r.ctxt, co.ReqName, "MultipathStatus")
+	co.Debugf(ctxt, "MultipathStatus invoked for %s", device)
+	return multipathStatus(ctxt, r.hostExecutor(), device)
+}
+
+func multipathStatus(ctxt context.Context, h HostExecutor, device string) (*MultipathStatus, error) {
+	out, err := h.Run(ctxt, "multipath", "-v1", "-l", device)
+	if err != nil {
+		return nil, fmt.Errorf("multipath failed: %s %s", err, out)
+	}
+	name := ""
+	if lines := strings.Fields(out); len(lines) > 0 {
+		name = lines[0]
+	}
+	if name == "" {
+		return nil, nil
+	}
+	out, err = h.Run(ctxt, "multipath", "-ll", name)
+	if err != nil {
+		return nil, fmt.Errorf("multipath failed: %s %s", err, out)
+	}
+	st := &MultipathStatus{Map: name}
+	for _, line := range strings.Split(out, "\n") {
+		if m := mpathPathRe.FindStringSubmatch(line); m != nil {
+			st.Paths = append(st.Paths, MultipathPath{Device: m[1], DmState: m[2], CheckerState: m[3]})
+		}
+	}
+	co.Debugf(ctxt, "Multipath status of %s: %#v", device, st)
+	return st, nil
+}
+
+// waitMultipath waits for the map holding device to show up under
+// /dev/mapper with paths active paths and returns its path.  A map with
+// fewer paths is used once the wait runs out, one without any isn't
+func waitMultipath(ctxt context.Context, h HostExecutor, device string, paths int) (string, error) {
+	var st *MultipathStatus
+	for i := 0; ; i++ {
+		s, err := multipathStatus(ctxt, h, device)
+		if err != nil {
+			co.Warning(ctxt, err)
+		} else if s != nil {
+			if _, err = h.Stat(s.Device()); err == nil {
+				st = s
+				if st.Active() >= paths {
+					return st.Device(), nil
+				}
+			}
+		}
+		if i >= multipathRetries {
+			break
+		}
+		time.Sleep(multipathInterval)
+	}
+	if st == nil {
+		return "", fmt.Errorf("No multipath device appeared for %s.  Is multipathd running?  Set DAT_DISABLE_MULTIPATH to use a single path instead", device)
+	}
+	if st.Active() == 0 {
+		return "", fmt.Errorf("Multipath device %s has no active paths", st.Device())
+	}
+	co.Warningf(ctxt, "Multipath device %s only has %d of %d paths active", st.Device(), st.Active(), paths)
+	return st.Device(), nil
+}
+
+// flushMultipath removes the map behind a /dev/mapper device before its
+// paths are logged out of, otherwise the map is left queueing IO for paths
+// that will never come back.  Other devices are left alone
+func flushMultipath(ctxt context.Context, h HostExecutor, device string) error {
+	if !strings.HasPrefix(device, "/dev/mapper/") {
+		return nil
+	}
+	if _, err := h.Stat(device); err != nil {
+		co.Debugf(ctxt, "Multipath device %s is already gone", device)
+		return nil
+	}
+	name := filepath.Base(device)
+	var (
+		out string
+		err error
+	)
+	// udev may still hold the map right after it was unmounted
+	for i := 0; i < 3; i++ {
+		if out, err = h.Run(ctxt, "multipath", "-f", name); err == nil {
+			return nil
+		}
+		co.Warningf(ctxt, "Could not flush multipath device %s: %s %s", device, err, out)
+		time.Sleep(multipathInterval)
+	}
+	return fmt.Errorf("Could not flush multipath device %s: %s %s", device, err, out)
+}
+
+// resizeMultipath grows the map holding device after its paths were
+// rescanned, the map keeps its old size otherwise
+func resizeMultipath(ctxt context.Context, h HostExecutor, device string) {
+	st, err := multipathStatus(ctxt, h, device)
+	if err != nil || st == nil {
+		return
+	}
+	if out, err := h.Run(ctxt, "multipathd", "resize", "map", st.Map); err != nil {
+		co.Warningf(ctxt, "Could not resize multipath device %s: %s %s", st.Device(), err, out)
+	}
+}
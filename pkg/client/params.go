@@ -0,0 +1,443 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	units "github.com/docker/go-units"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// Parameters with this prefix are reserved for Kubernetes (eg: the ones added
+// by the external-provisioner's --extra-create-metadata) and are ignored
+const reservedParamPrefix = "csi.storage.k8s.io/"
+
+// VolParam describes a single StorageClass parameter.  VolParams drives both
+// parsing the parameters into VolOpts and storing VolOpts as volume metadata
+type VolParam struct {
+	Name string
+	// "int", "iops", "bandwidth", "bool" or "string"
+	Type    string
+	Default string
+	Help    string
+	// Inclusive bounds for numeric parameters, Max 0 means unbounded
+	Min, Max int64
+	// Allowed values for "string" parameters, nil means anything goes
+	Enum func() []string
+	// Additional validation of the value, if any
+	Check func(string) error
+	// Other names the parameter is accepted under
+	Aliases []string
+	// If set, using the parameter logs this as a warning
+	Deprecated string
+	// Key the value is stored under in the volume metadata
+	MdKey string
+
+	get func(*VolOpts) string
+	set func(*VolOpts, string)
+	// Converts numeric parameters to the integer sent to the Datera system
+	parse func(string) (int64, error)
+}
+
+func intParam(name, def string, min, max int64, help string, f func(*VolOpts) *int) *VolParam {
+	return numParam("int", name, def, min, max, help, f, func(v string) (int64, error) {
+		return strconv.ParseInt(v, 10, 0)
+	})
+}
+
+func iopsParam(name, help string, f func(*VolOpts) *int) *VolParam {
+	return numParam("iops", name, "0", 0, 0, help, f, ParseIops)
+}
+
+func bandwidthParam(name, help string, f func(*VolOpts) *int) *VolParam {
+	return numParam("bandwidth", name, "0", 0, 0, help, f, ParseBandwidth)
+}
+
+func numParam(typ, name, def string, min, max int64, help string, f func(*VolOpts) *int, parse func(string) (int64, error)) *VolParam {
+	return &VolParam{
+		Name: name, Type: typ, Default: def, Min: min, Max: max, Help: help, MdKey: name,
+		get: func(vo *VolOpts) string { return strconv.FormatInt(int64(*f(vo)), 10) },
+		set: func(vo *VolOpts, v string) {
+			i, _ := parse(v)
+			*f(vo) = int(i)
+		},
+		parse: parse,
+	}
+}
+
+// fsck_mode values
+const (
+	FsckModeOff    = "off"
+	FsckModeCheck  = "check"
+	FsckModeRepair = "repair"
+)
+
+// A Datera PerformancePolicy KB is 1024 bytes
+const dateraKB = units.KiB
+
+var (
+	quantityRegex = regexp.MustCompile(`^(\d+(\.\d+)?) ?([kKmMgGtTpP]?)([iI]?)([bB]?)$`)
+)
+
+// ParseIops parses an IOPS count with an optional decimal suffix, eg: "500",
+// "2k" or "1.5M"
+func ParseIops(v string) (int64, error) {
+	m := quantityRegex.FindStringSubmatch(v)
+	if m == nil || m[4] != "" || m[5] != "" {
+		return 0, fmt.Errorf("%q is not an IOPS count, eg: 500 or 2k", v)
+	}
+	return units.FromHumanSize(v)
+}
+
+// ParseBandwidth parses a bandwidth to KB/s.  A bare number is already in
+// KB/s, otherwise the unit is binary if it contains an "i" ("500MiB/s",
+// "10Gi") and decimal if it doesn't ("500MB/s", "1G").  A lowercase "b"
+// is bits, as in "1Gbps" or "500Mb/s"
+func ParseBandwidth(v string) (int64, error) {
+	q := strings.TrimSuffix(strings.TrimSuffix(v, "/s"), "ps")
+	m := quantityRegex.FindStringSubmatch(q)
+	if m == nil || (m[2] != "" && m[3] == "") {
+		return 0, fmt.Errorf("%q is not a bandwidth, eg: 500MiB/s, 1G/s or a whole number of KB/s", v)
+	}
+	if m[3] == "" && m[4] == "" && m[5] == "" {
+		return strconv.ParseInt(m[1], 10, 0)
+	}
+	var (
+		b   int64
+		err error
+	)
+	if m[4] != "" {
+		b, err = units.RAMInBytes(q)
+	} else {
+		b, err = units.FromHumanSize(q)
+	}
+	if err != nil {
+		return 0, err
+	}
+	div := int64(dateraKB)
+	if m[5] == "b" {
+		div *= 8
+	}
+	kb := (b + div/2) / div
+	if kb == 0 && b > 0 {
+		return 0, fmt.Errorf("%q is less than 1 KB/s", v)
+	}
+	return kb, nil
+}
+
+func boolParam(name, def, help string, f func(*VolOpts) *bool) *VolParam {
+	return &VolParam{
+		Name: name, Type: "bool", Default: def, Help: help, MdKey: name,
+		get: func(vo *VolOpts) string { return strconv.FormatBool(*f(vo)) },
+		set: func(vo *VolOpts, v string) { *f(vo), _ = strconv.ParseBool(v) },
+	}
+}
+
+func stringParam(name, def, help string, f func(*VolOpts) *string) *VolParam {
+	return &VolParam{
+		Name: name, Type: "string", Default: def, Help: help, MdKey: name,
+		get: func(vo *VolOpts) string { return *f(vo) },
+		set: func(vo *VolOpts, v string) { *f(vo) = v },
+	}
+}
+
+func enum(values ...string) func() []string {
+	return func() []string { return values }
+}
+
+var VolParams = []*VolParam{
+	func() *VolParam {
+		p := intParam("replica_count", "3", 1, 5, "Number of replicas of the volume",
+			func(vo *VolOpts) *int { return &vo.Replica })
+		p.Aliases = []string{"replica"}
+		p.MdKey = "replica"
+		return p
+	}(),
+	func() *VolParam {
+		p := stringParam("placement_mode", "hybrid", "Media the volume is placed on",
+			func(vo *VolOpts) *string { return &vo.PlacementMode })
+		p.Enum = enum("hybrid", "single_flash", "all_flash")
+		p.Aliases = []string{"placement"}
+		p.Deprecated = "placement_mode is superseded by placement_policy on Datera OS >= 3.3"
+		p.MdKey = "placement"
+		return p
+	}(),
+	stringParam("placement_policy", "default", "Placement policy for the volume (Datera OS >= 3.3)",
+		func(vo *VolOpts) *string { return &vo.PlacementPolicy }),
+	stringParam("ip_pool", "default", "Access network IP pool",
+		func(vo *VolOpts) *string { return &vo.IpPool }),
+	stringParam("template", "", "App template to create the volume from",
+		func(vo *VolOpts) *string { return &vo.Template }),
+	boolParam("disable_template_override", "false", "Use the template's size instead of the requested one",
+		func(vo *VolOpts) *bool { return &vo.DisableTemplateOverride }),
+	boolParam("round_robin", "false", "Log in to about half of the portals, chosen per node, instead of all of them",
+		func(vo *VolOpts) *bool { return &vo.RoundRobin }),
+	iopsParam("read_iops_max", "Max read IOPS, 0 is unlimited",
+		func(vo *VolOpts) *int { return &vo.ReadIopsMax }),
+	iopsParam("write_iops_max", "Max write IOPS, 0 is unlimited",
+		func(vo *VolOpts) *int { return &vo.WriteIopsMax }),
+	iopsParam("total_iops_max", "Max total IOPS, 0 is unlimited",
+		func(vo *VolOpts) *int { return &vo.TotalIopsMax }),
+	bandwidthParam("read_bandwidth_max", "Max read bandwidth (KB/s if no unit is given), 0 is unlimited",
+		func(vo *VolOpts) *int { return &vo.ReadBandwidthMax }),
+	bandwidthParam("write_bandwidth_max", "Max write bandwidth (KB/s if no unit is given), 0 is unlimited",
+		func(vo *VolOpts) *int { return &vo.WriteBandwidthMax }),
+	bandwidthParam("total_bandwidth_max", "Max total bandwidth (KB/s if no unit is given), 0 is unlimited",
+		func(vo *VolOpts) *int { return &vo.TotalBandwidthMax }),
+	iopsParam("iops_per_gb", "Total IOPS per GB of volume size, 0 disables",
+		func(vo *VolOpts) *int { return &vo.IopsPerGb }),
+	bandwidthParam("bandwidth_per_gb", "Total bandwidth per GB of volume size (KB/s if no unit is given), 0 disables",
+		func(vo *VolOpts) *int { return &vo.BandwidthPerGb }),
+	func() *VolParam {
+		p := stringParam("fs_type", "", "Filesystem to format the volume with if the VolumeCapability doesn't specify one",
+			func(vo *VolOpts) *string { return &vo.FsType })
+		p.Enum = co.FsTypes
+		return p
+	}(),
+	&VolParam{
+		Name: "fs_args", Type: "string", Help: "Format arguments, the filesystem's defaults if empty", MdKey: "fs_args",
+		get: func(vo *VolOpts) string { return strings.Join(vo.FsArgs, " ") },
+		set: func(vo *VolOpts, v string) { vo.FsArgs = strings.Fields(v) },
+	},
+	&VolParam{
+		Name: "mount_options", Type: "string", Help: "Comma separated options for mounting filesystem volumes", MdKey: "mount_options",
+		Check: func(v string) error { return co.CheckMountOptions(co.SplitMountOptions(v)) },
+		get:   func(vo *VolOpts) string { return strings.Join(vo.MountOptions, ",") },
+		set:   func(vo *VolOpts, v string) { vo.MountOptions = co.SplitMountOptions(v) },
+	},
+	boolParam("delete_on_unmount", "false", "Delete the volume when it's unpublished from its last node",
+		func(vo *VolOpts) *bool { return &vo.DeleteOnUnmount }),
+	func() *VolParam {
+		p := stringParam("fsck_mode", FsckModeOff, "Check the filesystem before mounting it: off, check (fail if it has errors) or repair (fix what can be fixed safely)",
+			func(vo *VolOpts) *string { return &vo.FsckMode })
+		p.Enum = enum(FsckModeOff, FsckModeCheck, FsckModeRepair)
+		return p
+	}(),
+	boolParam("force_format", "false", "Format volumes that already hold data other than a filesystem, destroying it",
+		func(vo *VolOpts) *bool { return &vo.ForceFormat }),
+	intParam("iscsi_port", strconv.Itoa(DefaultIscsiPort), 1, 65535, "TCP port of the volume's iSCSI portals",
+		func(vo *VolOpts) *int { return &vo.IscsiPort }),
+	intParam("replacement_timeout", "0", 0, 86400, "Seconds to wait for a failed iSCSI session to come back before failing IO, 0 keeps the node's setting",
+		func(vo *VolOpts) *int { return &vo.ReplacementTimeout }),
+	intParam("noop_out_interval", "0", 0, 3600, "Seconds between iSCSI NOP-Out pings checking the sessions, 0 keeps the node's setting",
+		func(vo *VolOpts) *int { return &vo.NoopOutInterval }),
+	intParam("queue_depth", "0", 0, 1024, "iSCSI session queue depth, 0 keeps the node's setting",
+		func(vo *VolOpts) *int { return &vo.QueueDepth }),
+	intParam("login_retry_count", "0", 0, 60, "iSCSI login retries, 0 keeps the node's setting",
+		func(vo *VolOpts) *int { return &vo.LoginRetryCount }),
+}
+
+// validate checks v against the parameter's type, bounds and allowed values
+func (p *VolParam) validate(v string) error {
+	switch p.Type {
+	case "int", "iops", "bandwidth":
+		i, err := p.parse(v)
+		if err != nil && p.Type == "int" {
+			return fmt.Errorf("Invalid value for %s: %q is not an integer", p.Name, v)
+		} else if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", p.Name, err)
+		}
+		if i < p.Min || (p.Max != 0 && i > p.Max) {
+			if p.Max != 0 {
+				return fmt.Errorf("Invalid value for %s: %d, must be between %d and %d", p.Name, i, p.Min, p.Max)
+			}
+			return fmt.Errorf("Invalid value for %s: %d, must be at least %d", p.Name, i, p.Min)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("Invalid value for %s: %q is not a boolean", p.Name, v)
+		}
+	}
+	if p.Check != nil {
+		if err := p.Check(v); err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", p.Name, err)
+		}
+	}
+	if p.Enum != nil && v != "" {
+		for _, e := range p.Enum() {
+			if v == e {
+				return nil
+			}
+		}
+		return fmt.Errorf("Invalid value for %s: %q, must be one of %s", p.Name, v, strings.Join(p.Enum(), ", "))
+	}
+	return nil
+}
+
+// ParseVolParams builds VolOpts from StorageClass parameters, filling in
+// defaults.  Unknown parameters, parameters given under more than one name
+// and invalid values are errors.  The returned warnings should be logged
+func ParseVolParams(params map[string]string) (*VolOpts, []string, error) {
+	byName := map[string]*VolParam{}
+	for _, p := range VolParams {
+		byName[p.Name] = p
+		for _, a := range p.Aliases {
+			byName[a] = p
+		}
+	}
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	// Sorted so the errors are stable
+	sort.Strings(keys)
+	vals := map[*VolParam]string{}
+	given := map[*VolParam]string{}
+	warnings := []string{}
+	for _, k := range keys {
+		if strings.HasPrefix(k, reservedParamPrefix) {
+			continue
+		}
+		p, ok := byName[k]
+		if !ok {
+			msg := fmt.Sprintf("Unknown StorageClass parameter %q", k)
+			if s := suggestParam(k); s != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", s)
+			}
+			return nil, nil, fmt.Errorf("%s.  Supported parameters are: %s", msg, strings.Join(VolParamNames(), ", "))
+		}
+		if prev, ok := given[p]; ok {
+			return nil, nil, fmt.Errorf("StorageClass parameter %s specified twice, as %q and %q", p.Name, prev, k)
+		}
+		v := strings.TrimSpace(params[k])
+		if err := p.validate(v); err != nil {
+			return nil, nil, err
+		}
+		if k != p.Name {
+			warnings = append(warnings, fmt.Sprintf("StorageClass parameter %s is an alias, use %s instead", k, p.Name))
+		}
+		if p.Deprecated != "" {
+			warnings = append(warnings, fmt.Sprintf("StorageClass parameter %s is deprecated: %s", k, p.Deprecated))
+		}
+		given[p] = k
+		vals[p] = v
+	}
+	vo := &VolOpts{}
+	for _, p := range VolParams {
+		v, ok := vals[p]
+		if !ok {
+			v = p.Default
+		}
+		p.set(vo, v)
+	}
+	return vo, warnings, nil
+}
+
+// VolParamNames returns the canonical name of every supported parameter
+func VolParamNames() []string {
+	names := []string{}
+	for _, p := range VolParams {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// VolParamsFromMetadata returns the parameters stored in a volume's metadata,
+// under their canonical names
+func VolParamsFromMetadata(md VolMetadata) map[string]string {
+	params := map[string]string{}
+	for _, p := range VolParams {
+		if v, ok := md[p.MdKey]; ok {
+			params[p.Name] = v
+		}
+	}
+	return params
+}
+
+// VolMetadataFromParams is the reverse of VolParamsFromMetadata, parameters
+// it doesn't know are dropped
+func VolMetadataFromParams(params map[string]string) VolMetadata {
+	md := VolMetadata{}
+	for _, p := range VolParams {
+		if v, ok := params[p.Name]; ok {
+			md[p.MdKey] = v
+		}
+	}
+	return md
+}
+
+// suggestParam returns the supported parameter closest to an unknown one, if
+// it's close enough to be a typo
+func suggestParam(k string) string {
+	best, bestd := "", 3
+	for _, p := range VolParams {
+		for _, n := range append([]string{p.Name}, p.Aliases...) {
+			if d := editDistance(k, n); d < bestd {
+				best, bestd = p.Name, d
+			}
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// PrintVolParams writes a table of the supported StorageClass parameters
+func PrintVolParams(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tDEFAULT\tALLOWED\tDESCRIPTION")
+	for _, p := range VolParams {
+		allowed := ""
+		switch {
+		case p.Enum != nil:
+			allowed = strings.Join(p.Enum(), "|")
+		case p.Type == "int" && p.Max != 0:
+			allowed = fmt.Sprintf("%d-%d", p.Min, p.Max)
+		case p.Type == "iops":
+			allowed = "eg: 500, 2k"
+		case p.Type == "bandwidth":
+			allowed = "eg: 500MiB/s, 1G/s, 2048"
+		case p.Type == "int":
+			allowed = fmt.Sprintf(">=%d", p.Min)
+		case p.Type == "bool":
+			allowed = "true|false"
+		}
+		help := p.Help
+		if len(p.Aliases) > 0 {
+			help += fmt.Sprintf(" (alias: %s)", strings.Join(p.Aliases, ", "))
+		}
+		if p.Deprecated != "" {
+			help += " DEPRECATED: " + p.Deprecated
+		}
+		def := p.Default
+		if def == "" {
+			def = `""`
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.Type, def, allowed, help)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseVolParamsDefaults(t *testing.T) {
+	vo, warnings, err := ParseVolParams(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("Unexpected warnings: %v", warnings)
+	}
+	if vo.Replica != 3 || vo.PlacementMode != "hybrid" || vo.PlacementPolicy != "default" || vo.IpPool != "default" {
+		t.Fatalf("Defaults not applied: %#v", vo)
+	}
+}
+
+func TestParseVolParams(t *testing.T) {
+	params := map[string]string{
+		"replica":                     "2",
+		"placement_mode":              "all_flash",
+		"total_iops_max":              " 1000 ",
+		"round_robin":                 "true",
+		"fs_type":                     "xfs",
+		"fs_args":                     "-K  -f",
+		"mount_options":               "noatime, nodiscard",
+		"csi.storage.k8s.io/pvc/name": "ignored",
+	}
+	vo, warnings, err := ParseVolParams(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vo.Replica != 2 || vo.PlacementMode != "all_flash" || vo.TotalIopsMax != 1000 || !vo.RoundRobin || vo.FsType != "xfs" || len(vo.FsArgs) != 2 {
+		t.Fatalf("Parameters not parsed: %#v", vo)
+	}
+	// The alias and the deprecated placement_mode
+	if len(warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, got: %v", warnings)
+	}
+	if _, ok := params["ip_pool"]; ok {
+		t.Fatal("Defaults were written back into the parameters")
+	}
+	md := vo.ToMap()
+	if md["replica"] != "2" || md["placement"] != "all_flash" || md["total_iops_max"] != "1000" || md["fs_args"] != "-K -f" || md["mount_options"] != "noatime,nodiscard" {
+		t.Fatalf("Unexpected metadata: %v", md)
+	}
+}
+
+func TestParseVolParamsInvalid(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		msg    string
+	}{
+		{map[string]string{"replica_cont": "1"}, `Unknown StorageClass parameter "replica_cont" (did you mean "replica_count"?)`},
+		{map[string]string{"bogus": "1"}, `Unknown StorageClass parameter "bogus".`},
+		{map[string]string{"replica_count": "7"}, "must be between 1 and 5"},
+		{map[string]string{"replica_count": "three"}, "is not an integer"},
+		{map[string]string{"read_iops_max": "-1"}, "is not an IOPS count"},
+		{map[string]string{"read_iops_max": "2KiB"}, "is not an IOPS count"},
+		{map[string]string{"total_bandwidth_max": "fast"}, "is not a bandwidth"},
+		{map[string]string{"total_bandwidth_max": "1.5"}, "is not a bandwidth"},
+		{map[string]string{"round_robin": "yes"}, "is not a boolean"},
+		{map[string]string{"placement_mode": "flash"}, "must be one of hybrid, single_flash, all_flash"},
+		{map[string]string{"fs_type": "ntfs"}, "must be one of"},
+		{map[string]string{"mount_options": "noatime,suid"}, `Mount option "suid" is not allowed`},
+		{map[string]string{"replica": "1", "replica_count": "2"}, "specified twice"},
+	}
+	for _, test := range tests {
+		_, _, err := ParseVolParams(test.params)
+		if err == nil {
+			t.Errorf("Expected error for %v", test.params)
+		} else if !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("Error for %v doesn't contain %q: %s", test.params, test.msg, err)
+		}
+	}
+}
+
+func TestPrintVolParams(t *testing.T) {
+	buf := &bytes.Buffer{}
+	PrintVolParams(buf)
+	for _, name := range VolParamNames() {
+		if !strings.Contains(buf.String(), name) {
+			t.Fatalf("Parameter %s missing from:\n%s", name, buf.String())
+		}
+	}
+}
+
+func TestParseQoSUnits(t *testing.T) {
+	iops := map[string]int64{
+		"500":  500,
+		"2k":   2000,
+		"2K":   2000,
+		"1.5M": 1500000,
+	}
+	for v, expected := range iops {
+		if got, err := ParseIops(v); err != nil || got != expected {
+			t.Errorf("ParseIops(%q) = %d, %v, expected %d", v, got, err, expected)
+		}
+	}
+	bandwidth := map[string]int64{
+		"2048":     2048,
+		"500MiB/s": 500 * 1024,
+		"500MB/s":  488281,
+		"10Gi":     10 * 1024 * 1024,
+		"1G/s":     976563,
+		"100KiBps": 100,
+		"1.5MiB/s": 1536,
+		"4 MiB/s":  4096,
+		"0":        0,
+		// Lowercase b is bits
+		"1Gbps":   122070,
+		"500Mb/s": 61035,
+		"8Mib/s":  1024,
+		"100Kbps": 12,
+		"8MiBps":  8192,
+	}
+	for v, expected := range bandwidth {
+		if got, err := ParseBandwidth(v); err != nil || got != expected {
+			t.Errorf("ParseBandwidth(%q) = %d, %v, expected %d", v, got, err, expected)
+		}
+	}
+	for _, v := range []string{"500b/s", "1Kbps"} {
+		if got, err := ParseBandwidth(v); err == nil {
+			t.Errorf("ParseBandwidth(%q) = %d, expected an error for less than 1 KB/s", v, got)
+		}
+	}
+	vo, _, err := ParseVolParams(map[string]string{
+		"total_bandwidth_max": "500MiB/s",
+		"write_iops_max":      "2k",
+		"bandwidth_per_gb":    "1MiB/s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vo.TotalBandwidthMax != 512000 || vo.WriteIopsMax != 2000 || vo.BandwidthPerGb != 1024 {
+		t.Fatalf("QoS not normalized: %#v", vo)
+	}
+	if md := vo.ToMap(); md["total_bandwidth_max"] != "512000" {
+		t.Fatalf("Normalized bandwidth not stored: %s", md["total_bandwidth_max"])
+	}
+}
+
+func TestIscsiSettingsFromMetadata(t *testing.T) {
+	s, err := IscsiSettingsFromMetadata(VolMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (IscsiSettings{Port: DefaultIscsiPort}); *s != expected {
+		t.Fatalf("Volumes without iSCSI settings must get the defaults: %#v", s)
+	}
+	vo, _, err := ParseVolParams(map[string]string{
+		"iscsi_port":          "3261",
+		"replacement_timeout": "5",
+		"queue_depth":         "64",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = IscsiSettingsFromMetadata(VolMetadata(vo.ToMap())); err != nil {
+		t.Fatal(err)
+	}
+	if expected := (IscsiSettings{Port: 3261, ReplacementTimeout: 5, QueueDepth: 64}); *s != expected {
+		t.Fatalf("iSCSI settings not read back from metadata: %#v != %#v", s, expected)
+	}
+	if _, err = IscsiSettingsFromMetadata(VolMetadata{"iscsi_port": "0"}); err == nil {
+		t.Fatal("Expected an error for port 0")
+	}
+}
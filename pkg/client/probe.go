@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// Bytes read from the start of a device to look for signatures
+const probeSize = 64 * 1024
+
+// DeviceNotEmptyError is returned by Format for a device that already holds
+// something other than a supported filesystem
+type DeviceNotEmptyError struct {
+	Device     string
+	Signatures []string
+}
+
+func (e *DeviceNotEmptyError) Error() string {
+	return fmt.Sprintf("Refusing to format %s, it already contains data (%s).  "+
+		"Set the StorageClass parameter force_format to \"true\" to format it anyway, destroying that data",
+		e.Device, strings.Join(e.Signatures, ", "))
+}
+
+type deviceProbe struct {
+	// Supported filesystem found on the device, "" if none
+	Fs string
+	// Everything found on the device, eg: "xfs", "gpt partition table"
+	Signatures []string
+}
+
+func (p *deviceProbe) add(sig string) {
+	for _, s := range p.Signatures {
+		if s == sig {
+			return
+		}
+	}
+	p.Signatures = append(p.Signatures, sig)
+}
+
+type exitCoder interface {
+	ExitCode() int
+}
+
+// probeDevice looks for anything on device that formatting would destroy,
+// using blkid, wipefs and a scan of the device's first bytes.  Any of them
+// failing is an error, a device is only empty if all of them say so
+func probeDevice(ctxt context.Context, h HostExecutor, device string) (*deviceProbe, error) {
+	p := &deviceProbe{}
+	out, err := h.Run(ctxt, "blkid", "-p", "-o", "export", device)
+	if err == nil {
+		vals := map[string]string{}
+		for _, line := range strings.Split(out, "\n") {
+			if kv := strings.SplitN(strings.TrimSpace(line), "=", 2); len(kv) == 2 {
+				vals[kv[0]] = kv[1]
+			}
+		}
+		if t := vals["TYPE"]; t != "" {
+			if fsp, ok := co.DetectFs(t); ok && vals["USAGE"] == "filesystem" {
+				p.Fs = fsp.Name
+			}
+			p.add(t)
+		}
+		if pt := vals["PTTYPE"]; pt != "" {
+			p.add(pt + " partition table")
+		}
+	} else if ec, ok := err.(exitCoder); !ok || ec.ExitCode() != 2 {
+		// blkid exits 2 when it finds nothing
+		return nil, fmt.Errorf("blkid failed: %s %s", err, out)
+	}
+	out, err = h.Run(ctxt, "wipefs", "--no-act", "--parsable", device)
+	if err != nil {
+		return nil, fmt.Errorf("wipefs failed: %s %s", err, out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		// offset,uuid,label,type
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) == 4 && !strings.HasPrefix(fields[0], "#") && fields[3] != "" {
+			p.add(fields[3])
+		}
+	}
+	buf := make([]byte, probeSize)
+	n, err := h.ReadAt(device, buf, 0)
+	if err != nil && n == 0 {
+		return nil, fmt.Errorf("Could not read %s: %s", device, err)
+	}
+	for _, s := range rawSignatures(buf[:n]) {
+		p.add(s)
+	}
+	if len(p.Signatures) == 0 && bytes.Count(buf[:n], []byte{0}) != n {
+		p.add(fmt.Sprintf("non-zero data in the first %d KiB", probeSize/1024))
+	}
+	co.Debugf(ctxt, "Probed %s: %#v", device, p)
+	return p, nil
+}
+
+// rawSignatures checks the start of a device for partition tables and
+// volume manager, encryption and RAID headers, in case blkid and wipefs
+// don't know them
+func rawSignatures(b []byte) []string {
+	at := func(off int, magic string) bool {
+		return len(b) >= off+len(magic) && string(b[off:off+len(magic)]) == magic
+	}
+	sigs := []string{}
+	if len(b) >= 512 && b[510] == 0x55 && b[511] == 0xaa {
+		sigs = append(sigs, "boot sector or dos partition table")
+	}
+	if at(512, "EFI PART") {
+		sigs = append(sigs, "gpt partition table")
+	}
+	for off := 0; off < 4*512; off += 512 {
+		if at(off, "LABELONE") {
+			sigs = append(sigs, "LVM2 member")
+			break
+		}
+	}
+	if at(0, "LUKS\xba\xbe") {
+		sigs = append(sigs, "LUKS header")
+	}
+	// MD superblocks 1.1 (start of the device) and 1.2 (4 KiB in)
+	for _, off := range []int{0, 4096} {
+		if len(b) >= off+4 && binary.LittleEndian.Uint32(b[off:]) == 0xa92b4efc {
+			sigs = append(sigs, "linux raid member")
+			break
+		}
+	}
+	return sigs
+}
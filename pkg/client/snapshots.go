@@ -3,12 +3,14 @@ package client
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	uuid "github.com/google/uuid"
+	greq "github.com/levigross/grequests"
 
 	co "github.com/Datera/datera-csi/pkg/common"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
@@ -73,109 +75,249 @@ func (r *DateraClient) SnapshotPathFromCsiId(csiId string) (string, error) {
 	return snaps[0].Path, nil
 }
 
-func (r *DateraClient) ListSnapshots(snapId, sourceVol string, maxEntries, startToken int) ([]*Snapshot, int, error) {
+// ErrInvalidToken is returned by ListSnapshots for a startToken that isn't
+// the path of a snapshot
+var ErrInvalidToken = fmt.Errorf("StartingToken is not a snapshot path")
+
+// ListSnapshots returns up to maxEntries snapshots (all if zero) following
+// startToken, along with the token for the next page ("" on the last page).
+// Tokens are the path of the last snapshot returned, so they remain valid
+// when snapshots are created or deleted between pages.  Unless snapId is
+// given only snapshots created by the plugin are returned
+func (r *DateraClient) ListSnapshots(snapId, sourceVol string, maxEntries int, startToken string) ([]*Snapshot, string, error) {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "ListSnapshots")
-	co.Debugf(ctxt, "ListSnapshots invoked.  snapId = %s, sourceVol = %s, maxEntries = %d, startToken = %d\n", snapId, sourceVol, maxEntries, startToken)
+	co.Debugf(ctxt, "ListSnapshots invoked.  snapId = %s, sourceVol = %s, maxEntries = %d, startToken = %s\n", snapId, sourceVol, maxEntries, startToken)
 	var (
 		err   error
 		vid   string
 		sid   string
-		vols  = []*Volume{}
 		snaps = []*Snapshot{}
 	)
+	if startToken != "" && (snapParentId(startToken) == "" || !strings.Contains(startToken, "/snapshots/")) {
+		return nil, "", ErrInvalidToken
+	}
 	if snapId != "" {
 		vid, sid = co.ParseSnapId(snapId)
 		if vid == "" || sid == "" {
-			return []*Snapshot{}, 0, fmt.Errorf("SnapshotId must be of format app_instance_name:snapshot_timestamp")
+			return []*Snapshot{}, "", fmt.Errorf("SnapshotId must be of format app_instance_name:snapshot_timestamp")
 		}
-		if sourceVol == "" {
-			sourceVol = vid
+		if sourceVol != "" && sourceVol != vid {
+			return []*Snapshot{}, "", nil
 		}
 	}
 
 	if vid != "" && sid != "" {
 		vol, err := r.GetVolume(vid, false, false)
 		if err != nil {
-			return nil, 0, err
+			return nil, "", err
+		}
+		if snaps, err = vol.ListSnapshots(sid); err != nil {
+			return nil, "", err
 		}
-		snaps, err = vol.ListSnapshots(sid)
 	} else {
-		// TODO: When the new Snapshots API is available, bypass this slow path
 		if sourceVol == "" {
-			vols, err = r.ListVolumes(0, 0)
-			if err != nil {
-				return nil, 0, err
-			}
+			snaps, err = r.listAllSnapshots(ctxt)
 		} else {
-			vol, err := r.GetVolume(sourceVol, false, false)
-			if err != nil {
-				return nil, 0, err
+			var vol *Volume
+			if vol, err = r.GetVolume(sourceVol, false, false); err == nil {
+				snaps, err = vol.ListSnapshots("")
 			}
-			vols = append(vols, vol)
 		}
-		wg := sync.WaitGroup{}
-		addL := sync.Mutex{}
-		addSnaps := func(psnaps []*Snapshot) {
-			addL.Lock()
-			defer addL.Unlock()
-			snaps = append(snaps, psnaps...)
+		if err != nil {
+			return nil, "", err
 		}
-		for _, vol := range vols {
-			wg.Add(1)
-			go func(v *Volume) {
-				psnaps, err := v.ListSnapshots(sid)
-				if err != nil {
-					co.Error(ctxt, err)
-					wg.Done()
-					return
+		snaps = csiSnapshots(snaps)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Path < snaps[j].Path
+	})
+	start := 0
+	if startToken != "" {
+		start = sort.Search(len(snaps), func(i int) bool {
+			return snaps[i].Path > startToken
+		})
+	}
+	end := len(snaps)
+	if maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+	nextToken := ""
+	if end < len(snaps) {
+		nextToken = snaps[end-1].Path
+	}
+	co.Debugf(ctxt, "startToken = %s, maxEntries = %d, found %d snapshots, returning [%d:%d]", startToken, maxEntries, len(snaps), start, end)
+	return r.loadParents(ctxt, snaps[start:end]), nextToken, nil
+}
+
+// FindSnapshotByName returns the snapshot created by the plugin with name on
+// any volume in the tenant, or nil if there's none.  See snapIdFromName
+func (r *DateraClient) FindSnapshotByName(name string) (*Snapshot, error) {
+	ctxt := context.WithValue(r.ctxt, co.ReqName, "FindSnapshotByName")
+	co.Debugf(ctxt, "FindSnapshotByName invoked for %s", name)
+	sid := snapIdFromName(ctxt, name).String()
+	snaps, err := r.listAllSnapshots(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range snaps {
+		if snap.Snap.Uuid == sid {
+			if found := r.loadParents(ctxt, []*Snapshot{snap}); len(found) > 0 {
+				return found[0], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// loadParents fills in the parent volume of the snapshots listed tenant wide,
+// fetching each one once.  Snapshots whose parent has been deleted since they
+// were listed are dropped
+func (r *DateraClient) loadParents(ctxt context.Context, snaps []*Snapshot) []*Snapshot {
+	vols := map[string]*Volume{}
+	result := []*Snapshot{}
+	for _, snap := range snaps {
+		if snap.Vol == nil {
+			aid := snapParentId(snap.Path)
+			vol, ok := vols[aid]
+			if !ok {
+				var err error
+				if vol, err = r.GetVolume(aid, false, false); err != nil {
+					co.Warningf(ctxt, "Skipping snapshot %s, could not get its volume: %s", snap.Path, err)
 				}
-				addSnaps(psnaps)
-				wg.Done()
-			}(vol)
+				vols[aid] = vol
+			}
+			if vol == nil {
+				continue
+			}
+			snap.Vol = vol
+		}
+		result = append(result, snap)
+	}
+	return result
+}
+
+// snapParentId returns the id of the AppInstance holding the snapshot at
+// path, which looks like
+// /app_instances/<id>/storage_instances/<si>/volumes/<vol>/snapshots/<ts>
+func snapParentId(path string) string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[1] != "app_instances" {
+		return ""
+	}
+	return parts[2]
+}
+
+// CsiId returns the id the snapshot is known by to the CO.  We set the id to
+// "<volume-id>:<snapshot-id>" since during delete requests we are not given
+// the parent volume id
+func (s *Snapshot) CsiId() string {
+	return co.MkSnapId(s.Vol.Name, s.Id)
+}
 
+// csiSnapshots filters snaps down to those created by the plugin, which
+// carry a name based (version 5) uuid.  See snapIdFromName
+func csiSnapshots(snaps []*Snapshot) []*Snapshot {
+	result := []*Snapshot{}
+	for _, snap := range snaps {
+		if id, err := uuid.Parse(snap.Snap.Uuid); err == nil && id.Version() == 5 {
+			result = append(result, snap)
 		}
-		co.Debug(ctxt, "Waiting")
-		wg.Wait()
 	}
-	sort.Slice(snaps, func(i, j int) bool {
-		return snaps[i].Id < snaps[j].Id
-	})
-	if len(snaps) == 0 || startToken > len(snaps) {
-		return snaps, 0, nil
-	}
-	snapEnd := len(snaps)
-	if maxEntries == 0 {
-		maxEntries = snapEnd - startToken
-	}
-	end := startToken + maxEntries
-	if end == 0 || end > snapEnd {
-		end = snapEnd
-	}
-	// startToken = 0, maxEntries = len(snap) --> end = 6
-	//
-	//
-	// [0, 1, 2, 3, 4, 5]
-	//  |              |
-	//  st             end
-	//
-
-	// startToken = 3, maxEntries = 0 -- > end = 6
-	//
-	// [0, 1, 2, 3, 4, 5]
-	//           |     |
-	//           st    end
-	//
-
-	// startToken = 2, maxEntries = 2 -- > end = 4
-	//
-	// [0, 1, 2, 3, 4, 5]
-	//        |  |
-	//        st end
-	//
-	co.Debugf(ctxt, "startToken = %d, maxEntries = %d, end = %d", startToken, maxEntries, end)
-	co.Debugf(ctxt, "Found snapshots: %#v", snaps)
-	co.Debugf(ctxt, "Returning snapshots: %#v", snaps[startToken:end])
-	return snaps[startToken:end], end, nil
+	return result
+}
+
+// listAllSnapshots returns the snapshots of every volume in the tenant.  The
+// tenant wide snapshots endpoint is used when the array has one, leaving the
+// parent volumes to be loaded for the page returned, otherwise the volumes
+// are listed and their snapshots SnapshotListWorkers volumes at a time
+func (r *DateraClient) listAllSnapshots(ctxt context.Context) ([]*Snapshot, error) {
+	if atomic.LoadInt32(r.tenantSnaps) >= 0 {
+		snaps, err := r.listTenantSnapshots(ctxt)
+		if err != errNoTenantSnapshots {
+			atomic.StoreInt32(r.tenantSnaps, 1)
+			return snaps, err
+		}
+		co.Infof(ctxt, "Array has no tenant wide snapshots endpoint, listing snapshots per volume")
+		atomic.StoreInt32(r.tenantSnaps, -1)
+	}
+	vols, err := r.ListVolumes(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return r.listVolumeSnapshots(ctxt, vols)
+}
+
+var errNoTenantSnapshots = fmt.Errorf("Tenant wide snapshot listing is not supported")
+
+func (r *DateraClient) listTenantSnapshots(ctxt context.Context) ([]*Snapshot, error) {
+	rs, apierr, err := dsdk.GetConn(ctxt).GetList(ctxt, "/snapshots", &greq.RequestOptions{})
+	if apierr != nil {
+		if apierr.Http == http.StatusNotFound {
+			return nil, errNoTenantSnapshots
+		}
+		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
+		return nil, co.ErrTranslator(apierr)
+	} else if err != nil {
+		co.Error(ctxt, err)
+		return nil, err
+	}
+	snaps := []*Snapshot{}
+	for _, data := range rs.Data {
+		snap := &dsdk.Snapshot{}
+		if err = dsdk.FillStruct(data.(map[string]interface{}), snap); err != nil {
+			co.Error(ctxt, err)
+			return nil, err
+		}
+		if snapParentId(snap.Path) == "" {
+			co.Warningf(ctxt, "Skipping snapshot with unexpected path: %s", snap.Path)
+			continue
+		}
+		snaps = append(snaps, &Snapshot{
+			ctxt:   r.ctxt,
+			dc:     r,
+			Snap:   snap,
+			Id:     snap.UtcTs,
+			Path:   snap.Path,
+			Status: snap.OpState,
+		})
+	}
+	return snaps, nil
+}
+
+// Number of volumes whose snapshots are listed concurrently when the array
+// has no tenant wide snapshots endpoint
+var SnapshotListWorkers = 8
+
+func (r *DateraClient) listVolumeSnapshots(ctxt context.Context, vols []*Volume) ([]*Snapshot, error) {
+	var (
+		wg    sync.WaitGroup
+		addL  sync.Mutex
+		snaps = []*Snapshot{}
+		work  = make(chan *Volume)
+	)
+	for i := 0; i < SnapshotListWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for vol := range work {
+				psnaps, err := vol.listSnapshots(ctxt)
+				if err != nil {
+					// Most likely deleted since it was listed
+					co.Warning(ctxt, err)
+					continue
+				}
+				addL.Lock()
+				snaps = append(snaps, psnaps...)
+				addL.Unlock()
+			}
+		}()
+	}
+	for _, vol := range vols {
+		work <- vol
+	}
+	close(work)
+	wg.Wait()
+	return snaps, nil
 }
 
 func (r *Volume) GetSnapshotByUuid(id *uuid.UUID) (*Snapshot, error) {
@@ -213,6 +355,8 @@ func (r *Volume) GetSnapshotByUuid(id *uuid.UUID) (*Snapshot, error) {
 
 }
 
+// CreateSnapshot starts a snapshot and returns without waiting for it to
+// become available, use Ready (after Reload) to check on it
 func (r *Volume) CreateSnapshot(name string, snapOpts *SnapOpts) (*Snapshot, error) {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "CreateSnapshot")
 	co.Debugf(ctxt, "CreateSnapshot invoked for %s", r.Name)
@@ -260,24 +404,10 @@ func (r *Volume) CreateSnapshot(name string, snapOpts *SnapOpts) (*Snapshot, err
 		Path:   snap.Path,
 		Status: snap.OpState,
 	}
-	// Poll for availability
-	timeout := 30
-	for {
-		err = csnap.Reload()
-		if err != nil {
-			return csnap, err
-		}
-		if csnap.Status == "available" {
-			return csnap, nil
-		}
-		co.Debugf(ctxt, "Snapshot %s is not available yet", csnap.Id)
-		time.Sleep(time.Second * 1)
-		timeout--
-		if timeout <= 0 {
-			err := fmt.Errorf("Snapshot %s did not become available before timeout", csnap.Id)
-			return csnap, err
-		}
+	if !csnap.Ready() {
+		co.Debugf(ctxt, "Snapshot %s is not available yet: %s", csnap.Id, csnap.Status)
 	}
+	return csnap, nil
 }
 
 func (r *Volume) DeleteSnapshot(id string) error {
@@ -332,8 +462,22 @@ func (r *Volume) ListSnapshots(snapId string) ([]*Snapshot, error) {
 		co.Warning(ctxt, err)
 		return snaps, nil
 	}
-	v := r.Ai.StorageInstances[0].Volumes[0]
-	rsnaps, apierr, err := v.SnapshotsEp.List(&dsdk.SnapshotsListRequest{
+	rsnaps, err := r.listSnapshots(ctxt)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range rsnaps {
+		if snapId == "" || snapId == s.Id {
+			snaps = append(snaps, s)
+		}
+	}
+	co.Debugf(ctxt, "Returning Snapshots: %#v", snaps)
+	return snaps, nil
+}
+
+// listSnapshots lists the volume's snapshots without reloading it first
+func (r *Volume) listSnapshots(ctxt context.Context) ([]*Snapshot, error) {
+	rsnaps, apierr, err := r.Ai.StorageInstances[0].Volumes[0].SnapshotsEp.List(&dsdk.SnapshotsListRequest{
 		Ctxt: ctxt,
 	})
 	if err != nil {
@@ -343,28 +487,32 @@ func (r *Volume) ListSnapshots(snapId string) ([]*Snapshot, error) {
 		co.Errorf(ctxt, "%s, %s", dsdk.Pretty(apierr), err)
 		return nil, co.ErrTranslator(apierr)
 	}
+	v, err := aiToClientVol(ctxt, r.Ai, false, false, nil)
+	if err != nil {
+		co.Error(ctxt, err)
+		return nil, err
+	}
+	snaps := []*Snapshot{}
 	for _, s := range rsnaps {
-		if snapId == "" || snapId == s.UtcTs {
-			v, err := aiToClientVol(ctxt, r.Ai, false, false, nil)
-			if err != nil {
-				co.Error(ctxt, err)
-				return nil, err
-			}
-			snaps = append(snaps, &Snapshot{
-				ctxt:   r.ctxt,
-				dc:     r.dc,
-				Snap:   s,
-				Vol:    v,
-				Id:     s.UtcTs,
-				Path:   s.Path,
-				Status: s.OpState,
-			})
-		}
+		snaps = append(snaps, &Snapshot{
+			ctxt:   r.ctxt,
+			dc:     r.dc,
+			Snap:   s,
+			Vol:    v,
+			Id:     s.UtcTs,
+			Path:   s.Path,
+			Status: s.OpState,
+		})
 	}
-	co.Debugf(ctxt, "Returning Snapshots: %#v", snaps)
 	return snaps, nil
 }
 
+// Ready returns whether the snapshot's data has been fully captured and it can
+// be used as a volume source
+func (s *Snapshot) Ready() bool {
+	return s.Status == "available"
+}
+
 func (s *Snapshot) Reload() error {
 	ctxt := context.WithValue(s.ctxt, co.ReqName, "Snapshot Reload")
 	co.Debugf(ctxt, "Snapshot Reload invoked: %s", s.Id)
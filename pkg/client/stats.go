@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	unix "golang.org/x/sys/unix"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// ErrNotMounted is returned by PathStats for a directory nothing is mounted on
+var ErrNotMounted = fmt.Errorf("Nothing is mounted on path")
+
+// PathStats is the usage of a volume published on a node
+type PathStats struct {
+	// Block volumes only report their size
+	Block bool
+
+	TotalBytes     int64
+	AvailableBytes int64
+	UsedBytes      int64
+
+	TotalInodes int64
+	FreeInodes  int64
+	UsedInodes  int64
+
+	// The filesystem was mounted, or has been remounted, read-only
+	ReadOnly bool
+}
+
+// PathStats measures the volume published at path on this node.  Mounted
+// filesystems are measured with statfs, block volumes report the size of
+// their device.  The error satisfies os.IsNotExist if path doesn't exist and
+// is ErrNotMounted for an empty mount point
+func (r *DateraClient) PathStats(path string) (*PathStats, error) {
+	ctxt := context.WithValue(r.ctxt, co.ReqName, "PathStats")
+	co.Debugf(ctxt, "PathStats invoked for %s", path)
+	h := r.hostExecutor()
+	fi, err := h.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		size, err := blockdevSize(ctxt, h, path)
+		if err != nil {
+			return nil, err
+		}
+		return &PathStats{Block: true, TotalBytes: size}, nil
+	}
+	mounted, err := isMountPoint(ctxt, h, path)
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		return nil, ErrNotMounted
+	}
+	st := unix.Statfs_t{}
+	if err = h.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	bs := int64(st.Bsize)
+	return &PathStats{
+		TotalBytes:     int64(st.Blocks) * bs,
+		AvailableBytes: int64(st.Bavail) * bs,
+		UsedBytes:      int64(st.Blocks-st.Bfree) * bs,
+		TotalInodes:    int64(st.Files),
+		FreeInodes:     int64(st.Ffree),
+		UsedInodes:     int64(st.Files - st.Ffree),
+		ReadOnly:       st.Flags&unix.ST_RDONLY != 0,
+	}, nil
+}
+
+// IsMountPoint returns whether something is mounted exactly on path
+func (r *DateraClient) IsMountPoint(path string) (bool, error) {
+	ctxt := context.WithValue(r.ctxt, co.ReqName, "IsMountPoint")
+	return isMountPoint(ctxt, r.hostExecutor(), path)
+}
+
+// isMountPoint returns whether something is mounted exactly on path
+func isMountPoint(ctxt context.Context, h HostExecutor, path string) (bool, error) {
+	mounts, err := procMounts(h)
+	if err != nil {
+		return false, err
+	}
+	for _, fields := range mounts {
+		if fields[1] == path {
+			return true, nil
+		}
+	}
+	co.Debugf(ctxt, "No mount found for %s", path)
+	return false, nil
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -19,6 +20,7 @@ type VolOpts struct {
 	RemoteProvider          string   `json:"remote_provider,omitempty"`
 	FsType                  string   `json:"fs_type,omitempty"`
 	FsArgs                  []string `json:"fs_args,omitempty"`
+	MountOptions            []string `json:"mount_options,omitempty"`
 	PlacementMode           string   `json:"placement,omitempty"`
 	PlacementPolicy         string   `json:"placement_policy,omitempty"`
 	CloneSrc                string   `json:"clone_src,omitempty"`
@@ -27,6 +29,8 @@ type VolOpts struct {
 	IpPool                  string   `json:"ip_pool,omitempty"`
 	RoundRobin              bool     `json:"round_robin,omitempty"`
 	DeleteOnUnmount         bool     `json:"delete_on_unmount,omitempty"`
+	ForceFormat             bool     `json:"force_format,omitempty"`
+	FsckMode                string   `json:"fsck_mode,omitempty"`
 	DisableTemplateOverride bool     `json:"disable_template_override,omitempty"`
 
 	// QoS IOPS
@@ -42,6 +46,13 @@ type VolOpts struct {
 	// Dynamic QoS
 	IopsPerGb      int `json:"iops_per_gb,omitempty"`
 	BandwidthPerGb int `json:"bandwidth_per_gb,omitempty"`
+
+	// iSCSI session tuning
+	IscsiPort          int `json:"iscsi_port,omitempty"`
+	ReplacementTimeout int `json:"replacement_timeout,omitempty"`
+	NoopOutInterval    int `json:"noop_out_interval,omitempty"`
+	QueueDepth         int `json:"queue_depth,omitempty"`
+	LoginRetryCount    int `json:"login_retry_count,omitempty"`
 }
 
 type Volume struct {
@@ -58,6 +69,9 @@ type Volume struct {
 	Iqn           string
 	Initiators    []string
 
+	// Session tuning applied by Login, nil for the defaults
+	Iscsi *IscsiSettings
+
 	Replicas        int
 	PlacementMode   string
 	PlacementPolicy string
@@ -89,37 +103,18 @@ type VolMetadata map[string]string
 // sending more metadata than can be processed (2048 characters)
 var MetadataDebug = false
 
+// ToMap returns the VolOpts in the form stored as volume metadata
 func (v VolOpts) ToMap() map[string]string {
-	return map[string]string{
-		"size":                      strconv.FormatInt(int64(v.Size), 10),
-		"replica":                   strconv.FormatInt(int64(v.Replica), 10),
-		"template":                  v.Template,
-		"fs_type":                   v.FsType,
-		"fs_args":                   strings.Join(v.FsArgs, " "),
-		"placement":                 v.PlacementMode,
-		"placement_policy":          v.PlacementPolicy,
-		"clone_src":                 v.CloneSrc,
-		"clone_vol_src":             v.CloneVolSrc,
-		"clone_snap_src":            v.CloneSnapSrc,
-		"ip_pool":                   v.IpPool,
-		"round_robin":               strconv.FormatBool(v.RoundRobin),
-		"delete_on_unmount":         strconv.FormatBool(v.DeleteOnUnmount),
-		"disable_template_override": strconv.FormatBool(v.DisableTemplateOverride),
-
-		// QoS IOPS
-		"write_iops_max": strconv.FormatInt(int64(v.WriteIopsMax), 10),
-		"read_iops_max":  strconv.FormatInt(int64(v.ReadIopsMax), 10),
-		"total_iops_max": strconv.FormatInt(int64(v.TotalIopsMax), 10),
-
-		// QoS Bandwidth
-		"write_bandwidth_max": strconv.FormatInt(int64(v.WriteBandwidthMax), 10),
-		"read_bandwidth_max":  strconv.FormatInt(int64(v.ReadBandwidthMax), 10),
-		"total_bandwidth_max": strconv.FormatInt(int64(v.TotalBandwidthMax), 10),
-
-		// Dynamic QoS
-		"iops_per_gb":      strconv.FormatInt(int64(v.IopsPerGb), 10),
-		"bandwidth_per_gb": strconv.FormatInt(int64(v.BandwidthPerGb), 10),
+	m := map[string]string{
+		"size":           strconv.FormatInt(int64(v.Size), 10),
+		"clone_src":      v.CloneSrc,
+		"clone_vol_src":  v.CloneVolSrc,
+		"clone_snap_src": v.CloneSnapSrc,
+	}
+	for _, p := range VolParams {
+		m[p.MdKey] = p.get(&v)
 	}
+	return m
 }
 
 func aiToClientVol(ctx context.Context, ai *dsdk.AppInstance, qos, metadata bool, client *DateraClient) (*Volume, error) {
@@ -229,11 +224,23 @@ func (r *DateraClient) GetVolume(name string, qos, metadata bool) (*Volume, erro
 	return v, nil
 }
 
+// LocalVolume returns a Volume that only knows its name, for the node
+// operations that work on the host alone.  Nothing is read from the array, the
+// caller fills in whatever else the operation needs
+func (r *DateraClient) LocalVolume(name string) *Volume {
+	return &Volume{
+		ctxt:           context.WithValue(r.ctxt, co.ReqName, "LocalVolume"),
+		dc:             r,
+		Name:           name,
+		BindMountPaths: dsdk.NewStringSet(10),
+	}
+}
+
 func (r *DateraClient) CreateVolume(name string, volOpts *VolOpts, qos bool, chapParams map[string]string) (*Volume, error) {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "CreateVolume")
 	co.Debugf(ctxt, "CreateVolume invoked for %s, volOpts: %#v", name, volOpts)
 	var ai dsdk.AppInstancesCreateRequest
-	var mode string = "kubernetes"
+	var mode string = CsiCreateMode
 	if volOpts.Template != "" {
 		// From Template
 		template := strings.Trim(volOpts.Template, "/")
@@ -482,6 +489,62 @@ func (r *DateraClient) ListVolumes(maxEntries int, startToken int) ([]*Volume, e
 	return vols, nil
 }
 
+// CreateMode of the AppInstances created by the plugin
+const CsiCreateMode = "kubernetes"
+
+// IsCsi returns whether the volume is managed by the plugin, either created
+// by it or named like one of its volumes
+func (r *Volume) IsCsi() bool {
+	return r.Ai.CreateMode == CsiCreateMode || strings.HasPrefix(r.Name, "CSI-")
+}
+
+// ErrStaleToken is returned by ListCsiVolumes for a startToken naming a
+// volume that has since been deleted
+var ErrStaleToken = fmt.Errorf("StartingToken is stale, volume no longer exists")
+
+// ListCsiVolumes returns up to maxEntries (all if zero) volumes managed by the
+// plugin following startToken, sorted by name, along with the token for the
+// next page ("" on the last page).  Tokens are the name of the last volume
+// returned, a token naming a volume that has since been deleted is
+// ErrStaleToken.  The volumes are listed without their metadata, which is
+// left to be loaded for the page returned
+func (r *DateraClient) ListCsiVolumes(maxEntries int, startToken string) ([]*Volume, string, error) {
+	ctxt := context.WithValue(r.ctxt, co.ReqName, "ListCsiVolumes")
+	co.Debugf(ctxt, "ListCsiVolumes invoked.  maxEntries = %d, startToken = %s", maxEntries, startToken)
+	all, err := r.ListVolumes(0, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	vols := []*Volume{}
+	for _, vol := range all {
+		if vol.IsCsi() {
+			vols = append(vols, vol)
+		}
+	}
+	sort.Slice(vols, func(i, j int) bool {
+		return vols[i].Name < vols[j].Name
+	})
+	start := 0
+	if startToken != "" {
+		start = sort.Search(len(vols), func(i int) bool {
+			return vols[i].Name >= startToken
+		})
+		if start == len(vols) || vols[start].Name != startToken {
+			return nil, "", ErrStaleToken
+		}
+		start++
+	}
+	end := len(vols)
+	if maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+	nextToken := ""
+	if end < len(vols) {
+		nextToken = vols[end-1].Name
+	}
+	return vols[start:end], nextToken, nil
+}
+
 func (r *Volume) SetPerformancePolicy(volOpts *VolOpts) error {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "SetPerformancePolicy")
 	co.Debugf(ctxt, "SetPerformancePolicy invoked for %s, volOpts: %#v", r.Name, volOpts)
@@ -618,6 +681,11 @@ func (r *Volume) Reload(qos, metadata bool) error {
 	return nil
 }
 
+// Path returns the Datera path of the volume, eg: for cloning it
+func (r *Volume) Path() string {
+	return r.Ai.StorageInstances[0].Volumes[0].Path
+}
+
 func (r *Volume) Resize(newSize int) error {
 	ctxt := context.WithValue(r.ctxt, co.ReqName, "Volume Resize")
 	co.Debugf(ctxt, "Volume Resize invoked: %s", r.Name)
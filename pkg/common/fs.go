@@ -0,0 +1,222 @@
+package common
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FsProfile describes how to create, grow and check a filesystem on a node.
+// Registering a profile is all that's needed for the driver to accept the
+// filesystem in a VolumeCapability, format volumes with it and expand it
+type FsProfile struct {
+	// Name as requested in VolumeCapability.Mount.FsType
+	Name string
+	// Command (and any fixed arguments) used to create the filesystem.  The
+	// device is appended after the format arguments
+	Mkfs []string
+	// Format arguments used when the volume doesn't specify any
+	DefaultArgs []string
+	// Command used to grow the filesystem to fill its device.  The target is
+	// appended
+	Grow []string
+	// Whether Grow takes the mount point instead of the device
+	GrowMounted bool
+	// Command used to check the (unmounted) filesystem, fixing what can be
+	// fixed safely.  The device is appended
+	Fsck []string
+	// Command used to check the filesystem without changing it.  The device
+	// is appended
+	FsckCheck []string
+	// Interprets the exit code and output of Fsck and FsckCheck
+	FsckExit func(code int, out string) FsckResult
+	// FSTYPE reported by lsblk/blkid for this filesystem
+	Detect string
+}
+
+// FsckResult is the outcome of checking a filesystem
+type FsckResult string
+
+const (
+	FsckClean FsckResult = "clean"
+	// Errors were found and fixed
+	FsckRepaired FsckResult = "repaired"
+	// The log has to be replayed, by mounting the filesystem, before it can
+	// be checked
+	FsckDirtyLog FsckResult = "dirty_log"
+	// Errors were found and left
+	FsckErrors FsckResult = "errors"
+	// The check itself failed
+	FsckFailed FsckResult = "failed"
+)
+
+// e2fsck's exit code is a bit mask.  `e2fsck -n` doesn't recover the journal
+// and checks the filesystem as if it wasn't there
+func e2fsckExit(code int, out string) FsckResult {
+	switch {
+	case strings.Contains(out, "skipping journal recovery"):
+		return FsckDirtyLog
+	case code >= 8:
+		return FsckFailed
+	case code&4 != 0:
+		return FsckErrors
+	case code&3 != 0:
+		return FsckRepaired
+	}
+	return FsckClean
+}
+
+// `xfs_repair -n` ignores a dirty log with an ALERT, reporting whatever
+// inconsistencies that causes, while xfs_repair refuses to run and exits 2
+func xfsRepairExit(code int, out string) FsckResult {
+	if strings.Contains(out, "log which is being ignored") {
+		return FsckDirtyLog
+	}
+	switch code {
+	case 0:
+		return FsckClean
+	case 1:
+		return FsckErrors
+	case 2:
+		return FsckDirtyLog
+	}
+	return FsckFailed
+}
+
+func btrfsCheckExit(code int, out string) FsckResult {
+	if code == 0 {
+		return FsckClean
+	}
+	return FsckErrors
+}
+
+var (
+	fsLock     sync.RWMutex
+	fsProfiles = map[string]*FsProfile{}
+)
+
+func init() {
+	RegisterFs(&FsProfile{
+		Name:        Ext4,
+		Mkfs:        []string{"mkfs.ext4"},
+		DefaultArgs: strings.Split("-E lazy_itable_init=0,lazy_journal_init=0,nodiscard -F", " "),
+		Grow:        []string{"resize2fs"},
+		Fsck:        []string{"e2fsck", "-p"},
+		FsckCheck:   []string{"e2fsck", "-n"},
+		FsckExit:    e2fsckExit,
+		Detect:      "ext4",
+	})
+	RegisterFs(&FsProfile{
+		Name:        Ext3,
+		Mkfs:        []string{"mkfs.ext3"},
+		DefaultArgs: strings.Split("-E nodiscard -F", " "),
+		Grow:        []string{"resize2fs"},
+		Fsck:        []string{"e2fsck", "-p"},
+		FsckCheck:   []string{"e2fsck", "-n"},
+		FsckExit:    e2fsckExit,
+		Detect:      "ext3",
+	})
+	RegisterFs(&FsProfile{
+		Name:        Xfs,
+		Mkfs:        []string{"mkfs.xfs"},
+		DefaultArgs: []string{},
+		Grow:        []string{"xfs_growfs"},
+		GrowMounted: true,
+		Fsck:        []string{"xfs_repair", "-n"},
+		FsckCheck:   []string{"xfs_repair", "-n"},
+		FsckExit:    xfsRepairExit,
+		Detect:      "xfs",
+	})
+	RegisterFs(&FsProfile{
+		Name:        Btrfs,
+		Mkfs:        []string{"mkfs.btrfs"},
+		DefaultArgs: []string{"-f"},
+		Grow:        []string{"btrfs", "filesystem", "resize", "max"},
+		GrowMounted: true,
+		Fsck:        []string{"btrfs", "check", "--readonly"},
+		FsckCheck:   []string{"btrfs", "check", "--readonly"},
+		FsckExit:    btrfsCheckExit,
+		Detect:      "btrfs",
+	})
+}
+
+// RegisterFs adds (or replaces) a filesystem profile
+func RegisterFs(p *FsProfile) {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	fsProfiles[p.Name] = p
+}
+
+// GetFs returns the profile registered under name
+func GetFs(name string) (*FsProfile, bool) {
+	fsLock.RLock()
+	defer fsLock.RUnlock()
+	p, ok := fsProfiles[name]
+	return p, ok
+}
+
+// DetectFs returns the profile whose Detect string matches the FSTYPE
+// reported for a device
+func DetectFs(fstype string) (*FsProfile, bool) {
+	fsLock.RLock()
+	defer fsLock.RUnlock()
+	for _, p := range fsProfiles {
+		if p.Detect == fstype {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// FsTypes returns the names of all registered filesystems, sorted
+func FsTypes() []string {
+	fsLock.RLock()
+	defer fsLock.RUnlock()
+	types := []string{}
+	for k := range fsProfiles {
+		types = append(types, k)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// MkfsCmd returns the command formatting device, using DefaultArgs if args
+// is empty
+func (p *FsProfile) MkfsCmd(device string, args []string) []string {
+	if len(args) == 0 {
+		args = p.DefaultArgs
+	}
+	cmd := append([]string{}, p.Mkfs...)
+	cmd = append(cmd, args...)
+	return append(cmd, device)
+}
+
+// GrowCmd returns the command growing the filesystem on device, mounted at
+// mountPath
+func (p *FsProfile) GrowCmd(device, mountPath string) []string {
+	target := device
+	if p.GrowMounted {
+		target = mountPath
+	}
+	return append(append([]string{}, p.Grow...), target)
+}
+
+// FsckCmd returns the command checking the filesystem on device, repairing
+// it if repair is set and the filesystem can be repaired safely
+func (p *FsProfile) FsckCmd(device string, repair bool) []string {
+	if repair {
+		return append(append([]string{}, p.Fsck...), device)
+	}
+	return append(append([]string{}, p.FsckCheck...), device)
+}
+
+// FsckResult interprets the exit code and output of FsckCmd
+func (p *FsProfile) FsckResult(code int, out string) FsckResult {
+	if p.FsckExit == nil {
+		if code == 0 {
+			return FsckClean
+		}
+		return FsckErrors
+	}
+	return p.FsckExit(code, out)
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFsProfiles(t *testing.T) {
+	expected := []string{Btrfs, Ext3, Ext4, Xfs}
+	if types := FsTypes(); !reflect.DeepEqual(types, expected) {
+		t.Fatalf("Registered filesystems: %v != %v", types, expected)
+	}
+	tests := []struct {
+		fs   string
+		args []string
+		mkfs []string
+		grow []string
+		fsck []string
+	}{
+		{Ext4, nil,
+			[]string{"mkfs.ext4", "-E", "lazy_itable_init=0,lazy_journal_init=0,nodiscard", "-F", "/dev/sdb"},
+			[]string{"resize2fs", "/dev/sdb"},
+			[]string{"e2fsck", "-p", "/dev/sdb"}},
+		{Xfs, []string{"-K"},
+			[]string{"mkfs.xfs", "-K", "/dev/sdb"},
+			[]string{"xfs_growfs", "/mnt"},
+			[]string{"xfs_repair", "-n", "/dev/sdb"}},
+		{Btrfs, nil,
+			[]string{"mkfs.btrfs", "-f", "/dev/sdb"},
+			[]string{"btrfs", "filesystem", "resize", "max", "/mnt"},
+			[]string{"btrfs", "check", "--readonly", "/dev/sdb"}},
+	}
+	for _, test := range tests {
+		p, ok := GetFs(test.fs)
+		if !ok {
+			t.Fatalf("No profile registered for %s", test.fs)
+		}
+		if cmd := p.MkfsCmd("/dev/sdb", test.args); !reflect.DeepEqual(cmd, test.mkfs) {
+			t.Errorf("%s mkfs: %v != %v", test.fs, cmd, test.mkfs)
+		}
+		if cmd := p.GrowCmd("/dev/sdb", "/mnt"); !reflect.DeepEqual(cmd, test.grow) {
+			t.Errorf("%s grow: %v != %v", test.fs, cmd, test.grow)
+		}
+		if cmd := p.FsckCmd("/dev/sdb", true); !reflect.DeepEqual(cmd, test.fsck) {
+			t.Errorf("%s fsck: %v != %v", test.fs, cmd, test.fsck)
+		}
+		if d, ok := DetectFs(p.Detect); !ok || d != p {
+			t.Errorf("%s not detected from %s", test.fs, p.Detect)
+		}
+	}
+}
+
+// What e2fsck -n and xfs_repair -n print for a dirty journal/log
+const (
+	e2fsckJournal  = "Warning: skipping journal recovery because doing a read-only filesystem check.\n/dev/sdb: clean, 11/65536 files, 12955/262144 blocks"
+	xfsRepairAlert = "Phase 1 - find and verify superblock...\nALERT: The filesystem has valuable metadata changes in a log which is being ignored because the -n option was used.  Expect spurious inconsistencies which may be resolved by first mounting the filesystem to replay the log."
+)
+
+func TestFsckResult(t *testing.T) {
+	ext4, _ := GetFs(Ext4)
+	xfs, _ := GetFs(Xfs)
+	tests := []struct {
+		p        *FsProfile
+		code     int
+		out      string
+		expected FsckResult
+	}{
+		{ext4, 0, "", FsckClean},
+		{ext4, 1, "", FsckRepaired},
+		{ext4, 3, "", FsckRepaired},
+		{ext4, 4, "", FsckErrors},
+		{ext4, 5, "", FsckErrors},
+		{ext4, 8, "", FsckFailed},
+		{ext4, 0, e2fsckJournal, FsckDirtyLog},
+		{ext4, 4, e2fsckJournal, FsckDirtyLog},
+		{xfs, 1, "", FsckErrors},
+		{xfs, 1, xfsRepairAlert, FsckDirtyLog},
+		{xfs, 2, "", FsckDirtyLog},
+		{xfs, 137, "", FsckFailed},
+	}
+	for _, test := range tests {
+		if r := test.p.FsckResult(test.code, test.out); r != test.expected {
+			t.Errorf("%s fsck exit %d: %s != %s", test.p.Name, test.code, r, test.expected)
+		}
+	}
+	if cmd := ext4.FsckCmd("/dev/sdb", false); !reflect.DeepEqual(cmd, []string{"e2fsck", "-n", "/dev/sdb"}) {
+		t.Errorf("ext4 read-only fsck: %v", cmd)
+	}
+}
+
+func TestRegisterFs(t *testing.T) {
+	RegisterFs(&FsProfile{Name: "zfs-test", Mkfs: []string{"mkzfs"}, Detect: "zfs_member"})
+	defer func() {
+		fsLock.Lock()
+		delete(fsProfiles, "zfs-test")
+		fsLock.Unlock()
+	}()
+	if p, ok := DetectFs("zfs_member"); !ok || p.Name != "zfs-test" {
+		t.Fatal("Newly registered filesystem not detected")
+	}
+	if _, ok := GetFs("zfs-test"); !ok {
+		t.Fatal("Newly registered filesystem not found")
+	}
+}
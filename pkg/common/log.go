@@ -4,15 +4,35 @@ import (
 	"context"
 	"fmt"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Context keys.  TraceId must stay "tid", the SDK reads it to tag its own
+// request logs
 const (
-	ReqName = "req"
-	TraceId = "tid"
+	ReqName  = "req"
+	TraceId  = "tid"
+	VolumeId = "vid"
+	NodeName = "node"
+	Method   = "method"
+)
+
+// Log field names, these are stable so log pipelines can index them
+const (
+	FieldTraceId  = "trace_id"
+	FieldReqName  = "req"
+	FieldVolumeId = "volume_id"
+	FieldNode     = "node"
+	FieldMethod   = "method"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
 )
 
 // DecorateRuntimeContext appends line, file and function context to the logger
@@ -26,12 +46,50 @@ func DecorateRuntimeContext(logger *log.Entry) *log.Entry {
 }
 
 func logHelper(ctxt context.Context) *log.Entry {
-	reqname := ctxt.Value(ReqName).(string)
-	tid := ctxt.Value(TraceId).(string)
-	return DecorateRuntimeContext(log.WithFields(log.Fields{
-		ReqName: reqname,
-		TraceId: tid,
-	}))
+	reqname, _ := ctxt.Value(ReqName).(string)
+	tid, _ := ctxt.Value(TraceId).(string)
+	fields := log.Fields{
+		FieldReqName: reqname,
+		FieldTraceId: tid,
+	}
+	for k, f := range map[string]string{VolumeId: FieldVolumeId, NodeName: FieldNode, Method: FieldMethod} {
+		if v, ok := ctxt.Value(k).(string); ok && v != "" {
+			fields[f] = v
+		}
+	}
+	return DecorateRuntimeContext(log.WithFields(fields))
+}
+
+// WithLogFields adds the volume, node and method an RPC operates on to ctxt
+// so every line logged with it carries them.  Empty values are skipped
+func WithLogFields(ctxt context.Context, vid, node, method string) context.Context {
+	for k, v := range map[string]string{VolumeId: vid, NodeName: node, Method: method} {
+		if v != "" {
+			ctxt = context.WithValue(ctxt, k, v)
+		}
+	}
+	return ctxt
+}
+
+// SetupLogging sets the log level (debug, info, warning, error) and format
+// (text, json).  Empty values keep the defaults of debug and text
+func SetupLogging(level, format string) error {
+	if level != "" {
+		l, err := log.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(l)
+	}
+	switch format {
+	case "", LogFormatText:
+		log.SetFormatter(&LogFormatter{})
+	case LogFormatJson:
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("Unsupported log format: %s, must be one of [%s, %s]", format, LogFormatText, LogFormatJson)
+	}
+	return nil
 }
 
 func Debug(ctxt context.Context, s interface{}) {
@@ -103,7 +161,14 @@ func (f *LogFormatter) Format(entry *log.Entry) ([]byte, error) {
 	level := entry.Level
 	t := entry.Time
 	fstring := ""
-	for f, v := range entry.Data {
+	// Sort the fields so lines are greppable
+	keys := make([]string, 0, len(entry.Data))
+	for f := range entry.Data {
+		keys = append(keys, f)
+	}
+	sort.Strings(keys)
+	for _, f := range keys {
+		v := entry.Data[f]
 		switch v.(type) {
 		case int, int32, int64, uint, uint32, uint64:
 			fstring = strings.Join([]string{fstring, fmt.Sprintf("%s: %d", f, v)}, " ")
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func captureLog(t *testing.T, level, format string, f func()) string {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	if err := SetupLogging(level, format); err != nil {
+		t.Fatal(err)
+	}
+	defer SetupLogging("debug", LogFormatText)
+	f()
+	return buf.String()
+}
+
+func TestJsonLogging(t *testing.T) {
+	ctxt := WithLogFields(WithCtxt(context.Background(), "CreateVolume", "trace-1234"), "CSI-vol", "node-1", "CreateVolume")
+	out := captureLog(t, "info", LogFormatJson, func() {
+		Debugf(ctxt, "Should be filtered")
+		Infof(ctxt, "Creating volume: %s", "CSI-vol")
+	})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 log line at info level, found %d: %s", len(lines), out)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Log line is not JSON: %s", err)
+	}
+	for k, v := range map[string]string{
+		FieldTraceId:  "trace-1234",
+		FieldReqName:  "CreateVolume",
+		FieldVolumeId: "CSI-vol",
+		FieldNode:     "node-1",
+		FieldMethod:   "CreateVolume",
+		"level":       "info",
+	} {
+		if entry[k] != v {
+			t.Errorf("Field %s: [%v] != [%s]", k, entry[k], v)
+		}
+	}
+}
+
+func TestTextLoggingStableOrder(t *testing.T) {
+	ctxt := WithLogFields(WithCtxt(context.Background(), "NodeStageVolume", "trace-1234"), "CSI-vol", "node-1", "")
+	out := captureLog(t, "debug", LogFormatText, func() {
+		Info(ctxt, "Staging volume")
+	})
+	if strings.Contains(out, FieldMethod+":") {
+		t.Errorf("Empty field logged: %s", out)
+	}
+	i, j := strings.Index(out, FieldNode+":"), strings.Index(out, FieldTraceId+":")
+	if i < 0 || j < 0 || i > j {
+		t.Errorf("Fields missing or not sorted: %s", out)
+	}
+}
+
+func TestSetupLoggingInvalid(t *testing.T) {
+	if err := SetupLogging("verbose", ""); err == nil {
+		t.Error("Expected an error for an invalid level")
+	}
+	if err := SetupLogging("", "xml"); err == nil {
+		t.Error("Expected an error for an invalid format")
+	}
+}
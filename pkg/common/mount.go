@@ -0,0 +1,77 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// Mount options a volume may not ask for.  They would let a pod gain
+	// privileges through the volume or change how the driver manages the
+	// mount
+	forbiddenMountOpts = map[string]bool{
+		"suid": true, "dev": true, "user": true, "users": true, "owner": true, "group": true,
+		"bind": true, "rbind": true, "remount": true, "move": true,
+		"shared": true, "rshared": true, "slave": true, "rslave": true,
+		"private": true, "rprivate": true, "unbindable": true, "runbindable": true,
+	}
+	// Options that override each other, the last one given wins
+	mountOptGroups = map[string]string{
+		"ro": "rw", "rw": "rw",
+		"exec": "exec", "noexec": "exec",
+		"sync": "sync", "async": "sync",
+		"atime": "atime", "noatime": "atime", "relatime": "atime", "norelatime": "atime", "strictatime": "atime",
+		"diratime": "diratime", "nodiratime": "diratime",
+	}
+)
+
+// SplitMountOptions splits comma separated mount options, dropping empty ones
+func SplitMountOptions(opts ...string) []string {
+	result := []string{}
+	for _, o := range opts {
+		for _, opt := range strings.Split(o, ",") {
+			if opt = strings.TrimSpace(opt); opt != "" {
+				result = append(result, opt)
+			}
+		}
+	}
+	return result
+}
+
+// CheckMountOptions returns an error for the first option that isn't safe to
+// pass to mount on behalf of a volume
+func CheckMountOptions(opts []string) error {
+	for _, opt := range opts {
+		name := strings.SplitN(opt, "=", 2)[0]
+		switch {
+		case strings.HasPrefix(opt, "-") || strings.ContainsAny(opt, " \t\n'\"\\"):
+			return fmt.Errorf("Invalid mount option %q", opt)
+		case forbiddenMountOpts[name]:
+			return fmt.Errorf("Mount option %q is not allowed", opt)
+		}
+	}
+	return nil
+}
+
+// MergeMountOptions merges lists of mount options, later lists taking
+// precedence.  A later "key=value" replaces an earlier value for key and a
+// later option replaces its opposite (eg: "ro" replaces "rw")
+func MergeMountOptions(lists ...[]string) []string {
+	result := []string{}
+	idx := map[string]int{}
+	for _, opts := range lists {
+		for _, opt := range opts {
+			key := strings.SplitN(opt, "=", 2)[0]
+			if g, ok := mountOptGroups[key]; ok {
+				key = g
+			}
+			if i, ok := idx[key]; ok {
+				result[i] = opt
+				continue
+			}
+			idx[key] = len(result)
+			result = append(result, opt)
+		}
+	}
+	return result
+}
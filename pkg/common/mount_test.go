@@ -0,0 +1,28 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMountOptions(t *testing.T) {
+	opts := SplitMountOptions("noatime, nodev,,", "discard,ro")
+	if expected := []string{"noatime", "nodev", "discard", "ro"}; !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Split mount options: %v != %v", opts, expected)
+	}
+	merged := MergeMountOptions(
+		[]string{"nodev", "rw", "relatime", "commit=5"},
+		[]string{"noatime", "commit=30"},
+		[]string{"ro", "discard"})
+	if expected := []string{"nodev", "ro", "noatime", "commit=30", "discard"}; !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("Merged mount options: %v != %v", merged, expected)
+	}
+	if err := CheckMountOptions(merged); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"suid", "dev", "bind", "remount", "rshared", "--bind", "noatime /etc"} {
+		if err := CheckMountOptions([]string{"noatime", bad}); err == nil {
+			t.Fatalf("Mount option %q was not rejected", bad)
+		}
+	}
+}
@@ -16,11 +16,15 @@ import (
 
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	tracing "github.com/Datera/datera-csi/pkg/tracing"
 )
 
 const (
-	Ext4 = "ext4"
-	Xfs  = "xfs"
+	Ext4  = "ext4"
+	Ext3  = "ext3"
+	Xfs   = "xfs"
+	Btrfs = "btrfs"
 )
 
 var (
@@ -49,7 +53,9 @@ func WithCtxt(ctxt context.Context, reqName, traceId string) context.Context {
 	if traceId == "" {
 		traceId = GenId()
 	}
-	ctxt = context.WithValue(topctxt, TraceId, traceId)
+	// Only the span is carried over from ctxt so it shows up as the parent of
+	// everything done under the new context
+	ctxt = context.WithValue(tracing.Inherit(topctxt, ctxt), TraceId, traceId)
 	ctxt = context.WithValue(ctxt, ReqName, reqName)
 	return ctxt
 }
@@ -63,10 +69,13 @@ func RunCmd(ctxt context.Context, cmd ...string) (string, error) {
 		}
 	}
 	Debugf(ctxt, "Running command: [%s]\n", strings.Join(ncmd, " "))
+	sctxt, end := tracing.Start(ctxt, "exec "+ncmd[0], tracing.Internal)
+	tracing.Annotate(sctxt, "command", strings.Join(ncmd, " "))
 	prefix := ncmd[0]
 	ncmd = ncmd[1:]
 	c := execCommand(prefix, ncmd...)
 	out, err := c.CombinedOutput()
+	end(err)
 	sout := string(out)
 	Debug(ctxt, sout)
 	return sout, err
@@ -101,6 +110,21 @@ func ParseSnapId(snapId string) (string, string) {
 	return parts[0], parts[1]
 }
 
+// Node IDs have the form "<hostname>@<initiator iqn>" so the controller can
+// resolve the initiator to place in an AppInstance ACL without needing to
+// reach the node itself
+func MkNodeId(host, iqn string) string {
+	return strings.Join([]string{host, iqn}, "@")
+}
+
+func ParseNodeId(nodeId string) (string, string) {
+	parts := strings.SplitN(nodeId, "@", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
 func GetCode(err error) codes.Code {
 	return status.Code(err)
 }
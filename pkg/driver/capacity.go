@@ -0,0 +1,57 @@
+package driver
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	units "github.com/docker/go-units"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// Datera volumes are sized in whole GiB
+const AllocationUnit = units.GiB
+
+// allocatedBytes returns the capacity of a volume of size allocation units
+func allocatedBytes(size int) int64 {
+	return int64(size) * AllocationUnit
+}
+
+// volumeSize returns the number of allocation units to give a volume for cr,
+// the smallest size holding RequiredBytes.  With no RequiredBytes the volume
+// gets def units, capped to LimitBytes.  The error is a grpc status:
+// InvalidArgument for a malformed range and OutOfRange if no whole number of
+// units fits in it
+func volumeSize(cr *csi.CapacityRange, def int) (int, error) {
+	if cr == nil || (cr.RequiredBytes == 0 && cr.LimitBytes == 0) {
+		return def, nil
+	}
+	req, lim := cr.RequiredBytes, cr.LimitBytes
+	if req < 0 || lim < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "RequiredBytes and LimitBytes cannot be negative: [%d, %d]", req, lim)
+	}
+	if lim > 0 && req > lim {
+		return 0, status.Errorf(codes.InvalidArgument, "RequiredBytes must be less than or equal to LimitBytes: [%d, %d]", req, lim)
+	}
+	var size int
+	if req == 0 {
+		size = def
+		if allocatedBytes(size) > lim {
+			size = int(lim / AllocationUnit)
+		}
+	} else {
+		size = int((req + AllocationUnit - 1) / AllocationUnit)
+	}
+	if size < 1 || (lim > 0 && allocatedBytes(size) > lim) {
+		return 0, status.Errorf(codes.OutOfRange, "No volume size in [%d, %d] bytes, volumes are allocated in multiples of %d bytes", req, lim, int64(AllocationUnit))
+	}
+	return size, nil
+}
+
+// sizeSatisfies returns whether an existing volume of size allocation units
+// is within cr
+func sizeSatisfies(size int, cr *csi.CapacityRange) bool {
+	if cr == nil {
+		return true
+	}
+	b := allocatedBytes(size)
+	return b >= cr.RequiredBytes && (cr.LimitBytes == 0 || b <= cr.LimitBytes)
+}
@@ -0,0 +1,79 @@
+package driver
+
+import (
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	units "github.com/docker/go-units"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+func TestVolumeSize(t *testing.T) {
+	tests := []struct {
+		cr   *csi.CapacityRange
+		size int
+		code codes.Code
+	}{
+		{nil, DefaultSize, codes.OK},
+		{&csi.CapacityRange{}, DefaultSize, codes.OK},
+		{&csi.CapacityRange{RequiredBytes: units.GiB}, 1, codes.OK},
+		{&csi.CapacityRange{RequiredBytes: 1}, 1, codes.OK},
+		{&csi.CapacityRange{RequiredBytes: 3 * units.GiB / 2}, 2, codes.OK},
+		{&csi.CapacityRange{RequiredBytes: 3 * units.GiB / 2, LimitBytes: 2 * units.GiB}, 2, codes.OK},
+		{&csi.CapacityRange{RequiredBytes: 5 * units.GiB / 4, LimitBytes: 3 * units.GiB / 2}, 0, codes.OutOfRange},
+		{&csi.CapacityRange{LimitBytes: 4 * units.GiB}, 4, codes.OK},
+		{&csi.CapacityRange{LimitBytes: 32 * units.GiB}, DefaultSize, codes.OK},
+		{&csi.CapacityRange{LimitBytes: units.MiB}, 0, codes.OutOfRange},
+		{&csi.CapacityRange{RequiredBytes: 2 * units.GiB, LimitBytes: units.GiB}, 0, codes.InvalidArgument},
+		{&csi.CapacityRange{RequiredBytes: -1}, 0, codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		size, err := volumeSize(test.cr, DefaultSize)
+		if code := status.Code(err); code != test.code {
+			t.Errorf("%v: expected %s, got %v", test.cr, test.code, err)
+		} else if size != test.size {
+			t.Errorf("%v: expected %d GiB, got %d", test.cr, test.size, size)
+		}
+	}
+}
+
+func TestCreateVolumeRoundsUp(t *testing.T) {
+	d := getDriverController(t)
+	req := &csi.CreateVolumeRequest{
+		Name:               "csi-capacity-test",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 3 * units.GiB / 2},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"replica_count": "1"},
+	}
+	resp, err := d.CreateVolume(getCtxt(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	if resp.Volume.CapacityBytes != 2*units.GiB {
+		t.Fatalf("Expected 2 GiB volume, got %d bytes", resp.Volume.CapacityBytes)
+	}
+	// Idempotent re-create reports the same allocation
+	again, err := d.CreateVolume(getCtxt(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Volume.CapacityBytes != resp.Volume.CapacityBytes {
+		t.Fatalf("Re-create reported %d bytes, expected %d", again.Volume.CapacityBytes, resp.Volume.CapacityBytes)
+	}
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: 5 * units.GiB}
+	if _, err = d.CreateVolume(getCtxt(), req); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists for a larger re-create, got %v", err)
+	}
+	exp, err := d.ControllerExpandVolume(getCtxt(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      resp.Volume.VolumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 * units.GiB / 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.CapacityBytes != 3*units.GiB {
+		t.Fatalf("Expected expansion to 3 GiB, got %d bytes", exp.CapacityBytes)
+	}
+}
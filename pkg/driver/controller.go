@@ -4,12 +4,12 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	units "github.com/docker/go-units"
 	ptypes "github.com/golang/protobuf/ptypes"
 	codes "google.golang.org/grpc/codes"
 	gmd "google.golang.org/grpc/metadata"
@@ -21,130 +21,37 @@ import (
 
 const (
 	DefaultSize = 16
+
+	// ControllerPublishVolume PublishContext keys, consumed by NodeStageVolume
+	PubIqn        = "iqn"
+	PubPortals    = "portals"
+	PubRoundRobin = "round_robin"
 )
 
+// Volume parameters NodeStageVolume works from.  They're passed along in the
+// PublishContext so nodes never have to read the volume's metadata
+var nodeParams = []string{
+	"fs_type",
+	"fs_args",
+	"mount_options",
+	"fsck_mode",
+	"force_format",
+	"iscsi_port",
+	"replacement_timeout",
+	"noop_out_interval",
+	"queue_depth",
+	"login_retry_count",
+}
+
 func parseVolParams(ctxt context.Context, params map[string]string) (*dc.VolOpts, error) {
-	//Golang makes something that should be simple, repetative and gross
-	if params == nil {
-		params = make(map[string]string, 16)
-	}
-	vo := &dc.VolOpts{}
-	var err error
 	co.Debugf(ctxt, "Volume Params: %s", params)
-	// set defaults
-	if _, ok := params["iops_per_gb"]; !ok {
-		params["iops_per_gb"] = "0"
-	}
-	if _, ok := params["bandwidth_per_gb"]; !ok {
-		params["bandwidth_per_gb"] = "0"
-	}
-	if _, ok := params["placement_mode"]; !ok {
-		params["placement_mode"] = "hybrid"
-	}
-	if _, ok := params["placement_policy"]; !ok {
-		params["placement_policy"] = "default"
-	}
-	if _, ok := params["round_robin"]; !ok {
-		params["round_robin"] = "false"
-	}
-	if _, ok := params["replica_count"]; !ok {
-		params["replica_count"] = "3"
-	}
-	if _, ok := params["ip_pool"]; !ok {
-		params["ip_pool"] = "default"
-	}
-	if _, ok := params["template"]; !ok {
-		params["template"] = ""
-	}
-	if _, ok := params["disable_template_override"]; !ok {
-		params["disable_template_override"] = "false"
-	}
-	if _, ok := params["read_iops_max"]; !ok {
-		params["read_iops_max"] = "0"
-	}
-	if _, ok := params["write_iops_max"]; !ok {
-		params["write_iops_max"] = "0"
-	}
-	if _, ok := params["total_iops_max"]; !ok {
-		params["total_iops_max"] = "0"
-	}
-	if _, ok := params["read_bandwidth_max"]; !ok {
-		params["read_bandwidth_max"] = "0"
-	}
-	if _, ok := params["write_bandwidth_max"]; !ok {
-		params["write_bandwidth_max"] = "0"
-	}
-	if _, ok := params["total_bandwidth_max"]; !ok {
-		params["total_bandwidth_max"] = "0"
-	}
-	if _, ok := params["delete_on_unmount"]; !ok {
-		params["delete_on_unmount"] = "false"
-	}
-
-	val, err := strconv.ParseInt(params["iops_per_gb"], 10, 0)
+	vo, warnings, err := dc.ParseVolParams(params)
 	if err != nil {
 		return nil, err
 	}
-	vo.IopsPerGb = int(val)
-	val, err = strconv.ParseInt(params["bandwidth_per_gb"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.BandwidthPerGb = int(val)
-	vo.PlacementMode = params["placement_mode"]
-        vo.PlacementPolicy = params["placement_policy"]
-	b, err := strconv.ParseBool(params["round_robin"])
-	if err != nil {
-		return nil, err
+	for _, w := range warnings {
+		co.Warning(ctxt, w)
 	}
-	vo.RoundRobin = b
-	val, err = strconv.ParseInt(params["replica_count"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.Replica = int(val)
-	vo.IpPool = params["ip_pool"]
-	vo.Template = params["template"]
-	b, err = strconv.ParseBool(params["disable_template_override"])
-	if err != nil {
-		return nil, err
-	}
-	vo.DisableTemplateOverride = b
-	val, err = strconv.ParseInt(params["read_iops_max"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.ReadIopsMax = int(val)
-	val, err = strconv.ParseInt(params["write_iops_max"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.WriteIopsMax = int(val)
-	val, err = strconv.ParseInt(params["total_iops_max"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.TotalIopsMax = int(val)
-	val, err = strconv.ParseInt(params["read_bandwidth_max"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.ReadBandwidthMax = int(val)
-	val, err = strconv.ParseInt(params["write_bandwidth_max"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.WriteBandwidthMax = int(val)
-	val, err = strconv.ParseInt(params["total_bandwidth_max"], 10, 0)
-	if err != nil {
-		return nil, err
-	}
-	vo.TotalBandwidthMax = int(val)
-	b, err = strconv.ParseBool(params["delete_on_unmount"])
-	if err != nil {
-		return nil, err
-	}
-	vo.DeleteOnUnmount = b
 	return vo, nil
 }
 
@@ -177,16 +84,122 @@ func validateSnapId(snapId string) error {
 	return nil
 }
 
-func handleTopologyRequirement(tr *csi.TopologyRequirement) error {
-	if tr == nil {
+// validateCloneSource checks that a volume with the capabilities registered
+// in md can be cloned from src.  The clone carries src's contents, so a block
+// volume can't become a filesystem or the other way around, and a filesystem
+// can't change type
+func validateCloneSource(src *dc.Volume, md *dc.VolMetadata) error {
+	smd, err := src.GetMetadata()
+	if err != nil {
+		return status.Errorf(codes.Unknown, err.Error())
+	}
+	sat, at := (*smd)["access_type"], (*md)["access_type"]
+	if sat != "" && at != "" && sat != at {
+		return status.Errorf(codes.InvalidArgument, "Cannot clone %s volume %s as a %s volume", sat, src.Name, at)
+	}
+	sfs, fs := (*smd)["fs_type"], (*md)["fs_type"]
+	if at == "mount" && sfs != "" && fs != "" && sfs != fs {
+		return status.Errorf(codes.InvalidArgument, "Cannot clone %s volume %s as %s", sfs, src.Name, fs)
+	}
+	return nil
+}
+
+const contentSourceMdKey = "content_source"
+
+// contentSourceToMetadata records cs in md, so it can be reported after the
+// volume has been created
+func contentSourceToMetadata(cs *csi.VolumeContentSource, md *dc.VolMetadata) {
+	if snap := cs.GetSnapshot(); snap != nil {
+		(*md)[contentSourceMdKey] = "snapshot/" + snap.SnapshotId
+	} else if vol := cs.GetVolume(); vol != nil {
+		(*md)[contentSourceMdKey] = "volume/" + vol.VolumeId
+	}
+}
+
+func contentSourceFromMetadata(md *dc.VolMetadata) *csi.VolumeContentSource {
+	if md == nil {
+		return nil
+	}
+	parts := strings.SplitN((*md)[contentSourceMdKey], "/", 2)
+	if len(parts) != 2 {
 		return nil
 	}
-	if len(tr.Requisite) > 0 || len(tr.Preferred) > 0 {
-		return fmt.Errorf("TopologyRequirements and Preferred Topologies are currently unsupported")
+	switch parts[0] {
+	case "snapshot":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: parts[1]},
+			},
+		}
+	case "volume":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: parts[1]},
+			},
+		}
 	}
 	return nil
 }
 
+// csiVolume converts vol to its CSI representation.  The VolumeContext holds
+// the StorageClass parameters the volume was created with, these along with
+// its content source and topology are read from md
+func csiVolume(vol *dc.Volume, md *dc.VolMetadata) *csi.Volume {
+	vctx := map[string]string{}
+	if md != nil {
+		vctx = dc.VolParamsFromMetadata(*md)
+	}
+	return &csi.Volume{
+		CapacityBytes:      allocatedBytes(vol.Size),
+		VolumeId:           vol.Name,
+		VolumeContext:      vctx,
+		ContentSource:      contentSourceFromMetadata(md),
+		AccessibleTopology: topologyFromMetadata(md),
+	}
+}
+
+// publishedMdKey is the metadata key holding the node id of the node
+// publishing a volume with initiator iqn
+func publishedMdKey(iqn string) string {
+	return "published_node:" + iqn
+}
+
+// publishedNodeIds returns the ids of the nodes vol is currently published
+// to.  The AclPolicy decides whether a volume is published, initiators
+// registered without going through ControllerPublishVolume have no known node
+// and are skipped
+func publishedNodeIds(vol *dc.Volume, md *dc.VolMetadata) []string {
+	nids := []string{}
+	if md == nil {
+		return nids
+	}
+	for _, iqn := range vol.InitiatorIqns() {
+		if nid, ok := (*md)[publishedMdKey(iqn)]; ok {
+			nids = append(nids, nid)
+		}
+	}
+	sort.Strings(nids)
+	return nids
+}
+
+// volumeCondition reports a volume as abnormal while it's offline or its
+// target isn't available to log into
+func volumeCondition(vol *dc.Volume) *csi.VolumeCondition {
+	switch {
+	case vol.AdminState != "online":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Volume admin_state is %s", vol.AdminState),
+		}
+	case vol.TargetOpState != "available":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Volume target op_state is %s", vol.TargetOpState),
+		}
+	}
+	return &csi.VolumeCondition{Message: "Volume is online and available"}
+}
+
 func registerMdFromCtxt(ctxt context.Context, md *dc.VolMetadata) error {
 	gmdata, ok := gmd.FromIncomingContext(ctxt)
 	co.Debugf(ctxt, "Recieved Metadata: %s", gmdata)
@@ -204,43 +217,46 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	chapParams := map[string]string{}
 	chapParams = co.StripSecretsAndGetChapParams(req)
 
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "CreateVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "CreateVolume", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	// Handle req.Name
 	if req.Name == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "Name must be provided (currently empty string)")
 	}
 	id := co.GenName(req.Name)
 
+	// Handle req.CapacityRange
 	cr := req.CapacityRange
-	if cr != nil && cr.LimitBytes == 0 {
-		cr.LimitBytes = cr.RequiredBytes
+	size, err := volumeSize(cr, DefaultSize)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check to see if a volume already exists with this name
-	if vol, err := d.dc.GetVolume(id, false, false); err == nil {
-		size := int64(vol.Size * units.GiB)
-		if cr != nil && (cr.LimitBytes < size || cr.RequiredBytes != size) {
-			return nil, status.Errorf(codes.AlreadyExists, "Requested volume exists, but has a different size")
+	if vol, err := d.client(ctxt).GetVolume(id, false, false); err == nil {
+		// A clone left at its source's size by a failed expansion (that
+		// couldn't be deleted either) is expanded by the retry
+		if req.VolumeContentSource.GetVolume() != nil && cr.GetRequiredBytes() > 0 && vol.Size < size {
+			co.Infof(ctxt, "Expanding existing clone %s from %d GiB to %d GiB", vol.Name, vol.Size, size)
+			if err = vol.Resize(size); err != nil {
+				return nil, status.Errorf(codes.Unknown, err.Error())
+			}
+		}
+		if !sizeSatisfies(vol.Size, cr) {
+			return nil, status.Errorf(codes.AlreadyExists, "Requested volume exists, but its size %d is outside the requested range", allocatedBytes(vol.Size))
+		}
+		vmd, err := vol.GetMetadata()
+		if err != nil {
+			co.Warning(ctxt, err)
 		}
 		return &csi.CreateVolumeResponse{
-			Volume: &csi.Volume{
-				CapacityBytes: size,
-				VolumeId:      vol.Name,
-				VolumeContext: map[string]string{},
-			},
+			Volume: csiVolume(vol, vmd),
 		}, nil
 	}
 
-	// Handle req.AccessibilityRequirements.  Currently we just error out if a topology requirement exists
-	// TODO: Implement real topology handling.
-	if err := handleTopologyRequirement(req.AccessibilityRequirements); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
-	}
-
 	md := &dc.VolMetadata{}
 	// Limit name size so we don't overflow metadata
 	if len(req.Name) > 100 {
@@ -250,6 +266,15 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	(*md)["display_name"] = req.Name
 	registerMdFromCtxt(ctxt, md)
 
+	// Handle req.Parameters
+	params, err := parseVolParams(ctxt, req.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	if params.FsType != "" {
+		(*md)["fs_type"] = params.FsType
+	}
+
 	vcs := req.VolumeCapabilities
 	if vcs == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapabilities cannot be empty")
@@ -259,11 +284,18 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			return nil, status.Errorf(codes.InvalidArgument, err.Error())
 		}
 	}
+	// A filesystem requested in the VolumeCapability wins over fs_type
+	params.FsType = (*md)["fs_type"]
 	co.Debugf(ctxt, "Metadata after registering VolumeCapabilities: %#v", *md)
-	// Handle req.Parameters
-	params, err := parseVolParams(ctxt, req.Parameters)
+
+	// Handle req.AccessibilityRequirements by mapping the requested segments
+	// to an ip_pool and/or placement_policy
+	topo, err := d.handleTopologyRequirement(ctxt, req.AccessibilityRequirements, params, req.Parameters)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		return nil, status.Errorf(codes.ResourceExhausted, err.Error())
+	}
+	if len(topo) > 0 {
+		(*md)[topologyMdKey] = topologyToMetadata(topo)
 	}
 
 	// Add parameters to metadata for storage
@@ -282,81 +314,68 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		if err = validateSnapId(snap.SnapshotId); err != nil {
 			return nil, status.Errorf(codes.InvalidArgument, err.Error())
 		}
-		src, err := d.dc.SnapshotPathFromCsiId(snap.SnapshotId)
+		src, err := d.client(ctxt).SnapshotPathFromCsiId(snap.SnapshotId)
 		if err != nil {
 			return nil, status.Errorf(codes.InvalidArgument, err.Error())
 		}
 		params.CloneSnapSrc = src
-	}
-
-	// Handle req.CapacityRange
-	if cr != nil && cr.RequiredBytes > cr.LimitBytes {
-		return &csi.CreateVolumeResponse{}, fmt.Errorf("RequiredBytes must be less than or equal to LimitBytes: [%d, %d]", cr.RequiredBytes, cr.LimitBytes)
-	}
-	var size int
-	if cr != nil {
-		// Default to LimitBytes since we've verified that it's larger than RequiredBytes
-		size = int(cr.LimitBytes / units.GiB)
-		// If we haven't been passed any capacity, default to 16 GiB
-		if size == 0 {
-			size = DefaultSize
-		} else if size < 1 {
-			size = 1
+	} else if srcVol := cs.GetVolume(); srcVol != nil {
+		src, err := d.client(ctxt).GetVolume(srcVol.VolumeId, false, false)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "Source volume %s not found: %s", srcVol.VolumeId, err)
 		}
-	} else {
-		size = DefaultSize
+		if err = validateCloneSource(src, md); err != nil {
+			return nil, err
+		}
+		// Without an explicit size the clone is as large as its source
+		if cr.GetRequiredBytes() == 0 {
+			size = src.Size
+		}
+		if src.Size > size || (cr.GetLimitBytes() > 0 && allocatedBytes(src.Size) > cr.GetLimitBytes()) {
+			return nil, status.Errorf(codes.OutOfRange, "Requested size is smaller than the %d bytes of source volume %s", allocatedBytes(src.Size), srcVol.VolumeId)
+		}
+		params.CloneVolSrc = src.Path()
 	}
+	contentSourceToMetadata(cs, md)
+
 	params.Size = size
 	// Create AppInstance/StorageInstance/Volume
 	// Fix for CET-312. QoS params sent along with volume creation call
 	// No need to update the performance_policy again
-	// Fix for CET-491. CHAP params are obtained from K8S 
+	// Fix for CET-491. CHAP params are obtained from K8S
 	// and sent to Datera backend for Auth configuration
 	// Get the CHAP params passed from Kubernetes StorageClass
 	// Strip the credentials and get it as chapParams
 
-	vol, err := d.dc.CreateVolume(id, params, false, chapParams)
+	vol, err := d.client(ctxt).CreateVolume(id, params, false, chapParams)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
+	// Clones start out the size of their source
+	if vol.Size < size {
+		co.Infof(ctxt, "Expanding clone %s from %d GiB to %d GiB", vol.Name, vol.Size, size)
+		if err = vol.Resize(size); err != nil {
+			// Otherwise every retry finds a clone of the wrong size
+			if derr := vol.Delete(false); derr != nil {
+				co.Warningf(ctxt, "Could not delete clone %s after failing to expand it: %s", vol.Name, derr)
+			}
+			return nil, status.Errorf(codes.Unknown, err.Error())
+		}
+	}
 
 	// Handle req.ControllerCreateSecrets
 	// TODO: Figure out what we want to do with secrets (software encryption maybe?)
 	// handleVolSecrets(req.ControllerCreateSecrets)
 
 	//Set metadata, fail gracefully
-	if md, err = vol.SetMetadata(md); err != nil {
+	if _, err = vol.SetMetadata(md); err != nil {
 		co.Error(ctxt, err)
 	}
 
-        // Update the ContentSource in the volume response
-        SnapSrc := &csi.VolumeContentSource_SnapshotSource{}
-        VolSrc := &csi.VolumeContentSource_VolumeSource{}
-        ContentSrc := &csi.VolumeContentSource{}
-
-        if params.CloneSrc != "" {
-                VolSrc.VolumeId = params.CloneSrc
-                ContentSrc.Type = &csi.VolumeContentSource_Volume{}
-                ContentSrc.GetType().(*csi.VolumeContentSource_Volume).Volume = VolSrc
-        } else if params.CloneVolSrc != "" {
-                VolSrc.VolumeId = params.CloneVolSrc
-                ContentSrc.Type = &csi.VolumeContentSource_Volume{}
-                ContentSrc.GetType().(*csi.VolumeContentSource_Volume).Volume = VolSrc
-        } else if params.CloneSnapSrc != "" {
-                SnapSrc.SnapshotId = params.CloneSnapSrc
-                ContentSrc.Type = &csi.VolumeContentSource_Snapshot{}
-                ContentSrc.GetType().(*csi.VolumeContentSource_Snapshot).Snapshot = SnapSrc
-        }
-
-        // Return volume response back to K8S
-        return &csi.CreateVolumeResponse{
-                Volume: &csi.Volume{
-                        CapacityBytes: int64(size * units.GiB),
-                        VolumeId:      vol.Name,
-                        VolumeContext: map[string]string{},
-                        ContentSource: ContentSrc,
-                },
-        }, nil
+	// Return volume response back to K8S
+	return &csi.CreateVolumeResponse{
+		Volume: csiVolume(vol, md),
+	}, nil
 
 }
 
@@ -365,11 +384,11 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	// Just strip the secrets from the GRPC request.
 	// Discard the returned chapParams since DeleteVolume doesn't need them.
 	_ = co.StripSecretsAndGetChapParams(req)
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "DeleteVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "DeleteVolume", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	vid := req.VolumeId
 	if req.VolumeId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -377,7 +396,7 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	// Handle req.ControllerDeleteSecrets
 	// TODO: Figure out what we want to do with secrets (software encryption maybe?)
 	// sec := req.ControllerDeleteSecrets
-	if err := d.dc.DeleteVolume(req.VolumeId, true); err != nil {
+	if err := d.client(ctxt).DeleteVolume(req.VolumeId, true); err != nil {
 		co.Errorf(ctxt, "Error deleting volume: %s.  err: %s", vid, err)
 		if strings.Contains(err.Error(), "it has snapshots") {
 			return nil, status.Errorf(codes.FailedPrecondition, "Volumes with snapshots cannot be deleted.  Delete snapshots first")
@@ -387,36 +406,139 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 }
 
 func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ControllerPublishVolume", *req)
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "ControllerPublishVolume", *req)
+	if err != nil {
+		return nil, err
+	}
 	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	}
+	if req.NodeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeId cannot be empty")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapability cannot be nil")
+	}
+	_, iqn := co.ParseNodeId(req.NodeId)
+	if iqn == "" {
+		return nil, status.Errorf(codes.NotFound, "NodeId is invalid (Not of the form hostname@initiator_iqn): %s", req.NodeId)
+	}
+	vol, err := d.client(ctxt).GetVolume(req.VolumeId, false, true)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, err.Error())
+	}
+	// Setup ACL
+	init, err := d.client(ctxt).CreateGetInitiator(iqn)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	if err = vol.RegisterAcl(init); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	// The AclPolicy only knows the IQN, remember which node it belongs to
+	if _, err = vol.SetMetadata(&dc.VolMetadata{publishedMdKey(iqn): req.NodeId}); err != nil {
+		co.Warning(ctxt, err)
 	}
-	return nil, status.Errorf(codes.Unimplemented, "ControllerPublishVolume Not Implemented")
+	// Online AI (to ensure targets are accessible)
+	if err = vol.Online(); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	md, err := vol.GetMetadata()
+	if err != nil {
+		co.Warning(ctxt, err)
+		md = &dc.VolMetadata{}
+	}
+	co.Debugf(ctxt, "Published volume %s to node %s", vol.Name, req.NodeId)
+	pctx := map[string]string{
+		PubIqn:        vol.Iqn,
+		PubPortals:    strings.Join(vol.Ips, ","),
+		PubRoundRobin: strconv.FormatBool((*md)["round_robin"] == "true"),
+	}
+	params := dc.VolParamsFromMetadata(*md)
+	for _, k := range nodeParams {
+		if v, ok := params[k]; ok {
+			pctx[k] = v
+		}
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: pctx,
+	}, nil
 }
 
 func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ControllerUnpublishVolume", *req)
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "ControllerUnpublishVolume", *req)
+	if err != nil {
+		return nil, err
+	}
 	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
+	}
+	if req.NodeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeId cannot be empty")
+	}
+	// Missing volumes, nodes or initiators mean there is nothing left to
+	// unpublish, so we succeed to keep this call idempotent
+	_, iqn := co.ParseNodeId(req.NodeId)
+	if iqn == "" {
+		co.Warningf(ctxt, "NodeId is invalid (Not of the form hostname@initiator_iqn): %s", req.NodeId)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	vol, err := d.client(ctxt).GetVolume(req.VolumeId, false, false)
+	if err != nil {
+		co.Warningf(ctxt, "VolumeId is invalid: %s", req.VolumeId)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	init, err := d.client(ctxt).GetInitiator(iqn)
+	if err != nil {
+		co.Warningf(ctxt, "No initiator found for node %s: %s", req.NodeId, err)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err = vol.UnregisterAcl(init); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	d.deleteOnUnmount(ctxt, vol)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// deleteOnUnmount deletes a delete_on_unmount volume once it's no longer
+// published to any node
+func (d *Driver) deleteOnUnmount(ctxt context.Context, vol *dc.Volume) {
+	md, err := vol.GetMetadata()
+	if err != nil {
+		co.Warning(ctxt, err)
+		return
+	}
+	if (*md)["delete_on_unmount"] != "true" {
+		return
+	}
+	if err = vol.Reload(false, false); err != nil {
+		co.Warning(ctxt, err)
+		return
+	}
+	if len(vol.InitiatorIqns()) > 0 {
+		return
+	}
+	co.Infof(ctxt, "Auto-deleting %s on unmount", vol.Name)
+	if err = vol.Delete(false); err != nil {
+		co.Warning(ctxt, err)
 	}
-	return nil, status.Errorf(codes.Unimplemented, "ControllerUnPublishVolume Not Implemented")
 }
 
 func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ValidateVolumeCapabilities", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "ValidateVolumeCapabilities", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	if req.VolumeId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
 	if req.VolumeCapabilities == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapabilities cannot be nil")
 	}
-	if _, err := d.dc.GetVolume(req.VolumeId, false, false); err != nil {
+	if _, err := d.client(ctxt).GetVolume(req.VolumeId, false, false); err != nil {
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
@@ -462,51 +584,76 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 }
 
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "ListVolumes", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
-	}
-	var err error
-	st := int64(0)
-	if req.StartingToken != "" {
-		st, err = strconv.ParseInt(req.StartingToken, 0, 0)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, err.Error())
-		}
-	}
-	vols, err := d.dc.ListVolumes(int(req.MaxEntries), int(st))
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "ListVolumes", *req)
 	if err != nil {
+		return nil, err
+	}
+	defer clean()
+	vols, nextToken, err := d.client(ctxt).ListCsiVolumes(int(req.MaxEntries), req.StartingToken)
+	if err == dc.ErrStaleToken {
+		return nil, status.Errorf(codes.Aborted, "StartingToken %s is stale, volume no longer exists", req.StartingToken)
+	} else if err != nil {
 		co.Error(ctxt, err)
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
+	// Only the page returned has its metadata loaded
 	rvols := []*csi.ListVolumesResponse_Entry{}
 	for _, vol := range vols {
+		md, err := vol.GetMetadata()
+		if err != nil {
+			co.Warning(ctxt, err)
+		}
 		rvols = append(rvols, &csi.ListVolumesResponse_Entry{
-			Volume: &csi.Volume{
-				CapacityBytes: int64(vol.Size * units.GiB),
-				VolumeId:      vol.Name,
-				VolumeContext: map[string]string{},
-				ContentSource: nil,
+			Volume: csiVolume(vol, md),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodeIds(vol, md),
+				VolumeCondition:  volumeCondition(vol),
 			},
 		})
 	}
 	return &csi.ListVolumesResponse{
-		Entries: rvols,
+		Entries:   rvols,
+		NextToken: nextToken,
 	}, nil
 }
 
-func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "GetCapacity", *req)
+func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "ControllerGetVolume", *req)
+	if err != nil {
+		return nil, err
+	}
 	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId is required")
+	}
+	vol, err := d.client(ctxt).GetVolume(req.VolumeId, false, false)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, err.Error())
+	}
+	md, err := vol.GetMetadata()
+	if err != nil {
+		co.Warning(ctxt, err)
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: csiVolume(vol, md),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIds(vol, md),
+			VolumeCondition:  volumeCondition(vol),
+		},
+	}, nil
+}
+
+func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "GetCapacity", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	params, err := parseVolParams(ctxt, req.Parameters)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	cap, err := d.dc.GetCapacity()
+	cap, err := d.client(ctxt).GetCapacity()
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
@@ -521,11 +668,11 @@ func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 }
 
 func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "controller", "ControllerGetCapabilities", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	_, clean, err := d.InitFunc(ctx, "controller", "ControllerGetCapabilities", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	resp := &csi.ControllerGetCapabilitiesResponse{Capabilities: []*csi.ControllerServiceCapability{}}
 	addCap := func(t csi.ControllerServiceCapability_RPC_Type) {
 		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
@@ -538,12 +685,16 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	}
 	for _, t := range []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 	} {
 		addCap(t)
 	}
@@ -551,18 +702,18 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 }
 
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "CreateSnapshot", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "CreateSnapshot", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	if req.SourceVolumeId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "SourceVolumeId cannot be empty")
 	}
 	if req.Name == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "Name field cannot be empty")
 	}
-	vol, err := d.dc.GetVolume(req.SourceVolumeId, false, false)
+	vol, err := d.client(ctxt).GetVolume(req.SourceVolumeId, false, false)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, err.Error())
 	}
@@ -570,10 +721,33 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
+	// The snapshot's uuid is derived from its name, which the array only
+	// keeps unique per volume
+	if existing, err := d.client(ctxt).FindSnapshotByName(req.Name); err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	} else if existing != nil && existing.Vol.Name != req.SourceVolumeId {
+		return nil, status.Errorf(codes.AlreadyExists, "Snapshot %s already exists for volume %s", req.Name, existing.Vol.Name)
+	}
 	snap, err := vol.CreateSnapshot(req.Name, params)
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
+	if !snap.Ready() {
+		co.Infof(ctxt, "Snapshot %s is not ready yet, state: %s", snap.Id, snap.Status)
+	}
+	rsnap, err := csiSnapshot(snap)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateSnapshotResponse{
+		Snapshot: rsnap,
+	}, nil
+}
+
+// csiSnapshot converts snap to its CSI representation.  ReadyToUse reflects
+// the snapshot's current op_state, the CO polls (by calling CreateSnapshot
+// again) until it becomes true
+func csiSnapshot(snap *dc.Snapshot) (*csi.Snapshot, error) {
 	ts, err := strconv.ParseFloat(snap.Id, 64)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
@@ -583,26 +757,21 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	if err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
-	//TODO Implement snapshot polling before returning
-	return &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			// We set the id to "<volume-id>:<snapshot-id>" since during delete requests
-			// we are not given the parent volume id
-			SnapshotId:     co.MkSnapId(vol.Name, snap.Id),
-			SourceVolumeId: vol.Name,
-			SizeBytes:      int64(vol.Size * units.GiB),
-			CreationTime:   pts,
-			ReadyToUse:     true,
-		},
+	return &csi.Snapshot{
+		SnapshotId:     snap.CsiId(),
+		SourceVolumeId: snap.Vol.Name,
+		SizeBytes:      allocatedBytes(snap.Vol.Size),
+		CreationTime:   pts,
+		ReadyToUse:     snap.Ready(),
 	}, nil
 }
 
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "DeleteSnapshot", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "DeleteSnapshot", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	if req.SnapshotId == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "SnapshotId is invalid (empty string)")
 	}
@@ -611,7 +780,7 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 		co.Warningf(ctxt, "SnapshotId is invalid (Not of the form app_instance_id:snapshot_id): %s", req.SnapshotId)
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
-	vol, err := d.dc.GetVolume(vid, false, false)
+	vol, err := d.client(ctxt).GetVolume(vid, false, false)
 	if err != nil {
 		co.Warningf(ctxt, "VolumeId is invalid: %s", vid)
 		return &csi.DeleteSnapshotResponse{}, nil
@@ -624,22 +793,16 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 }
 
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "ListSnapshots", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "ListSnapshots", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	rsnaps := []*csi.ListSnapshotsResponse_Entry{}
-	var err error
-	st := int64(0)
-	if req.StartingToken != "" {
-		st, err = strconv.ParseInt(req.StartingToken, 0, 0)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, err.Error())
-		}
-	}
-	snaps, nextToken, err := d.dc.ListSnapshots(req.SnapshotId, req.SourceVolumeId, int(req.MaxEntries), int(st))
-	if err != nil && req.SourceVolumeId != "" && strings.Contains(err.Error(), "NotFound") {
+	snaps, nextToken, err := d.client(ctxt).ListSnapshots(req.SnapshotId, req.SourceVolumeId, int(req.MaxEntries), req.StartingToken)
+	if err == dc.ErrInvalidToken {
+		return nil, status.Errorf(codes.Aborted, "Invalid StartingToken: %s", req.StartingToken)
+	} else if err != nil && req.SourceVolumeId != "" && strings.Contains(err.Error(), "NotFound") {
 		return &csi.ListSnapshotsResponse{
 			Entries: []*csi.ListSnapshotsResponse_Entry{},
 		}, nil
@@ -652,55 +815,51 @@ func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsReques
 	}
 	co.Debugf(ctxt, "Recieved snapshots: %#v", snaps)
 	for _, snap := range snaps {
-		ts, err := strconv.ParseFloat(snap.Id, 64)
+		rsnap, err := csiSnapshot(snap)
 		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, err.Error())
-		}
-		sec, dec := math.Modf(ts)
-		pts, err := ptypes.TimestampProto(time.Unix(int64(sec), int64(dec)))
-		if err != nil {
-			return nil, status.Errorf(codes.Unknown, err.Error())
+			return nil, err
 		}
 		rsnaps = append(rsnaps, &csi.ListSnapshotsResponse_Entry{
-			Snapshot: &csi.Snapshot{
-				SnapshotId:     co.MkSnapId(snap.Vol.Name, snap.Id),
-				SizeBytes:      int64(snap.Vol.Size * units.GiB),
-				SourceVolumeId: snap.Vol.Name,
-				CreationTime:   pts,
-			},
+			Snapshot: rsnap,
 		})
 	}
-	nt := ""
-	if nextToken != 0 {
-		nt = strconv.FormatInt(int64(nextToken), 10)
-	}
 	co.Debugf(ctxt, "Returning snapshots: %#v", rsnaps)
 	return &csi.ListSnapshotsResponse{
 		Entries:   rsnaps,
-		NextToken: nt,
+		NextToken: nextToken,
 	}, nil
 }
 
 func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "controller", "ControllerExpandVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "controller", "ControllerExpandVolume", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	cr := req.CapacityRange
-	if cr != nil && cr.LimitBytes == 0 {
-		cr.LimitBytes = cr.RequiredBytes
+	if cr == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CapacityRange must be provided")
+	}
+	size, err := volumeSize(cr, 0)
+	if err != nil {
+		return nil, err
 	}
-	vol, err := d.dc.GetVolume(req.VolumeId, false, false)
+	vol, err := d.client(ctxt).GetVolume(req.VolumeId, false, false)
 	if err != nil {
 		co.Warningf(ctxt, "VolumeId is invalid: %s", req.VolumeId)
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	if err := vol.Resize(int(cr.RequiredBytes / units.GiB)); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	// Volumes can't shrink, a retried or smaller request is already satisfied
+	if size > vol.Size {
+		if err := vol.Resize(size); err != nil {
+			return nil, status.Errorf(codes.Unknown, err.Error())
+		}
+	} else {
+		co.Debugf(ctxt, "Volume %s is already %d GiB, not resizing to %d GiB", vol.Name, vol.Size, size)
+		size = vol.Size
 	}
 	return &csi.ControllerExpandVolumeResponse{
-		CapacityBytes:         cr.RequiredBytes,
+		CapacityBytes:         allocatedBytes(size),
 		NodeExpansionRequired: true,
 	}, nil
 }
@@ -3,26 +3,52 @@ package driver
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	units "github.com/docker/go-units"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 
+	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
+	fake "github.com/Datera/datera-csi/pkg/fakeapi"
 	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
-	udc "github.com/Datera/go-udc/pkg/udc"
 )
 
+const (
+	FakeIqn = "iqn.1993-08.org.debian:01:fake"
+)
+
+var srv *fake.Server
+
+func TestMain(m *testing.M) {
+	srv = fake.NewServer()
+	dir, err := ioutil.TempDir("", "csi-driver-test")
+	if err != nil {
+		panic(err)
+	}
+	dc.InitiatorFile = filepath.Join(dir, "initiatorname.iscsi")
+	if err = ioutil.WriteFile(dc.InitiatorFile, []byte("InitiatorName="+FakeIqn+"\n"), 0644); err != nil {
+		panic(err)
+	}
+	os.Setenv(EnvDisableLogPush, "true")
+	os.Setenv(EnvStateDir, filepath.Join(dir, "staging"))
+	code := m.Run()
+	srv.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func getCtxt() context.Context {
 	return context.WithValue(context.Background(), co.TraceId, co.GenId())
 }
 
 func getDriverController(t *testing.T) *Driver {
-	conf, err := udc.GetConfig()
-	if err != nil {
-		t.Fatal(err)
-	}
-	d, err := NewDateraDriver(conf)
+	d, err := NewDateraDriverWithHTTPClient(srv.UDC(), srv.HTTPClient())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,6 +172,183 @@ func TestControllerCreateDeleteSnapshot(t *testing.T) {
 	}
 }
 
+func TestControllerCreateSnapshotNameInUse(t *testing.T) {
+	d := getDriverController(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	other, _, cleano := createVolume(t, d)
+	defer cleano()
+	name := "csi-controller-snapshot-test-" + dsdk.RandString(5)
+	resp, err := d.CreateSnapshot(getCtxt(), &csi.CreateSnapshotRequest{SourceVolumeId: id, Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteSnapshot(getCtxt(), &csi.DeleteSnapshotRequest{SnapshotId: resp.Snapshot.SnapshotId})
+	// Retried for the same volume
+	if again, err := d.CreateSnapshot(getCtxt(), &csi.CreateSnapshotRequest{SourceVolumeId: id, Name: name}); err != nil {
+		t.Fatal(err)
+	} else if again.Snapshot.SnapshotId != resp.Snapshot.SnapshotId {
+		t.Fatalf("Expected snapshot %s, got %s", resp.Snapshot.SnapshotId, again.Snapshot.SnapshotId)
+	}
+	_, err = d.CreateSnapshot(getCtxt(), &csi.CreateSnapshotRequest{SourceVolumeId: other, Name: name})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists for a name used with another volume, got: %v", err)
+	}
+}
+
+func TestControllerListVolumesPaged(t *testing.T) {
+	d := getDriverController(t)
+	want := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		id, _, cleanf := createVolume(t, d)
+		defer cleanf()
+		want[id] = true
+	}
+	srcId := ""
+	for id := range want {
+		srcId = id
+		break
+	}
+	resp, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:               "csi-controller-clone-" + dsdk.RandString(5),
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Parameters:         map[string]string{"replica_count": "1"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcId},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloneId := resp.Volume.VolumeId
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: cloneId})
+	want[cloneId] = true
+
+	// Not created by the plugin, so never listed
+	sdk, err := dsdk.NewSDKWithHTTPClient(srv.UDC(), true, srv.HTTPClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := "not-csi-" + dsdk.RandString(5)
+	if _, apierr, err := sdk.AppInstances.Create(&dsdk.AppInstancesCreateRequest{
+		Ctxt:       sdk.NewContext(),
+		Name:       other,
+		CreateMode: "openstack",
+		StorageInstances: []*dsdk.StorageInstance{{
+			Name:    "storage-1",
+			Volumes: []*dsdk.Volume{{Name: "volume-1", Size: 1, ReplicaCount: 1}},
+		}},
+	}); err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	defer d.dc.DeleteVolume(other, true)
+
+	seen := map[string]bool{}
+	token := ""
+	for page := 0; ; page++ {
+		mdCalls := srv.Calls("GET", "^/app_instances/[^/]+/metadata$")
+		lresp, err := d.ListVolumes(getCtxt(), &csi.ListVolumesRequest{
+			MaxEntries:    2,
+			StartingToken: token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lresp.Entries) > 2 {
+			t.Fatalf("Asked for 2 volumes, got %d", len(lresp.Entries))
+		}
+		// Metadata is only loaded for the page returned
+		if n := srv.Calls("GET", "^/app_instances/[^/]+/metadata$") - mdCalls; n > len(lresp.Entries) {
+			t.Fatalf("Loaded metadata %d times for %d volumes", n, len(lresp.Entries))
+		}
+		for _, e := range lresp.Entries {
+			v := e.Volume
+			if v.VolumeId == other {
+				t.Fatalf("Volume %s not created by the plugin was listed", other)
+			}
+			if seen[v.VolumeId] {
+				t.Fatalf("Volume %s listed twice", v.VolumeId)
+			}
+			seen[v.VolumeId] = true
+			if !want[v.VolumeId] {
+				continue
+			}
+			if v.VolumeContext["replica_count"] != "1" {
+				t.Errorf("Volume %s is missing its parameters: %v", v.VolumeId, v.VolumeContext)
+			}
+			src := v.ContentSource.GetVolume().GetVolumeId()
+			if (v.VolumeId == cloneId) != (src == srcId) {
+				t.Errorf("Volume %s reports the wrong content source: %v", v.VolumeId, v.ContentSource)
+			}
+		}
+		if lresp.NextToken == "" {
+			break
+		}
+		if page > 20 {
+			t.Fatalf("Too many pages, last token: %s", lresp.NextToken)
+		}
+		token = lresp.NextToken
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("Volume %s was not listed", id)
+		}
+	}
+
+	// A token naming a deleted volume is stale
+	_, err = d.ListVolumes(getCtxt(), &csi.ListVolumesRequest{StartingToken: "CSI-deleted-" + dsdk.RandString(5)})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted for a stale token, got %v", err)
+	}
+}
+
+func TestControllerCreateSnapshotNotReady(t *testing.T) {
+	d := getDriverController(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	srv.SnapshotAvailableAfter = 2
+	defer func() { srv.SnapshotAvailableAfter = 0 }()
+	req := &csi.CreateSnapshotRequest{
+		SourceVolumeId: id,
+		Name:           "csi-controller-snapshot-test-" + dsdk.RandString(5),
+	}
+	resp, err := d.CreateSnapshot(getCtxt(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapid := resp.Snapshot.SnapshotId
+	defer d.DeleteSnapshot(getCtxt(), &csi.DeleteSnapshotRequest{SnapshotId: snapid})
+	if resp.Snapshot.ReadyToUse {
+		t.Fatalf("Snapshot %s reported ready before it was available", snapid)
+	}
+
+	// Repeated calls report the current state of the same snapshot
+	ready := false
+	for i := 0; i < 5 && !ready; i++ {
+		resp, err = d.CreateSnapshot(getCtxt(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Snapshot.SnapshotId != snapid {
+			t.Fatalf("Expected snapshot %s, got %s", snapid, resp.Snapshot.SnapshotId)
+		}
+		ready = resp.Snapshot.ReadyToUse
+	}
+	if !ready {
+		t.Fatalf("Snapshot %s never became ready", snapid)
+	}
+
+	lresp, err := d.ListSnapshots(getCtxt(), &csi.ListSnapshotsRequest{SnapshotId: snapid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lresp.Entries) != 1 || !lresp.Entries[0].Snapshot.ReadyToUse {
+		t.Fatalf("Expected one ready snapshot, got %v", lresp.Entries)
+	}
+}
+
 func TestControllerCreateVolSnapshotVolumeSource(t *testing.T) {
 	d := getDriverController(t)
 	snapid, _, _, cleanf := createVolumeWithSnapshot(t, d)
@@ -191,6 +394,174 @@ func TestControllerCreateVolSnapshotVolumeSource(t *testing.T) {
 	}
 }
 
+func TestControllerCreateVolumeUnknownParameter(t *testing.T) {
+	d := getDriverController(t)
+	_, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:          "csi-controller-test-" + dsdk.RandString(5),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10737418240},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"replica_cont": "1",
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for a misspelled parameter, got: %v", err)
+	}
+}
+
+func TestControllerCreateVolumeFsTypeParameter(t *testing.T) {
+	d := getDriverController(t)
+	resp, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name:          "csi-controller-test-" + dsdk.RandString(5),
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10737418240},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"replica_count": "1",
+			"fs_type":       "xfs",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	vol, err := d.dc.GetVolume(resp.Volume.VolumeId, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.FsType != "xfs" {
+		t.Fatalf("fs_type parameter not stored: %s", vol.FsType)
+	}
+}
+
+func TestControllerCloneVolume(t *testing.T) {
+	d := getDriverController(t)
+	srcId, src, cleanf := createVolume(t, d)
+	defer cleanf()
+	clone := func(cr *csi.CapacityRange, vc *csi.VolumeCapability) (*csi.CreateVolumeResponse, error) {
+		return d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+			Name:               "csi-controller-clone-" + dsdk.RandString(5),
+			CapacityRange:      cr,
+			VolumeCapabilities: []*csi.VolumeCapability{vc},
+			Parameters:         map[string]string{"replica_count": "1"},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcId},
+				},
+			},
+		})
+	}
+	// Same size as the source when no capacity is requested
+	resp, err := clone(nil, mountCapability())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	if resp.Volume.CapacityBytes != src.CapacityBytes {
+		t.Fatalf("Clone is %d bytes, source is %d", resp.Volume.CapacityBytes, src.CapacityBytes)
+	}
+	if resp.Volume.ContentSource.GetVolume().GetVolumeId() != srcId {
+		t.Fatalf("Clone doesn't report its source: %v", resp.Volume.ContentSource)
+	}
+	// Expanded after cloning when larger
+	resp, err = clone(&csi.CapacityRange{RequiredBytes: src.CapacityBytes + units.GiB}, mountCapability())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	vol, err := d.dc.GetVolume(resp.Volume.VolumeId, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := src.CapacityBytes + units.GiB; resp.Volume.CapacityBytes != expected || allocatedBytes(vol.Size) != expected {
+		t.Fatalf("Clone not expanded to %d bytes: reported %d, allocated %d", expected, resp.Volume.CapacityBytes, allocatedBytes(vol.Size))
+	}
+	if _, err = clone(&csi.CapacityRange{RequiredBytes: units.GiB}, mountCapability()); status.Code(err) != codes.OutOfRange {
+		t.Fatalf("Expected OutOfRange for a clone smaller than its source, got %v", err)
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: mountCapability().AccessMode,
+	}
+	if _, err = clone(nil, block); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument cloning a filesystem volume as block, got %v", err)
+	}
+	if _, err = clone(nil, mountCapabilityFs(co.Xfs)); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument changing the filesystem of a clone, got %v", err)
+	}
+}
+
+func TestControllerCloneVolumeResizeFails(t *testing.T) {
+	d := getDriverController(t)
+	srcId, src, cleanf := createVolume(t, d)
+	defer cleanf()
+	clone := func(name string) (*csi.CreateVolumeResponse, error) {
+		return d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: src.CapacityBytes + units.GiB},
+			VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			Parameters:         map[string]string{"replica_count": "1"},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: srcId},
+				},
+			},
+		})
+	}
+	// The clone's expansion is the next volume update
+	resize := "^/app_instances/[^/]+/storage_instances/[^/]+/volumes/[^/]+$"
+	check := func(resp *csi.CreateVolumeResponse) {
+		if expected := src.CapacityBytes + units.GiB; resp.Volume.CapacityBytes != expected {
+			t.Fatalf("Clone not expanded on retry to %d bytes: %d", expected, resp.Volume.CapacityBytes)
+		}
+		d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId})
+	}
+
+	// The clone is deleted and created again by the retry
+	name := "csi-controller-clone-" + dsdk.RandString(5)
+	srv.InjectFault("PUT", resize, 1, &dsdk.ApiErrorResponse{Name: "InternalError", Message: "injected"})
+	if _, err := clone(name); status.Code(err) != codes.Unknown {
+		t.Fatalf("Expected the failed expansion to fail CreateVolume, got %v", err)
+	}
+	if ai := srv.AppInstance(co.GenName(name)); ai != nil {
+		t.Fatalf("Clone not deleted after failing to expand it")
+	}
+	resp, err := clone(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(resp)
+
+	// The clone couldn't be deleted, the retry expands it
+	name = "csi-controller-clone-" + dsdk.RandString(5)
+	srv.InjectFault("PUT", resize, 1, &dsdk.ApiErrorResponse{Name: "InternalError", Message: "injected"})
+	srv.InjectFault("DELETE", "^/app_instances/[^/]+$", 1, &dsdk.ApiErrorResponse{Name: "InternalError", Message: "injected"})
+	if _, err = clone(name); status.Code(err) != codes.Unknown {
+		t.Fatalf("Expected the failed expansion to fail CreateVolume, got %v", err)
+	}
+	if resp, err = clone(name); err != nil {
+		t.Fatal(err)
+	}
+	check(resp)
+}
+
 func TestControllerGetCapacity(t *testing.T) {
 	d := getDriverController(t)
 	if resp, err := d.GetCapacity(getCtxt(), &csi.GetCapacityRequest{}); err != nil {
@@ -239,3 +610,258 @@ func TestControllerExpandVolumes(t *testing.T) {
 		}
 	}
 }
+
+func TestControllerCreateVolumeApiError(t *testing.T) {
+	d := getDriverController(t)
+	name := "csi-controller-test-" + dsdk.RandString(5)
+	srv.InjectFault("POST", "^/app_instances$", 1, &dsdk.ApiErrorResponse{
+		Name:    "InternalError",
+		Message: "injected",
+	})
+	if _, err := d.CreateVolume(getCtxt(), &csi.CreateVolumeRequest{
+		Name: name,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 10737418240,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			&csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{
+						FsType: "ext4",
+					},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+	}); err == nil {
+		t.Fatal("Expected CreateVolume to fail on injected ApiError")
+	}
+	if ai := srv.AppInstance(name); ai != nil {
+		t.Fatalf("AppInstance %s was created despite injected ApiError", name)
+	}
+}
+
+func TestControllerPublishUnpublishVolume(t *testing.T) {
+	d := getDriverController(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	nid := co.MkNodeId("csi-node", FakeIqn)
+	resp, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   nid,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.PublishContext[PubIqn] == "" || resp.PublishContext[PubPortals] == "" {
+		t.Fatalf("PublishContext missing target information: %#v", resp.PublishContext)
+	}
+	if resp.PublishContext["fs_type"] != co.Ext4 || resp.PublishContext["iscsi_port"] != "3260" {
+		t.Fatalf("PublishContext missing the parameters staging needs: %#v", resp.PublishContext)
+	}
+	ai := srv.AppInstance(id)
+	if inits := ai.StorageInstances[0].AclPolicy.Initiators; len(inits) != 1 || inits[0].Id != FakeIqn {
+		t.Fatalf("Initiator %s was not added to the AclPolicy: %#v", FakeIqn, inits)
+	}
+	if _, err = d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   nid,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ai = srv.AppInstance(id)
+	if inits := ai.StorageInstances[0].AclPolicy.Initiators; len(inits) != 0 {
+		t.Fatalf("Initiator %s was not removed from the AclPolicy: %#v", FakeIqn, inits)
+	}
+}
+
+func TestControllerUnpublishDeleteOnUnmount(t *testing.T) {
+	d := getDriverController(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	vol, err := d.dc.GetVolume(id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vol.SetMetadata(&dc.VolMetadata{"delete_on_unmount": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	nids := []string{co.MkNodeId("csi-node-1", FakeIqn), co.MkNodeId("csi-node-2", FakeIqn+"-2")}
+	for _, nid := range nids {
+		if _, err = d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         id,
+			NodeId:           nid,
+			VolumeCapability: mountCapability(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, nid := range nids {
+		if _, err = d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: id,
+			NodeId:   nid,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if deleted := srv.AppInstance(id) == nil; deleted != (i == len(nids)-1) {
+			t.Fatalf("Volume deleted after unpublishing %d of %d nodes: %t", i+1, len(nids), deleted)
+		}
+	}
+}
+
+func TestControllerListVolumesPublishedNodes(t *testing.T) {
+	// Multi-tenant arrays list the AclPolicy initiators with their tenant
+	for _, tenant := range []string{"", fake.Tenant} {
+		srv.InitiatorTenant = tenant
+		testListVolumesPublishedNodes(t)
+	}
+	srv.InitiatorTenant = ""
+}
+
+func testListVolumesPublishedNodes(t *testing.T) {
+	d := getDriverController(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	published := func() []string {
+		resp, err := d.ListVolumes(getCtxt(), &csi.ListVolumesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range resp.Entries {
+			if e.Volume.VolumeId == id {
+				return e.Status.GetPublishedNodeIds()
+			}
+		}
+		t.Fatalf("Volume %s was not listed", id)
+		return nil
+	}
+	nids := []string{co.MkNodeId("csi-node-1", FakeIqn), co.MkNodeId("csi-node-2", FakeIqn+"-2")}
+	for _, nid := range nids {
+		if _, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         id,
+			NodeId:           nid,
+			VolumeCapability: mountCapability(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := published(); fmt.Sprint(got) != fmt.Sprint(nids) {
+		t.Fatalf("Expected volume published to %v, got %v", nids, got)
+	}
+	for i, nid := range nids {
+		if _, err := d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: id,
+			NodeId:   nid,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got := published(); fmt.Sprint(got) != fmt.Sprint(nids[i+1:]) {
+			t.Fatalf("Expected volume published to %v, got %v", nids[i+1:], got)
+		}
+	}
+}
+
+func TestControllerCreateVolumeTopology(t *testing.T) {
+	d := getDriverController(t)
+	pools, err := parseTopologyMap(d.name, "rack=rack1:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.env.TopologyIpPools = pools
+	rack := topologyKey(d.name, "rack")
+	req := func(racks ...string) *csi.CreateVolumeRequest {
+		tr := &csi.TopologyRequirement{}
+		for _, r := range racks {
+			tr.Requisite = append(tr.Requisite, &csi.Topology{Segments: map[string]string{rack: r}})
+		}
+		return &csi.CreateVolumeRequest{
+			Name:                      "csi-controller-test-" + dsdk.RandString(5),
+			CapacityRange:             &csi.CapacityRange{RequiredBytes: units.GiB},
+			VolumeCapabilities:        []*csi.VolumeCapability{mountCapability()},
+			Parameters:                map[string]string{"replica_count": "1"},
+			AccessibilityRequirements: tr,
+		}
+	}
+	resp, err := d.CreateVolume(getCtxt(), req("rack9", "rack1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := resp.Volume.VolumeId
+	defer d.DeleteVolume(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: id})
+	topo := resp.Volume.AccessibleTopology
+	if len(topo) != 1 || topo[0].Segments[rack] != "rack1" {
+		t.Fatalf("Expected the volume to be accessible from rack1, got %v", topo)
+	}
+	gresp, err := d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gresp.Volume.AccessibleTopology; len(got) != 1 || got[0].Segments[rack] != "rack1" {
+		t.Fatalf("Expected the topology to be read back from the volume, got %v", got)
+	}
+
+	_, err = d.CreateVolume(getCtxt(), req("rack9"))
+	if st, _ := status.FromError(err); st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted for an unmapped topology, got %v", err)
+	}
+}
+
+func TestControllerGetVolume(t *testing.T) {
+	d := getDriverController(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	nid := co.MkNodeId("csi-node", FakeIqn)
+	if _, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           nid,
+		VolumeCapability: mountCapability(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Volume.VolumeId != id {
+		t.Fatalf("Expected volume %s, got %s", id, resp.Volume.VolumeId)
+	}
+	if nids := resp.Status.PublishedNodeIds; len(nids) != 1 || nids[0] != nid {
+		t.Fatalf("Expected volume published to [%s], got %v", nid, nids)
+	}
+	if resp.Status.VolumeCondition.Abnormal {
+		t.Fatalf("Expected a normal volume, got %#v", resp.Status.VolumeCondition)
+	}
+
+	vol, err := d.dc.GetVolume(id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdk, err := dsdk.NewSDKWithHTTPClient(srv.UDC(), true, srv.HTTPClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, apierr, err := vol.Ai.Set(&dsdk.AppInstanceSetRequest{Ctxt: sdk.NewContext(), AdminState: "offline"}); err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	if resp, err = d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: id}); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Status.VolumeCondition.Abnormal {
+		t.Fatalf("Expected an offline volume to be abnormal, got %#v", resp.Status.VolumeCondition)
+	}
+
+	_, err = d.ControllerGetVolume(getCtxt(), &csi.ControllerGetVolumeRequest{VolumeId: "does-not-exist"})
+	if st, _ := status.FromError(err); st.Code() != codes.NotFound {
+		t.Fatalf("Expected NotFound for a missing volume, got %v", err)
+	}
+}
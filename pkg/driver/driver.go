@@ -3,24 +3,30 @@ package driver
 import (
 	"context"
 	"fmt"
-	"math"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	log "github.com/sirupsen/logrus"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	grpc "google.golang.org/grpc"
 	gmd "google.golang.org/grpc/metadata"
+	status "google.golang.org/grpc/status"
 
 	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
+	tracing "github.com/Datera/datera-csi/pkg/tracing"
 	udc "github.com/Datera/go-udc/pkg/udc"
 )
 
@@ -38,6 +44,28 @@ const (
 	EnvDisableLogPush   = "DAT_DISABLE_LOGPUSH"
 	EnvLogPushInterval  = "DAT_LOGPUSH_INTERVAL"
 	EnvFormatTimeout    = "DAT_FORMAT_TIMEOUT"
+	// Seconds to wait for in-flight RPCs to finish on shutdown
+	EnvShutdownTimeout = "DAT_SHUTDOWN_TIMEOUT"
+	// Overrides the default kubelet plugin socket, eg: "unix:///tmp/csi.sock"
+	EnvSocket = "DAT_SOCKET"
+	// Log level (debug, info, warning, error) and format (text, json)
+	EnvLogLevel  = "DAT_LOG_LEVEL"
+	EnvLogFormat = "DAT_LOG_FORMAT"
+	// Address for the Prometheus /metrics listener (eg: ":9808"), unset disables it
+	EnvMetricsAddr = "DAT_METRICS_ADDR"
+	// Where to send traces: "stdout", "file:///path" or "otlp://host:port",
+	// unset disables tracing
+	EnvTracingEndpoint = "DAT_TRACING_ENDPOINT"
+	// Node topology segments, eg: "rack=rack1,zone=east"
+	EnvTopology = "DAT_TOPOLOGY"
+	// Controller topology mappings, eg: "rack=rack1:pool-a,rack=rack2:pool-b"
+	EnvTopologyIpPools           = "DAT_TOPOLOGY_IP_POOLS"
+	EnvTopologyPlacementPolicies = "DAT_TOPOLOGY_PLACEMENT_POLICIES"
+	// Options every filesystem volume is mounted with, eg: "nosuid,nodev"
+	EnvMountOptions = "DAT_MOUNT_OPTIONS"
+	// Directory for the node's staging journal, defaults to
+	// /var/lib/kubelet/plugins/<driver name>/staging
+	EnvStateDir = "DAT_STATE_DIR"
 
 	IdentityType = iota + 1
 	ControllerType
@@ -67,14 +95,6 @@ var (
 	Version          = "No Version Provided"
 	Githash          = "No Githash Provided"
 	SdkVersion       = "No SdkVersion Provided"
-	SupportedFsTypes = map[string]struct{}{
-		co.Ext4: struct{}{},
-		co.Xfs:  struct{}{},
-	}
-	DefaultFsArgs = map[string][]string{
-		co.Ext4: strings.Split("-E lazy_itable_init=0,lazy_journal_init=0,nodiscard -F", " "),
-		co.Xfs:  []string{},
-	}
 )
 
 type EnvVars struct {
@@ -88,6 +108,16 @@ type EnvVars struct {
 	LogPush          bool
 	LogPushInterval  int
 	FormatTimeout    int
+	ShutdownTimeout  int
+	Socket           string
+	MetricsAddr      string
+	TracingEndpoint  string
+	MountOptions     []string
+	StateDir         string
+
+	Topology                  map[string]string
+	TopologyIpPools           map[string]string
+	TopologyPlacementPolicies map[string]string
 }
 
 func readEnvVars() *EnvVars {
@@ -128,6 +158,31 @@ func readEnvVars() *EnvVars {
 	if err != nil {
 		ft = int64(60)
 	}
+	st, err := strconv.ParseInt(os.Getenv(EnvShutdownTimeout), 0, 0)
+	if err != nil {
+		// Kubernetes kills the container 30 seconds after SIGTERM by default
+		st = int64(25)
+	}
+	topo, err := parseSegments(name, os.Getenv(EnvTopology))
+	if err != nil {
+		log.Fatalf("Invalid %s: %s", EnvTopology, err)
+	}
+	tpools, err := parseTopologyMap(name, os.Getenv(EnvTopologyIpPools))
+	if err != nil {
+		log.Fatalf("Invalid %s: %s", EnvTopologyIpPools, err)
+	}
+	tpolicies, err := parseTopologyMap(name, os.Getenv(EnvTopologyPlacementPolicies))
+	if err != nil {
+		log.Fatalf("Invalid %s: %s", EnvTopologyPlacementPolicies, err)
+	}
+	sd := os.Getenv(EnvStateDir)
+	if sd == "" {
+		sd = fmt.Sprintf("/var/lib/kubelet/plugins/%s/staging", name)
+	}
+	mopts := co.SplitMountOptions(os.Getenv(EnvMountOptions))
+	if err = co.CheckMountOptions(mopts); err != nil {
+		log.Fatalf("Invalid %s: %s", EnvMountOptions, err)
+	}
 	return &EnvVars{
 		VolPerNode:       int(vpn),
 		DisableMultipath: dm,
@@ -139,22 +194,24 @@ func readEnvVars() *EnvVars {
 		LogPush:          lp,
 		LogPushInterval:  int(lpi),
 		FormatTimeout:    int(ft),
+		ShutdownTimeout:  int(st),
+		Socket:           os.Getenv(EnvSocket),
+		MetricsAddr:      os.Getenv(EnvMetricsAddr),
+		TracingEndpoint:  os.Getenv(EnvTracingEndpoint),
+		MountOptions:     mopts,
+		StateDir:         sd,
+
+		Topology:                  topo,
+		TopologyIpPools:           tpools,
+		TopologyPlacementPolicies: tpolicies,
 	}
 }
 
 func isSupportedFs(fs string) bool {
-	_, ok := SupportedFsTypes[fs]
+	_, ok := co.GetFs(fs)
 	return ok
 }
 
-func supportedFsTypes() []string {
-	types := []string{}
-	for k := range SupportedFsTypes {
-		types = append(types, k)
-	}
-	return types
-}
-
 // Driver is a single-binary implementation of:
 //   * csi.ControllerServer
 //   * csi.IdentityServer
@@ -167,46 +224,145 @@ type Driver struct {
 	healthy       bool
 	vendorVersion string
 	manifest      *dc.Manifest
-	rpcStatus     map[string]struct{}
+	locks         *opLocks
+	journal       *stageJournal
+	stopTracing   func()
+	// Started without a Datera config, see Options
+	noApi bool
+
+	// Cancelled on Stop to end the background loops
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	stopped  chan struct{}
+	// Guards what Run sets up and Stop tears down
+	runL sync.Mutex
+	addr string
 
 	sock    string
 	name    string
 	version string
 }
 
-func NewDateraDriver(udc *udc.UDC) (*Driver, error) {
+// NeedsApi reports whether the services DAT_TYPE selects talk to the Datera
+// API.  The node service only works from what the controller hands it
+func NeedsApi() bool {
+	t := StrToType[os.Getenv(EnvType)]
+	return t != NodeType && t != NodeIdentityType
+}
+
+// Options are the Driver settings that don't come from the environment
+type Options struct {
+	// There's no Datera config, so nothing that needs the API (pushing logs
+	// to the array) is started.  Only the node service works this way
+	NoApi bool
+}
+
+func NewDateraDriver(udc *udc.UDC, opts Options) (*Driver, error) {
+	return newDateraDriver(udc, nil, opts)
+}
+
+// NewDateraDriverWithHTTPClient is NewDateraDriver with the http.Client used
+// to talk to the Datera API overridden, a nil client uses the SDK default
+func NewDateraDriverWithHTTPClient(udc *udc.UDC, hc *http.Client) (*Driver, error) {
+	return newDateraDriver(udc, hc, Options{})
+}
+
+func newDateraDriver(udc *udc.UDC, hc *http.Client, opts Options) (*Driver, error) {
 	env := readEnvVars()
+	if opts.NoApi {
+		env.LogPush = false
+	}
 	v := fmt.Sprintf("datera-csi-%s-%s-gosdk-%s", Version, Githash, SdkVersion)
-	client, err := dc.NewDateraClient(udc, false, v)
+	client, err := dc.NewDateraClientWithHTTPClient(udc, false, v, hc)
 	if err != nil {
 		return nil, err
 	}
 	dc.MetadataDebug = env.MetadataDebug
 	t := TypeToSock[env.Type]
 	sock := fmt.Sprintf("unix:///var/lib/kubelet/plugins/%s/%s.sock", env.DriverName, t)
-	return &Driver{
+	if env.Socket != "" {
+		sock = env.Socket
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Driver{
 		dc:        client,
 		name:      env.DriverName,
 		sock:      sock,
 		env:       env,
 		nid:       co.GetHost(),
 		version:   Version,
-		rpcStatus: map[string]struct{}{},
-	}, nil
+		locks:     newOpLocks(),
+		journal:   newStageJournal(env.StateDir),
+		ctx:       ctx,
+		cancel:    cancel,
+		stopped:   make(chan struct{}),
+		noApi:     opts.NoApi,
+	}
+	// Created up front so Stop never races Run for it
+	d.gs = d.newServer()
+	return d, nil
+}
+
+// newServer registers the services DAT_TYPE selects
+func (d *Driver) newServer() *grpc.Server {
+	ctxt := co.WithCtxt(context.Background(), "NewServer", "")
+	gs := grpc.NewServer(grpc.UnaryInterceptor(logServerAndSetId))
+	if d.env.Type == ControllerType || d.env.Type == ControllerIdentityType || d.env.Type == AllType {
+		co.Info(ctxt, "Starting 'controller' service\n")
+		csi.RegisterControllerServer(gs, d)
+	}
+	if d.env.Type == IdentityType || d.env.Type == NodeIdentityType || d.env.Type == ControllerIdentityType || d.env.Type == AllType {
+		co.Info(ctxt, "Starting 'identity' service\n")
+		csi.RegisterIdentityServer(gs, d)
+	}
+	if d.env.Type == NodeType || d.env.Type == NodeIdentityType || d.env.Type == AllType {
+		co.Info(ctxt, "Starting 'node' service\n")
+		csi.RegisterNodeServer(gs, d)
+	}
+	return gs
 }
 
 func (d *Driver) Run() error {
 	ctxt := co.WithCtxt(context.Background(), "Run", "")
 	co.Infof(ctxt, "Starting CSI driver\n")
+	listener, err := d.listen(ctxt)
+	if err != nil || listener == nil {
+		return err
+	}
+	go d.Heartbeater()
+	if d.env.LogPush {
+		go d.LogPusher()
+	}
+	err = d.gs.Serve(listener)
+	// Serve returns as soon as Stop closes the listener, in-flight RPCs may
+	// still be draining
+	if d.ctx.Err() != nil {
+		<-d.stopped
+		if err == grpc.ErrServerStopped {
+			err = nil
+		}
+	}
+	return err
+}
 
+// listen sets up everything Run needs before serving.  The listener is nil
+// if Stop has already been called
+func (d *Driver) listen(ctxt context.Context) (net.Listener, error) {
+	d.runL.Lock()
+	defer d.runL.Unlock()
+	if d.ctx.Err() != nil {
+		co.Info(ctxt, "CSI driver was stopped before it started\n")
+		return nil, nil
+	}
 	co.Infof(ctxt, "Parsing socket: %s\n", d.sock)
 	u, err := url.Parse(d.sock)
 	co.Debugf(ctxt, "Parsed socket: %#v\n", u)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if u.Scheme != "unix" {
-		return fmt.Errorf("Only unix sockets are supported by CSI")
+		return nil, fmt.Errorf("Only unix sockets are supported by CSI")
 	}
 	addr := path.Join(u.Host, filepath.FromSlash(u.Path))
 	if u.Host == "" {
@@ -217,44 +373,74 @@ func (d *Driver) Run() error {
 		co.Debugf(ctxt, "Creating directories: %s\n", addr)
 		err = os.MkdirAll(addr, os.ModePerm)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	co.Infof(ctxt, "Removing socket: %s\n", addr)
 	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
 		co.Errorf(ctxt, "Failed to remove unix domain socket file: %s", addr)
-		return err
+		return nil, err
 	}
 	listener, err := net.Listen(u.Scheme, addr)
 	if err != nil {
 		co.Errorf(ctxt, "Error starting listener for address: %s", addr)
-		return err
-	}
-	d.gs = grpc.NewServer(grpc.UnaryInterceptor(logServerAndSetId))
-	if d.env.Type == ControllerType || d.env.Type == ControllerIdentityType || d.env.Type == AllType {
-		co.Info(ctxt, "Starting 'controller' service\n")
-		csi.RegisterControllerServer(d.gs, d)
-	}
-	if d.env.Type == IdentityType || d.env.Type == NodeIdentityType || d.env.Type == ControllerIdentityType || d.env.Type == AllType {
-		co.Info(ctxt, "Starting 'identity' service\n")
-		csi.RegisterIdentityServer(d.gs, d)
+		return nil, err
 	}
-	if d.env.Type == NodeType || d.env.Type == NodeIdentityType || d.env.Type == AllType {
-		co.Info(ctxt, "Starting 'node' service\n")
-		csi.RegisterNodeServer(d.gs, d)
+	d.addr = addr
+	if d.env.MetricsAddr != "" {
+		d.registerMetrics(ctxt)
+		go func() {
+			co.Infof(ctxt, "Serving metrics on: %s/metrics\n", d.env.MetricsAddr)
+			if err := metrics.Serve(d.env.MetricsAddr); err != nil {
+				co.Errorf(ctxt, "Metrics listener failure: %s\n", err)
+			}
+		}()
+	}
+	if d.env.TracingEndpoint != "" {
+		co.Infof(ctxt, "Exporting traces to: %s\n", d.env.TracingEndpoint)
+		if d.stopTracing, err = tracing.Setup(d.env.TracingEndpoint, d.name); err != nil {
+			listener.Close()
+			return nil, err
+		}
 	}
 	co.Infof(ctxt, "Datera CSI Driver Serving On Socket: %s\n", addr)
-	go d.Heartbeater()
-	if d.env.LogPush {
-		go d.LogPusher()
-	}
-	return d.gs.Serve(listener)
+	return listener, nil
 }
 
+// Stop stops accepting new RPCs and gives the in-flight ones up to
+// ShutdownTimeout seconds to finish before cancelling them.  Background loops
+// are stopped and the socket is removed.  It's safe to call more than once
 func (d *Driver) Stop() {
-	ctxt := co.WithCtxt(context.Background(), "Stop", "")
-	co.Info(ctxt, "Datera CSI driver stopped")
-	d.gs.Stop()
+	d.stopOnce.Do(func() {
+		ctxt := co.WithCtxt(context.Background(), "Stop", "")
+		co.Infof(ctxt, "Stopping Datera CSI driver, waiting up to %ds for in-flight operations\n", d.env.ShutdownTimeout)
+		d.cancel()
+		done := make(chan struct{})
+		go func() {
+			d.gs.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Duration(d.env.ShutdownTimeout) * time.Second):
+			co.Warningf(ctxt, "In-flight operations did not finish in %ds, cancelling them. Operations in progress: %d", d.env.ShutdownTimeout, d.LockStats().Held)
+			d.gs.Stop()
+		}
+		// Waits for Run to finish setting up, which it won't start after
+		// the cancel above
+		d.runL.Lock()
+		defer d.runL.Unlock()
+		if d.addr != "" {
+			if err := os.Remove(d.addr); err != nil && !os.IsNotExist(err) {
+				co.Errorf(ctxt, "Failed to remove unix domain socket file: %s", d.addr)
+			}
+		}
+		if d.stopTracing != nil {
+			d.stopTracing()
+		}
+		co.Info(ctxt, "Datera CSI driver stopped")
+		close(d.stopped)
+	})
 }
 
 func (d *Driver) Heartbeater() {
@@ -262,19 +448,25 @@ func (d *Driver) Heartbeater() {
 	co.Infof(ctxt, "Starting heartbeat service. Interval: %d", d.env.Heartbeat)
         if d.env.Type == NodeType || d.env.Type == NodeIdentityType || d.env.Type == AllType {
                 d.healthy = true
+                metrics.Heartbeat(nil)
                 return
         }
 	t := d.env.Heartbeat
 	for {
-		if mf, err := d.dc.HealthCheck(ctxt); err != nil {
+		mf, err := d.dc.HealthCheck(ctxt)
+		metrics.Heartbeat(err)
+		if err != nil {
 			d.healthy = false
-			d.manifest = mf
-			d.vendorVersion = mf.BuildVersion
 			co.Errorf(ctxt, "Heartbeat failure: %s\n", err)
 		} else {
 			d.healthy = true
+			d.manifest = mf
+			d.vendorVersion = mf.BuildVersion
+		}
+		if !Sleeper(d.ctx, t) {
+			co.Info(ctxt, "Stopping heartbeat service")
+			return
 		}
-		Sleeper(t)
 	}
 }
 
@@ -283,63 +475,116 @@ func (d *Driver) LogPusher() {
 	co.Infof(ctxt, "Starting LogPusher service. Interval: %d", d.env.LogPushInterval)
 	t := d.env.LogPushInterval
 	// Give the driver a chance to start before doing first log collect
-	Sleeper(10)
+	if !Sleeper(d.ctx, 10) {
+		return
+	}
 	for {
-		if err := d.dc.LogPush(ctxt, "/etc/logrotate.d/driver-logrotate", "/var/log/driver.log.1.gz"); err != nil {
+		err := d.dc.LogPush(ctxt, "/etc/logrotate.d/driver-logrotate", "/var/log/driver.log.1.gz")
+		metrics.LogPush(err)
+		if err != nil {
 			co.Errorf(ctxt, "LogPush failure: %s\n", err)
 		}
-		Sleeper(t)
+		if !Sleeper(d.ctx, t) {
+			co.Info(ctxt, "Stopping LogPusher service")
+			return
+		}
 	}
 }
 
 func logServerAndSetId(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	id := co.GenId()
+	ctx, end := tracing.Start(ctx, info.FullMethod, tracing.Server)
+	tracing.Annotate(ctx, "datera.request_id", id)
 	ctxt := co.WithCtxt(ctx, "rpc", id)
 	ctxt = gmd.AppendToOutgoingContext(ctxt, "datera-request-id", id)
 	co.Infof(ctxt, "GRPC -- request: %s -- %s -- %+v\n", info.FullMethod, id, protosanitizer.StripSecrets(req))
 	ts1 := time.Now()
+	done := metrics.StartRPC(path.Base(info.FullMethod))
 	resp, err := handler(ctxt, req)
-	ts2 := time.Now()
-	td := math.Round(float64(ts2.Sub(ts1) / time.Second))
-	co.Infof(ctxt, "GRPC -- response: %s -- %s %fs -- %+v\n", info.FullMethod, id, td, protosanitizer.StripSecrets(resp))
+	done(status.Code(err).String())
+	end(err)
+	td := time.Since(ts1).Seconds()
+	co.Infof(ctxt, "GRPC -- response: %s -- %s %.3fs -- %+v\n", info.FullMethod, id, td, protosanitizer.StripSecrets(resp))
 	if err != nil {
 		co.Errorf(ctxt, "GRPC -- error: %s -- %s -- %+v\n", info.FullMethod, id, err)
 	}
 	return resp, err
 }
 
-func (d *Driver) InitFunc(ctx context.Context, piece, funcName string, req interface{}) (context.Context, bool, func()) {
+// InitFunc sets up the logging context for an RPC and takes the locks it
+// needs.  On success the returned function must be called to release them
+func (d *Driver) InitFunc(ctx context.Context, piece, funcName string, req interface{}) (context.Context, func(), error) {
 	id := ctx.Value(co.TraceId).(string)
 	// Sets trace id in driver
 	ctxt := co.WithCtxt(ctx, fmt.Sprintf("%s.%s", piece, funcName), id)
-	// Sets trace id in client
-	ctxt = d.dc.WithContext(ctxt)
+	node := d.nid
+	if piece == "controller" {
+		node, _ = co.ParseNodeId(reqField(req, "NodeId"))
+	}
+	vid := reqField(req, "VolumeId", "SourceVolumeId")
+	ctxt = co.WithLogFields(ctxt, vid, node, funcName)
+	tracing.Annotate(ctxt, "csi.volume_id", vid, "csi.node", node)
 	// We're not going to log the identity calls because they're really verbose with the
 	// liveness probe sidecar
 	if piece != "identity" {
 		co.Infof(ctxt, "%s service '%s' called\n", piece, funcName)
 		co.Debugf(ctxt, "%s: %+v\n", funcName, req)
 	}
-	// Kubernetes multi-call stupidity rectifier
-	// K8s will often call a long running function many times with the same arguments before the first one completes
-	// This creates a key with the function name and arguments, stores that in a map and only allows execution
-	// if the previous function is complete (and thus removed from the map).  This doesn't actually enforce anything,
-	// just returns a boolean and a cleaner function to clean the map when execution is done.  Enforcement is
-	// performed in the caller
-	//
-	// map[string]struct{} is just a workaround for Golang's lack of a native set datatype
-	key := strings.Join([]string{piece, funcName, fmt.Sprintf("%+v", req)}, "|")
-	inProgress := false
-	cleaner := func() {}
-	if _, ok := d.rpcStatus[key]; ok {
-		inProgress = true
-	} else {
-		d.rpcStatus[key] = struct{}{}
-		cleaner = func() {
-			delete(d.rpcStatus, key)
+	// Serialize operations on the same volume/snapshot, see locks.go
+	exclusive, shared := lockKeys(req)
+	release, err := d.locks.Acquire(ctx, opName(piece, funcName, req), exclusive, shared)
+	if err != nil {
+		co.Warningf(ctxt, "%s rejected: %s", funcName, err)
+		return ctxt, nil, err
+	}
+	return ctxt, release, nil
+}
+
+// reqField returns the first non-empty string field of a CSI request out of
+// names, eg: the VolumeId it operates on
+func reqField(req interface{}, names ...string) string {
+	v := reflect.ValueOf(req)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	for _, name := range names {
+		if f := v.FieldByName(name); f.IsValid() && f.Kind() == reflect.String && f.String() != "" {
+			return f.String()
+		}
+	}
+	return ""
+}
+
+// client returns the Datera client an RPC should use so its requests are
+// logged under the RPC's trace id
+func (d *Driver) client(ctxt context.Context) *dc.DateraClient {
+	return d.dc.ForContext(ctxt)
+}
+
+// LockStats reports the state of the per-volume operation locks
+func (d *Driver) LockStats() LockStats {
+	return d.locks.Stats()
+}
+
+// registerMetrics exports the driver state only known at scrape time
+func (d *Driver) registerMetrics(ctxt context.Context) {
+	for _, err := range []error{
+		metrics.RegisterGaugeFunc("operation_locks_held", "Volume and path locks currently held by in-flight operations",
+			func() float64 { return float64(d.LockStats().Held) }),
+		metrics.RegisterCounterFunc("operation_locks_acquired_total", "Operations that acquired their volume and path locks",
+			func() float64 { return float64(d.LockStats().Acquired) }),
+		metrics.RegisterCounterFunc("operation_locks_waited_total", "Identical retries that waited for the original operation",
+			func() float64 { return float64(d.LockStats().Waited) }),
+		metrics.RegisterCounterFunc("operation_locks_aborted_total", "Operations rejected because a conflicting one was in progress",
+			func() float64 { return float64(d.LockStats().Aborted) }),
+	} {
+		if err != nil {
+			co.Warningf(ctxt, "Failed to register metric: %s", err)
 		}
 	}
-	return ctxt, inProgress, cleaner
 }
 
 func RegisterVolumeCapability(ctxt context.Context, md *dc.VolMetadata, vc *csi.VolumeCapability) error {
@@ -366,17 +611,26 @@ func RegisterVolumeCapability(ctxt context.Context, md *dc.VolMetadata, vc *csi.
 	case *csi.VolumeCapability_Mount:
 		at = "mount"
 		fs = vc.GetMount().FsType
-		if fs == "" {
+		if fs == "" && (*md)["fs_type"] != "" {
+			// Set by the StorageClass fs_type parameter
+			fs = (*md)["fs_type"]
+		} else if fs == "" {
 			co.Debug(ctxt, "No filesystem type specified, defaulting to ext4")
 			fs = co.Ext4
 		}
 		if !isSupportedFs(fs) {
-			err := fmt.Errorf("Unsupported filesystem type: %s, supported types :re %s", fs, supportedFsTypes())
+			err := fmt.Errorf("Unsupported filesystem type: %s, supported types are %s", fs, co.FsTypes())
 			co.Error(ctxt, err)
 			return err
 		}
 		co.Debugf(ctxt, "Registering Filesystem %s", fs)
-		mountArgs = strings.Join(vc.GetMount().MountFlags, "")
+		// StorageClass mountOptions arrive as MountFlags
+		flags := co.SplitMountOptions(vc.GetMount().MountFlags...)
+		if err := co.CheckMountOptions(flags); err != nil {
+			co.Error(ctxt, err)
+			return err
+		}
+		mountArgs = strings.Join(flags, ",")
 		co.Debugf(ctxt, "Registering MountFlags %s", mountArgs)
 	default:
 		return fmt.Errorf("Unsupported VolumeCapability: %s.  Supported capabilities are Mount and Block", fs)
@@ -394,12 +648,15 @@ func RegisterVolumeCapability(ctxt context.Context, md *dc.VolMetadata, vc *csi.
 }
 
 // For finer grained sleeping, interval is specified in seconds
-func Sleeper(interval int) {
-	for {
-		if interval <= 0 {
-			break
-		}
-		time.Sleep(time.Second * 1)
-		interval--
+// Sleeper sleeps for interval seconds, returning false early if ctx is
+// cancelled first
+func Sleeper(ctx context.Context, interval int) bool {
+	t := time.NewTimer(time.Duration(interval) * time.Second)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
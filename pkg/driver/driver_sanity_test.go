@@ -2,11 +2,13 @@ package driver
 
 import (
 	"os"
+	"strings"
 	"testing"
 
 	sanity "github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"github.com/onsi/ginkgo/config"
 
-	udc "github.com/Datera/go-udc/pkg/udc"
+	fh "github.com/Datera/datera-csi/pkg/fakehost"
 )
 
 const (
@@ -14,34 +16,49 @@ const (
 )
 
 func getDriver(t *testing.T) *Driver {
-	conf, err := udc.GetConfig()
-	if err != nil {
+	if err := os.Setenv(EnvSocket, Endpoint); err != nil {
 		t.Fatal(err)
 	}
-	if err = os.Setenv(EnvSocket, Endpoint); err != nil {
+	if err := os.Setenv(EnvType, "all"); err != nil {
 		t.Fatal(err)
 	}
-	if err = os.Setenv(EnvType, "all"); err != nil {
+	// We advertise VOLUME_ACCESSIBILITY_CONSTRAINTS, so sanity expects the
+	// node to report a topology
+	if err := os.Setenv(EnvTopology, "zone=sanity"); err != nil {
 		t.Fatal(err)
 	}
-	d, err := NewDateraDriver(conf)
+	defer os.Unsetenv(EnvTopology)
+	d, err := NewDateraDriverWithHTTPClient(srv.UDC(), srv.HTTPClient())
 	if err != nil {
 		t.Fatal(err)
 	}
+	d.dc.SetHostExecutor(fh.New())
 	return d
 }
 
 func TestDriverSanity(t *testing.T) {
+	d := getDriver(t)
+	errc := make(chan error, 1)
 	go func() {
-		d := getDriver(t)
-		if err := d.Run(); err != nil {
-			t.Fatal(err)
-		}
+		errc <- d.Run()
 	}()
+	defer d.Stop()
+	// csi-test v1.1.1 predates the VolumeExpansion plugin capability
+	skip := []string{
+		"should return appropriate capabilities",
+	}
+	config.GinkgoConfig.SkipString = strings.Join(skip, "|")
 	sc := &sanity.Config{
-		TargetPath:  "/mnt/my-publish",
-		StagingPath: "/mnt/my-staging",
+		TargetPath:  "/tmp/csi-sanity-publish",
+		StagingPath: "/tmp/csi-sanity-staging",
 		Address:     Endpoint,
 	}
 	sanity.Test(t, sc)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+	}
 }
@@ -0,0 +1,240 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel/sdk/export/trace/tracetest"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
+	tracing "github.com/Datera/datera-csi/pkg/tracing"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	d := getDriverController(t)
+	ctxt := co.WithCtxt(context.Background(), "TestMetrics", "")
+	d.registerMetrics(ctxt)
+	// Registering twice must not panic
+	d.registerMetrics(ctxt)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/MetricsTest"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Errorf(codes.Aborted, "An operation on volume/CSI-1234 is already in progress")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := logServerAndSetId(context.Background(), nil, info, handler); status.Code(err) != codes.Aborted {
+			t.Fatalf("Interceptor changed the RPC error: %v", err)
+		}
+	}
+	// Every new client logs in on its first request
+	if _, err := d.client(ctxt).GetCapacity(); err != nil {
+		t.Fatal(err)
+	}
+	body := scrapeMetrics(t)
+	for _, line := range []string{
+		`datera_csi_rpc_requests_total{code="Aborted",method="MetricsTest"} 2`,
+		`datera_csi_rpc_in_flight{method="MetricsTest"} 0`,
+		`datera_csi_rpc_duration_seconds_count{method="MetricsTest"} 2`,
+		"datera_csi_operation_locks_held 0",
+		`datera_csi_api_requests_total{code="200",endpoint="/login",method="PUT"}`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Missing from /metrics: %s", line)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	d := getDriverController(t)
+	id, _, _ := createVolume(t, d)
+	exp := tracetest.NewInMemoryExporter()
+	stop := tracing.SetupWithExporter(exp, "test")
+	defer stop()
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/DeleteVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return d.DeleteVolume(ctx, req.(*csi.DeleteVolumeRequest))
+	}
+	if _, err := logServerAndSetId(getCtxt(), &csi.DeleteVolumeRequest{VolumeId: id}, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	spans := exp.GetSpans()
+	rpc := spans[len(spans)-1]
+	if rpc.Name != info.FullMethod {
+		t.Fatalf("Expected RPC span to end last, found: %s", rpc.Name)
+	}
+	found := false
+	for _, s := range spans {
+		if s.Name == "AppInstances.Delete" {
+			found = true
+			if s.SpanContext.TraceID != rpc.SpanContext.TraceID {
+				t.Fatal("Datera API span is not part of the RPC trace")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("No span recorded for the AppInstance delete")
+	}
+}
+
+// blockingTransport holds POST requests until release is closed
+type blockingTransport struct {
+	next    http.RoundTripper
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPost {
+		b.entered <- struct{}{}
+		<-b.release
+	}
+	return b.next.RoundTrip(req)
+}
+
+func TestGracefulStop(t *testing.T) {
+	const sock = "/tmp/test-csi-stop.sock"
+	os.Setenv(EnvSocket, "unix://"+sock)
+	defer os.Setenv(EnvSocket, Endpoint)
+	os.Setenv(EnvType, "controller")
+	defer os.Unsetenv(EnvType)
+	hc := *srv.HTTPClient()
+	bt := &blockingTransport{
+		next:    hc.Transport,
+		entered: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	if bt.next == nil {
+		bt.next = http.DefaultTransport
+	}
+	hc.Transport = bt
+	d, err := NewDateraDriverWithHTTPClient(srv.UDC(), &hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.Run()
+	}()
+	conn, err := grpc.Dial("unix://"+sock, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Start a CreateVolume and hold it in the middle of talking to the array
+	rpcErr := make(chan error, 1)
+	go func() {
+		_, err := csi.NewControllerClient(conn).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: "graceful-stop",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		}, grpc.WaitForReady(true))
+		rpcErr <- err
+	}()
+	select {
+	case <-bt.entered:
+	case err := <-rpcErr:
+		t.Fatalf("CreateVolume returned before reaching the Datera API: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("CreateVolume never reached the Datera API")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned with an RPC still in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(bt.release)
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stop did not return after the in-flight RPC finished")
+	}
+	if err := <-rpcErr; err != nil {
+		t.Fatalf("In-flight CreateVolume failed: %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Run returned error: %s", err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("Socket %s was not removed: %v", sock, err)
+	}
+	if Sleeper(d.ctx, 1) {
+		t.Fatal("Background loops were not cancelled")
+	}
+	// Safe to call again
+	d.Stop()
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	const sock = "/tmp/test-csi-stop-before-run.sock"
+	os.Setenv(EnvSocket, "unix://"+sock)
+	defer os.Setenv(EnvSocket, Endpoint)
+	d, err := NewDateraDriverWithHTTPClient(srv.UDC(), srv.HTTPClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Stop()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.Run()
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("Run returned error: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("Socket %s was created after Stop: %v", sock, err)
+	}
+}
+
+func TestNoApiDisablesLogPush(t *testing.T) {
+	defer os.Setenv(EnvDisableLogPush, os.Getenv(EnvDisableLogPush))
+	os.Setenv(EnvDisableLogPush, "false")
+	d, err := NewDateraDriver(srv.UDC(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.env.LogPush {
+		t.Fatal("Log push was disabled with API access")
+	}
+	d, err = NewDateraDriver(srv.UDC(), Options{NoApi: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.env.LogPush {
+		t.Fatal("Log push was enabled without API access")
+	}
+}
@@ -12,14 +12,14 @@ import (
 	dc "github.com/Datera/datera-csi/pkg/client"
 )
 
-func (d *Driver) getManifestData() (map[string]string, error) {
+func (d *Driver) getManifestData(ctxt context.Context) (map[string]string, error) {
 	//TODO(_alastor_): Populate manifest with Datera DSP information
 	var (
 		mf  *dc.Manifest
 		err error
 	)
 	if d.manifest == nil {
-		mf, err = d.dc.GetManifest()
+		mf, err = d.client(ctxt).GetManifest()
 		if err != nil {
 			return map[string]string{}, err
 		}
@@ -42,12 +42,12 @@ func (d *Driver) getManifestData() (map[string]string, error) {
 }
 
 func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "identity", "GetPluginInfo", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "identity", "GetPluginInfo", *req)
+	if err != nil {
+		return nil, err
 	}
-	manifest, err := d.getManifestData()
+	defer clean()
+	manifest, err := d.getManifestData(ctxt)
 	if err != nil {
 		return nil, status.Errorf(codes.Unavailable, err.Error())
 	}
@@ -59,11 +59,11 @@ func (d *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReques
 }
 
 func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "identity", "GetPluginCapabilities", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	_, clean, err := d.InitFunc(ctx, "identity", "GetPluginCapabilities", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
@@ -73,6 +73,13 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
 			{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
@@ -92,11 +99,11 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 }
 
 func (d *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "identity", "Probe", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	_, clean, err := d.InitFunc(ctx, "identity", "Probe", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	return &csi.ProbeResponse{
 		Ready: &wrappers.BoolValue{Value: d.healthy},
 	}, nil
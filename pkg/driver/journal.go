@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// NodeStageVolume records each step it completes in a per-volume journal on
+// the node, so a retry after a crash resumes where it stopped instead of
+// logging in or formatting again, and NodeUnstageVolume knows exactly what to
+// roll back.  It's the only state the node keeps, everything else comes with
+// the requests, so the node doesn't need the array to stage a volume.
+
+// Staging steps, in order.  A record's Step is the last one completed
+const (
+	// The target is recorded, the login may or may not have happened
+	stepLogin = iota + 1
+	// Logged in, DevicePath is known
+	stepLoggedIn
+	// The device has a filesystem (skipped for block volumes)
+	stepFormatted
+	// Mounted at StagingPath (or the device is ready for block volumes)
+	stepStaged
+)
+
+type stageRecord struct {
+	VolumeId    string   `json:"volume_id"`
+	StagingPath string   `json:"staging_path"`
+	Step        int      `json:"step"`
+	Iqn         string   `json:"iqn"`
+	Portals     []string `json:"portals"`
+	Port        int      `json:"port,omitempty"`
+	DevicePath  string   `json:"device_path,omitempty"`
+	Block       bool     `json:"block,omitempty"`
+	// How the volume was logged into, so the same portals are logged out of
+	SinglePath bool `json:"single_path,omitempty"`
+	RoundRobin bool `json:"round_robin,omitempty"`
+	// Filesystem on the device, which may differ from the requested one
+	FsType string `json:"fs_type,omitempty"`
+	// Outcome and time of the last check before mounting, if fsck_mode is set
+	FsckResult string `json:"fsck_result,omitempty"`
+	FsckTime   string `json:"fsck_time,omitempty"`
+}
+
+// MountPath is where the volume is published from
+func (r *stageRecord) MountPath() string {
+	if r.Block {
+		return r.DevicePath
+	}
+	return r.StagingPath
+}
+
+type stageJournal struct {
+	dir string
+}
+
+func newStageJournal(dir string) *stageJournal {
+	return &stageJournal{dir: dir}
+}
+
+func (j *stageJournal) path(vid string) string {
+	return filepath.Join(j.dir, url.PathEscape(vid)+".json")
+}
+
+// Get returns the record for vid, nil if the volume isn't staged on this node
+func (j *stageJournal) Get(vid string) (*stageRecord, error) {
+	b, err := ioutil.ReadFile(j.path(vid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := &stageRecord{}
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Put replaces the record for r.VolumeId.  The record is written to a
+// temporary file and renamed over the old one, so a crash leaves either
+// version intact
+func (j *stageJournal) Put(r *stageRecord) error {
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(j.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), j.path(r.VolumeId))
+}
+
+// Delete removes the record for vid, if any
+func (j *stageJournal) Delete(vid string) error {
+	if err := os.Remove(j.path(vid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+// Kubernetes will often call a long running function many times with the same
+// arguments before the first one completes, and independent sidecars happily
+// issue different RPCs against the same volume at the same time (eg:
+// DeleteVolume during CreateSnapshot).  Every RPC touching a volume takes a
+// lock on it first, snapshots are locked through their source volume.  Identical retries wait for the original
+// call to finish, anything else conflicting is rejected with Aborted so the
+// caller backs off and retries.
+
+type lockHolder struct {
+	op        string
+	exclusive bool
+	done      chan struct{}
+}
+
+// LockStats is a snapshot of the lock manager counters
+type LockStats struct {
+	// Locks currently held
+	Held int
+	// Total operations that acquired their locks
+	Acquired uint64
+	// Total identical retries that had to wait for the original call
+	Waited uint64
+	// Total operations rejected because of a conflicting operation
+	Aborted uint64
+}
+
+type opLocks struct {
+	m       sync.Mutex
+	holders map[string][]*lockHolder
+	stats   LockStats
+}
+
+func newOpLocks() *opLocks {
+	return &opLocks{holders: map[string][]*lockHolder{}}
+}
+
+func volLock(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "volume/" + id
+}
+
+func pathLock(p string) string {
+	if p == "" {
+		return ""
+	}
+	return "path/" + p
+}
+
+// lockKeys returns the resources an RPC must lock exclusively and the ones it
+// only needs to keep from being deleted underneath it
+func lockKeys(req interface{}) ([]string, []string) {
+	switch r := req.(type) {
+	case csi.CreateVolumeRequest:
+		shared := []string{}
+		if src := r.GetVolumeContentSource(); src != nil {
+			if snap := src.GetSnapshot(); snap != nil {
+				vid, _ := co.ParseSnapId(snap.SnapshotId)
+				shared = append(shared, volLock(vid))
+			}
+			if vol := src.GetVolume(); vol != nil {
+				shared = append(shared, volLock(vol.VolumeId))
+			}
+		}
+		if r.Name == "" {
+			return nil, shared
+		}
+		return []string{volLock(co.GenName(r.Name))}, shared
+	case csi.DeleteVolumeRequest:
+		return []string{volLock(r.VolumeId)}, nil
+	case csi.ControllerPublishVolumeRequest:
+		return []string{volLock(r.VolumeId)}, nil
+	case csi.ControllerUnpublishVolumeRequest:
+		return []string{volLock(r.VolumeId)}, nil
+	case csi.ControllerExpandVolumeRequest:
+		return []string{volLock(r.VolumeId)}, nil
+	// A snapshot's id isn't known until it's created, so a create retry
+	// and a delete of the same snapshot only meet on the source volume
+	case csi.CreateSnapshotRequest:
+		return []string{volLock(r.SourceVolumeId)}, nil
+	case csi.DeleteSnapshotRequest:
+		vid, _ := co.ParseSnapId(r.SnapshotId)
+		return []string{volLock(vid)}, nil
+	case csi.NodeStageVolumeRequest:
+		return []string{volLock(r.VolumeId)}, nil
+	case csi.NodeUnstageVolumeRequest:
+		return []string{volLock(r.VolumeId)}, nil
+	// A staged volume is published to every pod using it, only the target
+	// path is exclusive.  Staging and unstaging still wait for them
+	case csi.NodePublishVolumeRequest:
+		return []string{pathLock(r.TargetPath)}, []string{volLock(r.VolumeId)}
+	case csi.NodeUnpublishVolumeRequest:
+		return []string{pathLock(r.TargetPath)}, []string{volLock(r.VolumeId)}
+	case csi.NodeExpandVolumeRequest:
+		return []string{volLock(r.VolumeId)}, nil
+	}
+	return nil, nil
+}
+
+// conflict returns the holder blocking op from taking key, if any
+func (l *opLocks) conflict(key, op string, exclusive bool) *lockHolder {
+	for _, h := range l.holders[key] {
+		if h.op == op || exclusive || h.exclusive {
+			return h
+		}
+	}
+	return nil
+}
+
+// Acquire takes every lock needed by op.  If an identical operation already
+// holds them it waits for it to finish (or ctx to expire), any other conflict
+// returns an Aborted status.  The returned function releases the locks
+func (l *opLocks) Acquire(ctx context.Context, op string, exclusive, shared []string) (func(), error) {
+	keys := map[string]bool{}
+	for _, k := range shared {
+		if k != "" {
+			keys[k] = false
+		}
+	}
+	for _, k := range exclusive {
+		if k != "" {
+			keys[k] = true
+		}
+	}
+	if len(keys) == 0 {
+		return func() {}, nil
+	}
+	sorted := []string{}
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	waited := false
+	for {
+		l.m.Lock()
+		var blocker *lockHolder
+		var blocked string
+		for _, k := range sorted {
+			if blocker = l.conflict(k, op, keys[k]); blocker != nil {
+				blocked = k
+				break
+			}
+		}
+		if blocker == nil {
+			done := make(chan struct{})
+			for _, k := range sorted {
+				l.holders[k] = append(l.holders[k], &lockHolder{op: op, exclusive: keys[k], done: done})
+			}
+			l.stats.Held += len(sorted)
+			l.stats.Acquired++
+			l.m.Unlock()
+			return func() { l.release(sorted, done) }, nil
+		}
+		if blocker.op != op {
+			l.stats.Aborted++
+			l.m.Unlock()
+			return nil, status.Errorf(codes.Aborted, "An operation on %s is already in progress", blocked)
+		}
+		if !waited {
+			l.stats.Waited++
+			waited = true
+		}
+		l.m.Unlock()
+		select {
+		case <-blocker.done:
+		case <-ctx.Done():
+			return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+		}
+	}
+}
+
+func (l *opLocks) release(keys []string, done chan struct{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, k := range keys {
+		hs := l.holders[k]
+		for i, h := range hs {
+			if h.done == done {
+				hs = append(hs[:i], hs[i+1:]...)
+				break
+			}
+		}
+		if len(hs) == 0 {
+			delete(l.holders, k)
+		} else {
+			l.holders[k] = hs
+		}
+	}
+	l.stats.Held -= len(keys)
+	close(done)
+}
+
+func (l *opLocks) Stats() LockStats {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.stats
+}
+
+func opName(piece, funcName string, req interface{}) string {
+	return fmt.Sprintf("%s.%s|%+v", piece, funcName, req)
+}
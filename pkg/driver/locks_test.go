@@ -0,0 +1,171 @@
+package driver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+func acquire(l *opLocks, funcName string, req interface{}) (func(), error) {
+	exclusive, shared := lockKeys(req)
+	return l.Acquire(context.Background(), opName("controller", funcName, req), exclusive, shared)
+}
+
+func TestLocksConflictingOperationAborts(t *testing.T) {
+	l := newOpLocks()
+	release, err := acquire(l, "CreateSnapshot", csi.CreateSnapshotRequest{SourceVolumeId: "CSI-vol", Name: "snap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = acquire(l, "DeleteVolume", csi.DeleteVolumeRequest{VolumeId: "CSI-vol"})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted for DeleteVolume during CreateSnapshot, got: %v", err)
+	}
+	release()
+	release, err = acquire(l, "DeleteVolume", csi.DeleteVolumeRequest{VolumeId: "CSI-vol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if s := l.Stats(); s.Held != 0 || s.Aborted != 1 || s.Acquired != 2 {
+		t.Fatalf("Unexpected lock stats: %+v", s)
+	}
+}
+
+func TestLocksSharedOperationsCoexist(t *testing.T) {
+	l := newOpLocks()
+	clone := func(name string) csi.CreateVolumeRequest {
+		return csi.CreateVolumeRequest{
+			Name: name,
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "CSI-vol"}},
+			},
+		}
+	}
+	r1, err := acquire(l, "CreateVolume", clone("clone-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1()
+	r2, err := acquire(l, "CreateVolume", clone("clone-2"))
+	if err != nil {
+		t.Fatalf("Clones of the same volume should not conflict: %s", err)
+	}
+	defer r2()
+	// Unrelated volumes never conflict
+	r3, err := acquire(l, "DeleteVolume", csi.DeleteVolumeRequest{VolumeId: "CSI-other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r3()
+}
+
+func TestLocksSnapshotCreateDelete(t *testing.T) {
+	l := newOpLocks()
+	release, err := acquire(l, "CreateSnapshot", csi.CreateSnapshotRequest{SourceVolumeId: "CSI-vol", Name: "snap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	_, err = acquire(l, "DeleteSnapshot", csi.DeleteSnapshotRequest{SnapshotId: co.MkSnapId("CSI-vol", "1600000000.123")})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted for DeleteSnapshot during CreateSnapshot of the same volume, got: %v", err)
+	}
+}
+
+func TestLocksNodePublishShared(t *testing.T) {
+	l := newOpLocks()
+	r1, err := acquire(l, "NodePublishVolume", csi.NodePublishVolumeRequest{VolumeId: "CSI-vol", TargetPath: "/pod-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1()
+	r2, err := acquire(l, "NodePublishVolume", csi.NodePublishVolumeRequest{VolumeId: "CSI-vol", TargetPath: "/pod-2"})
+	if err != nil {
+		t.Fatalf("Publishing the same volume to another pod should not conflict: %s", err)
+	}
+	defer r2()
+	_, err = acquire(l, "NodeUnpublishVolume", csi.NodeUnpublishVolumeRequest{VolumeId: "CSI-vol", TargetPath: "/pod-1"})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted for NodeUnpublishVolume of a target being published, got: %v", err)
+	}
+	_, err = acquire(l, "NodeUnstageVolume", csi.NodeUnstageVolumeRequest{VolumeId: "CSI-vol", StagingTargetPath: "/staging"})
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted for NodeUnstageVolume during NodePublishVolume, got: %v", err)
+	}
+}
+
+func TestLocksIdenticalRetryWaits(t *testing.T) {
+	l := newOpLocks()
+	req := csi.DeleteVolumeRequest{VolumeId: "CSI-vol"}
+	release, err := acquire(l, "DeleteVolume", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		r, err := acquire(l, "DeleteVolume", req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("Identical retry acquired the lock while the original call held it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Identical retry did not proceed after the original call finished")
+	}
+	if s := l.Stats(); s.Waited != 1 {
+		t.Fatalf("Unexpected lock stats: %+v", s)
+	}
+}
+
+func TestLocksIdenticalRetryHonorsContext(t *testing.T) {
+	l := newOpLocks()
+	req := csi.DeleteVolumeRequest{VolumeId: "CSI-vol"}
+	release, err := acquire(l, "DeleteVolume", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	exclusive, shared := lockKeys(req)
+	if _, err = l.Acquire(ctx, opName("controller", "DeleteVolume", req), exclusive, shared); status.Code(err) != codes.Aborted {
+		t.Fatalf("Expected Aborted once the context expired, got: %v", err)
+	}
+}
+
+func TestLocksConcurrent(t *testing.T) {
+	l := newOpLocks()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := csi.NodeStageVolumeRequest{VolumeId: "CSI-vol", StagingTargetPath: string(rune('a' + i%5))}
+			if r, err := acquire(l, "NodeStageVolume", req); err == nil {
+				r()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if s := l.Stats(); s.Held != 0 {
+		t.Fatalf("Locks leaked: %+v", s)
+	}
+}
@@ -3,16 +3,17 @@ package driver
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	units "github.com/docker/go-units"
-	log "github.com/sirupsen/logrus"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 
 	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
 )
 
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
@@ -20,11 +21,11 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	chapParams := map[string]string{}
 	chapParams = co.StripSecretsAndGetChapParams(req)
 
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodeStageVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "node", "NodeStageVolume", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	vid := req.VolumeId
 	if vid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -36,49 +37,66 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	if vc == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapability cannot be nil")
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
+	rec, err := d.journal.Get(vid)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, status.Errorf(codes.Internal, "Could not read staging journal: %s", err)
 	}
-	md, err := vol.GetMetadata()
-	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	if rec != nil && rec.Step == stepStaged {
+		if rec.StagingPath != req.StagingTargetPath {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume %s is already staged at %s", vid, rec.StagingPath)
+		}
+		if d.stillStaged(ctxt, rec) {
+			co.Infof(ctxt, "Volume %s is already staged at %s", vid, rec.StagingPath)
+			return &csi.NodeStageVolumeResponse{}, nil
+		}
+		co.Warningf(ctxt, "Volume %s was staged at %s but isn't anymore, staging it again", vid, rec.StagingPath)
+		rec.Step = stepLoggedIn
+	}
+	if rec != nil && rec.StagingPath != req.StagingTargetPath {
+		// An earlier attempt at another path didn't finish, it may have
+		// mounted the volume there
+		if mounted, _ := d.client(ctxt).IsMountPoint(rec.StagingPath); mounted {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume %s is already mounted at %s", vid, rec.StagingPath)
+		}
+		rec.StagingPath = req.StagingTargetPath
 	}
+	md := nodeMetadata(req.VolumeContext, req.PublishContext)
 	if err := RegisterVolumeCapability(ctxt, md, vc); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	// Setup ACL
-	init, err := d.dc.CreateGetInitiator()
-	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	// ACL registration and onlining the AppInstance are handled by
+	// ControllerPublishVolume, which hands us the target information
+	iqn, portals := req.PublishContext[PubIqn], req.PublishContext[PubPortals]
+	if iqn == "" || portals == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "PublishContext must contain '%s' and '%s'.  Was ControllerPublishVolume called?", PubIqn, PubPortals)
+	}
+	vol := d.client(ctxt).LocalVolume(vid)
+	vol.Iqn = iqn
+	vol.Ips = strings.Split(portals, ",")
+	// Applied on every login, so changes to the parameters are picked up
+	// when the volume is staged again
+	if vol.Iscsi, err = dc.IscsiSettingsFromMetadata(*md); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	if err = vol.RegisterAcl(init); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	if rec == nil {
+		rec = &stageRecord{VolumeId: vid, StagingPath: req.StagingTargetPath, Step: stepLogin}
 	}
-
-	// This has been moved to volume creation time to satisfy silly requirements
-	// // Setup IpPool
-	// if vol.Template == "" {
-	// 	co.Debugf(ctxt, "Registering IP Pool: %s", (*md)["ip_pool"])
-	// 	if ipp, err := d.dc.GetIpPoolFromName((*md)["ip_pool"]); err != nil {
-	// 		return nil, status.Errorf(codes.NotFound, err.Error())
-	// 	} else {
-	// 		if err = vol.RegisterIpPool(ipp); err != nil {
-	// 			return nil, status.Errorf(codes.Unknown, err.Error())
-	// 		}
-	// 	}
-	// } else {
-	// 	co.Debug(ctxt, "Skipping IP Pool registration due to Template")
-	// }
-	// Online AI (to ensure targets are accessible)
-	if err = vol.Online(); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	rec.Iqn, rec.Portals, rec.Port = vol.Iqn, vol.Ips, vol.Iscsi.Port
+	rec.SinglePath, rec.RoundRobin = d.env.DisableMultipath, req.PublishContext[PubRoundRobin] == "true"
+	if err = d.journal.Put(rec); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not write staging journal: %s", err)
 	}
-	// Login to target
-	if err = vol.Login(!d.env.DisableMultipath, (*md)["round_robin"] == "true", chapParams); err != nil {
+	// Login to target.  Logging in again after a crash reuses the session
+	if err = vol.Login(!rec.SinglePath, rec.RoundRobin, chapParams); err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
-	(*md)["device_path"] = vol.DevicePath
+	rec.DevicePath = vol.DevicePath
+	if rec.Step < stepLoggedIn {
+		rec.Step = stepLoggedIn
+	}
+	if err = d.journal.Put(rec); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not write staging journal: %s", err)
+	}
 	switch vc.GetAccessType().(type) {
 
 	case *csi.VolumeCapability_Mount:
@@ -88,43 +106,143 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		if fsType == "" {
 			fsType = co.Ext4
 		}
-		fsArgs := strings.Split((*md)["fs_args"], " ")
-		if len(fsArgs) == 0 {
-			fsArgs = DefaultFsArgs[fsType]
+		// An empty list gets the filesystem's default format arguments
+		fsArgs := strings.Fields((*md)["fs_args"])
+		// A device that already has a filesystem is left as it is
+		if rec.Step < stepFormatted {
+			err = vol.Format(fsType, fsArgs, d.env.FormatTimeout, (*md)["force_format"] == "true")
+			if _, ok := err.(*dc.DeviceNotEmptyError); ok {
+				return nil, status.Errorf(codes.FailedPrecondition, "Volume %s: %s", vid, err)
+			} else if err != nil {
+				return nil, status.Errorf(codes.Unknown, err.Error())
+			}
+			// The filesystem already on the device is checked and mounted
+			// as what it is
+			if vol.FsType != "" && vol.FsType != fsType {
+				co.Warningf(ctxt, "Volume %s has a %s filesystem rather than the requested %s, using it as is", vid, vol.FsType, fsType)
+				fsType = vol.FsType
+			}
+			rec.FsType = fsType
+		} else if rec.FsType != "" {
+			fsType = rec.FsType
+		}
+		rec.Step = stepFormatted
+		if err = d.journal.Put(rec); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not write staging journal: %s", err)
+		}
+		// Driver defaults, then the StorageClass mount_options parameter,
+		// then the VolumeCapability's MountFlags
+		opts := co.MergeMountOptions(
+			d.env.MountOptions,
+			co.SplitMountOptions((*md)["mount_options"]),
+			co.SplitMountOptions((*md)["m_flags"]))
+		if err = co.CheckMountOptions(opts); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		}
+		mountArgs := []string{}
+		if len(opts) > 0 {
+			mountArgs = []string{"-o", strings.Join(opts, ",")}
 		}
-		if !vol.Formatted && (*md)["formatted"] != "true" {
-			err = vol.Format(fsType, fsArgs, d.env.FormatTimeout)
+		// The mount may have happened before a crash
+		if mounted, _ := d.client(ctxt).IsMountPoint(req.StagingTargetPath); !mounted {
+			if err = d.fsck(ctxt, vol, rec, (*md)["fsck_mode"], fsType); err != nil {
+				return nil, err
+			}
+			co.Debugf(ctxt, "Mounting %s with options %s", vid, opts)
+			err = vol.Mount(req.StagingTargetPath, mountArgs, fsType)
 			if err != nil {
 				return nil, status.Errorf(codes.Unknown, err.Error())
 			}
-			vol.Formatted = true
-			(*md)["formatted"] = "true"
-		}
-		mountArgs := strings.Split((*md)["m_args"], " ")
-		err = vol.Mount(req.StagingTargetPath, mountArgs, fsType)
-		if err != nil {
-			return nil, status.Errorf(codes.Unknown, err.Error())
 		}
-		(*md)["mount_path"] = vol.MountPath
 	case *csi.VolumeCapability_Block:
 		// No formatting is needed since this is raw block
 		co.Infof(ctxt, "Handling NodeStageVolume VolumeCapability_Block")
-		(*md)["mount_path"] = vol.DevicePath
+		rec.Block = true
 	default:
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Unknown volume capability: %#v", vc))
 	}
-	if _, err = vol.SetMetadata(md); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	rec.Step = stepStaged
+	if err = d.journal.Put(rec); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not write staging journal: %s", err)
 	}
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// nodeMetadata returns the volume parameters the node works from.
+// ControllerPublishVolume passes the current ones in the PublishContext, the
+// VolumeContext holds the ones the volume was created with
+func nodeMetadata(vctx, pctx map[string]string) *dc.VolMetadata {
+	params := map[string]string{}
+	for k, v := range vctx {
+		params[k] = v
+	}
+	for k, v := range pctx {
+		params[k] = v
+	}
+	md := dc.VolMetadataFromParams(params)
+	return &md
+}
+
+// fsck checks the filesystem before it's mounted, as the volume's fsck_mode
+// asks, recording the result in the volume's metadata and the staging journal
+func (d *Driver) fsck(ctxt context.Context, vol *dc.Volume, rec *stageRecord, mode, fsType string) error {
+	if mode != dc.FsckModeCheck && mode != dc.FsckModeRepair {
+		return nil
+	}
+	res, err := vol.Fsck(fsType, mode == dc.FsckModeRepair)
+	rec.FsckResult = string(res)
+	rec.FsckTime = time.Now().UTC().Format(time.RFC3339)
+	if jerr := d.journal.Put(rec); jerr != nil {
+		co.Warning(ctxt, jerr)
+	}
+	d.recordFsck(ctxt, vol.Name, rec)
+	if _, ok := err.(*dc.FsckError); ok {
+		if mode == dc.FsckModeRepair {
+			return status.Errorf(codes.FailedPrecondition, "Volume %s could not be repaired automatically, run fsck manually: %s", vol.Name, err)
+		}
+		return status.Errorf(codes.FailedPrecondition, "Volume %s needs repair and fsck_mode is %s, run fsck manually or set fsck_mode to %s: %s",
+			vol.Name, mode, dc.FsckModeRepair, err)
+	} else if err != nil {
+		return status.Errorf(codes.Unknown, err.Error())
+	}
+	if res == co.FsckRepaired {
+		co.Warningf(ctxt, "Repaired the filesystem of volume %s", vol.Name)
+	}
+	return nil
+}
+
+// recordFsck stores the outcome of the last check in the volume's metadata.
+// A node running without a Datera config only has the journal's copy
+func (d *Driver) recordFsck(ctxt context.Context, vid string, rec *stageRecord) {
+	if d.noApi {
+		return
+	}
+	vol, err := d.client(ctxt).GetVolume(vid, false, false)
+	if err != nil {
+		co.Warning(ctxt, err)
+		return
+	}
+	if _, err = vol.SetMetadata(&dc.VolMetadata{"fsck_result": rec.FsckResult, "fsck_time": rec.FsckTime}); err != nil {
+		co.Warning(ctxt, err)
+	}
+}
+
+// stillStaged checks that what the journal says is staged is still there
+func (d *Driver) stillStaged(ctxt context.Context, rec *stageRecord) bool {
+	if rec.Block {
+		_, err := d.client(ctxt).PathStats(rec.DevicePath)
+		return err == nil
+	}
+	mounted, err := d.client(ctxt).IsMountPoint(rec.StagingPath)
+	return err == nil && mounted
+}
+
 func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodeUnstageVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "node", "NodeUnstageVolume", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	vid := req.VolumeId
 	if vid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -132,56 +250,81 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	if req.StagingTargetPath == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "StagingTargetPath cannot be empty")
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
+	rec, err := d.journal.Get(vid)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, status.Errorf(codes.Internal, "Could not read staging journal: %s", err)
+	}
+	if rec != nil && rec.Step == stepStaged && rec.StagingPath != req.StagingTargetPath {
+		co.Warningf(ctxt, "Volume %s is staged at %s, not %s", vid, rec.StagingPath, req.StagingTargetPath)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+	vol := d.client(ctxt).LocalVolume(vid)
+	if rec == nil {
+		// Staged before the journal existed, or never staged here
+		d.unstageLegacy(ctxt, vol, req.StagingTargetPath)
+	} else {
+		// Roll back in reverse, keeping the record until everything is
+		// undone so a failed unstage can be retried
+		if mounted, _ := d.client(ctxt).IsMountPoint(rec.StagingPath); mounted {
+			vol.MountPath = rec.StagingPath
+			if err = vol.Unmount(); err != nil {
+				return nil, status.Errorf(codes.Internal, "Could not unmount %s: %s", rec.StagingPath, err)
+			}
+		}
+		rec.Step = stepLogin
+		if err = d.journal.Put(rec); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not write staging journal: %s", err)
+		}
+		// The multipath map, if any, is flushed before logging out
+		vol.Iqn, vol.Ips, vol.DevicePath = rec.Iqn, rec.Portals, rec.DevicePath
+		vol.Iscsi = &dc.IscsiSettings{Port: rec.Port}
+		if err = vol.Logout(!rec.SinglePath, rec.RoundRobin); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not log out of %s: %s", rec.Iqn, err)
+		}
+		if err = d.journal.Delete(vid); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not write staging journal: %s", err)
+		}
+		metrics.ForgetMultipath(vid)
 	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// unstageLegacy unstages a volume staged without a journal record.  Its
+// target is read from the iSCSI paths of the mounted device
+func (d *Driver) unstageLegacy(ctxt context.Context, vol *dc.Volume, staging string) {
 	// Don't return an error for failures to unmount or logout (fail gracefully)
 	// We log the errors so if something did go wrong we can track it down without bringing
 	// everything to a halt
-
-	err = vol.Unmount()
-	if err != nil {
-		co.Warning(ctxt, err)
-	}
-	md, err := vol.GetMetadata()
-	if err != nil {
-		co.Warning(ctxt, err)
-	}
-	if md == nil {
-		md = &dc.VolMetadata{}
+	if mounted, _ := d.client(ctxt).IsMountPoint(staging); !mounted {
+		return
 	}
-	(*md)["mount_path"] = ""
-	if _, err = vol.SetMetadata(md); err != nil {
-		co.Warning(ctxt, err)
+	// Found before unmounting, the mount is what leads to the device
+	terr := vol.FindTarget(staging)
+	if terr != nil {
+		co.Warning(ctxt, terr)
 	}
-	err = vol.Logout()
-	if err != nil {
+	vol.MountPath = staging
+	if err := vol.Unmount(); err != nil {
 		co.Warning(ctxt, err)
+		return
 	}
-	init, err := d.dc.CreateGetInitiator()
-	if err != nil {
-		co.Warning(ctxt, err)
+	if terr != nil {
+		co.Warningf(ctxt, "Volume %s has no staging journal record, its iSCSI session has to be logged out of manually", vol.Name)
+		return
 	}
-	err = vol.UnregisterAcl(init)
-	if err != nil {
+	// Every portal found is logged out of, whatever selected them
+	if err := vol.Logout(true, false); err != nil {
 		co.Warning(ctxt, err)
 	}
-	if (*md)["delete_on_unmount"] == "true" {
-		co.Infof(ctxt, "Auto-deleting %s on unmount", vol.Name)
-		if err = vol.Delete(false); err != nil {
-			co.Warning(ctxt, err)
-		}
-	}
-	return &csi.NodeUnstageVolumeResponse{}, nil
+	metrics.ForgetMultipath(vol.Name)
 }
 
 func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodePublishVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "node", "NodePublishVolume", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	vid := req.VolumeId
 	if vid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -192,38 +335,57 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	if req.TargetPath == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "TargetPath cannot be empty")
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
 	vc := req.VolumeCapability
 	if vc == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeCapability cannot be nil")
 	}
-	md, err := vol.GetMetadata()
-	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
-	}
+	md := nodeMetadata(req.VolumeContext, nil)
 	if err := RegisterVolumeCapability(ctxt, md, vc); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	for _, bm := range strings.Split((*md)["bind_mount"], ",") {
-		vol.BindMountPaths.Add(bm)
+	rec, err := d.journal.Get(vid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not read staging journal: %s", err)
 	}
+	vol := d.client(ctxt).LocalVolume(vid)
 	fsType := (*md)["fs_type"]
+	if rec != nil {
+		if rec.Step != stepStaged {
+			return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged", vid)
+		}
+		vol.DevicePath, vol.MountPath = rec.DevicePath, rec.MountPath()
+		if rec.FsType != "" {
+			fsType = rec.FsType
+		}
+	} else if mounted, _ := d.client(ctxt).IsMountPoint(req.StagingTargetPath); mounted && vc.GetMount() != nil {
+		// Staged before the journal existed
+		if err = vol.FindMount(req.StagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Unknown, err.Error())
+		}
+	} else {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s is not staged", vid)
+	}
 	if err = vol.BindMount(req.TargetPath, fsType); err != nil {
 		return nil, status.Errorf(codes.Unknown, err.Error())
 	}
-	(*md)["bind_mount"] = strings.Join(vol.BindMountPaths.List(), ",")
-	if _, err = vol.SetMetadata(md); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
+	if req.Readonly {
+		if _, ok := vc.GetAccessType().(*csi.VolumeCapability_Block); ok {
+			// A read-only mount of a device node doesn't stop writes to
+			// the device
+			co.Warningf(ctxt, "Readonly is not enforced for block volume %s", vid)
+		} else if err = vol.RemountReadOnly(req.TargetPath); err != nil {
+			return nil, status.Errorf(codes.Unknown, err.Error())
+		}
 	}
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	ctxt, ip, clean := d.InitFunc(ctx, "node", "NodeUnpublishVolume", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	ctxt, clean, err := d.InitFunc(ctx, "node", "NodeUnpublishVolume", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	vid := req.VolumeId
 	if vid == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
@@ -231,20 +393,7 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 	if req.TargetPath == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "TargetPath cannot be empty")
 	}
-	vol, err := d.dc.GetVolume(vid, false, true)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
-	}
-	md, err := vol.GetMetadata()
-	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
-	}
-	for _, bm := range strings.Split((*md)["bind_mount"], ",") {
-		vol.BindMountPaths.Delete(bm)
-	}
-	if _, err = vol.SetMetadata(md); err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
-	}
+	vol := d.client(ctxt).LocalVolume(vid)
 	err = vol.UnBindMount(req.TargetPath)
 	if err != nil {
 		co.Warning(ctxt, err)
@@ -253,11 +402,11 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 }
 
 func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeGetVolumeStats", *req)
-	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	_, clean, err := d.InitFunc(ctx, "node", "NodeGetCapabilities", *req)
+	if err != nil {
+		return nil, err
 	}
+	defer clean()
 	resp := &csi.NodeGetCapabilitiesResponse{Capabilities: []*csi.NodeServiceCapability{}}
 	addCap := func(t csi.NodeServiceCapability_RPC_Type) {
 		resp.Capabilities = append(resp.Capabilities, &csi.NodeServiceCapability{
@@ -272,6 +421,7 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
                 csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 	} {
 		addCap(t)
 	}
@@ -279,66 +429,174 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 }
 
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeGetInfo", *req)
+	ctxt, clean, err := d.InitFunc(ctx, "node", "NodeGetInfo", *req)
+	if err != nil {
+		return nil, err
+	}
 	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	co.Infof(ctxt, "Node server %s 'NodeGetInfo' called", d.nid)
+	// The initiator IQN is carried in the NodeId so ControllerPublishVolume
+	// can register it in the AppInstance ACL
+	iqn, err := dc.GetClientIqn(ctxt)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Could not determine initiator IQN: %s", err)
+	}
+	var topo *csi.Topology
+	if len(d.env.Topology) > 0 {
+		topo = &csi.Topology{Segments: d.env.Topology}
 	}
-	log.WithField("method", "node_get_info").Infof("Node server %s 'NodeGetInfo' called", d.nid)
 	return &csi.NodeGetInfoResponse{
-		NodeId:             d.nid,
+		NodeId:             co.MkNodeId(d.nid, iqn),
 		MaxVolumesPerNode:  int64(d.env.VolPerNode),
-		AccessibleTopology: nil,
+		AccessibleTopology: topo,
 	}, nil
 }
 
 func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeGetVolumeStats", *req)
+	ctxt, clean, err := d.InitFunc(ctx, "node", "NodeGetVolumeStats", *req)
+	if err != nil {
+		return nil, err
+	}
 	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
-	v, err := d.dc.GetVolume(req.VolumeId, false, false)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+	if req.VolumePath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumePath cannot be empty")
+	}
+	// Usage is measured on the node, the array only knows how many blocks
+	// have been written and nothing about inodes
+	st, err := d.client(ctxt).PathStats(req.VolumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "Volume %s is not published at %s: %s", req.VolumeId, req.VolumePath, err)
+	} else if err == dc.ErrNotMounted {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("Nothing is mounted at %s", req.VolumePath),
+			},
+		}, nil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Unknown, err.Error())
+	}
+	problems := []string{}
+	if msg := d.multipathHealth(ctxt, req.VolumeId); msg != "" {
+		problems = append(problems, msg)
+	}
+	if !st.Block && d.readOnlyFs(ctxt, req.VolumeId, req.VolumePath, st) {
+		co.Warningf(ctxt, "Volume %s is mounted read-only at %s", req.VolumeId, req.VolumePath)
+		problems = append(problems, fmt.Sprintf("Filesystem is read-only at %s", req.VolumePath))
+	}
+	cond := &csi.VolumeCondition{Message: "Volume is healthy"}
+	if len(problems) > 0 {
+		cond = &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, ", ")}
+	}
+	if st.Block {
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				&csi.VolumeUsage{
+					Total: st.TotalBytes,
+					Unit:  csi.VolumeUsage_BYTES,
+				},
+			},
+			VolumeCondition: cond,
+		}, nil
 	}
-	size, used, avail := v.GetUsage()
 	return &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			&csi.VolumeUsage{
-				Available: int64(avail * units.GiB),
-				Total:     int64(size * units.GiB),
-				Used:      int64(used * units.GiB),
+				Available: st.AvailableBytes,
+				Total:     st.TotalBytes,
+				Used:      st.UsedBytes,
 				Unit:      csi.VolumeUsage_BYTES,
 			},
+			&csi.VolumeUsage{
+				Available: st.FreeInodes,
+				Total:     st.TotalInodes,
+				Used:      st.UsedInodes,
+				Unit:      csi.VolumeUsage_INODES,
+			},
 		},
+		VolumeCondition: cond,
 	}, nil
 }
 
+// readOnlyFs returns whether the filesystem measured at path has gone
+// read-only.  Volumes published read-only are only read-only at their target,
+// their staging path stays writable unless the filesystem itself is
+func (d *Driver) readOnlyFs(ctxt context.Context, vid, path string, st *dc.PathStats) bool {
+	if !st.ReadOnly {
+		return false
+	}
+	rec, err := d.journal.Get(vid)
+	if err != nil || rec == nil || rec.StagingPath == path {
+		return true
+	}
+	sst, err := d.client(ctxt).PathStats(rec.StagingPath)
+	return err == nil && sst.ReadOnly
+}
+
+// multipathHealth exports the state of the paths behind a staged volume and
+// describes why it's degraded, if it is
+func (d *Driver) multipathHealth(ctxt context.Context, vid string) string {
+	rec, err := d.journal.Get(vid)
+	if err != nil || rec == nil || rec.DevicePath == "" {
+		return ""
+	}
+	mp, err := d.client(ctxt).MultipathStatus(rec.DevicePath)
+	if err != nil {
+		co.Warning(ctxt, err)
+		return ""
+	}
+	if mp == nil {
+		return ""
+	}
+	metrics.MultipathPaths(vid, mp.Active(), len(mp.Paths))
+	if mp.Active() < len(mp.Paths) {
+		co.Warningf(ctxt, "Volume %s is degraded, %s has %d of %d paths active", vid, mp.Device(), mp.Active(), len(mp.Paths))
+		return fmt.Sprintf("%s has %d of %d paths active", mp.Device(), mp.Active(), len(mp.Paths))
+	}
+	return ""
+}
+
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	_, ip, clean := d.InitFunc(ctx, "node", "NodeExpandVolume", *req)
+	ctxt, clean, err := d.InitFunc(ctx, "node", "NodeExpandVolume", *req)
+	if err != nil {
+		return nil, err
+	}
 	defer clean()
-	if ip {
-		return nil, status.Errorf(codes.Aborted, "Operation is still in progress")
+	if req.VolumeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumeId cannot be empty")
 	}
-	v, err := d.dc.GetVolume(req.VolumeId, false, false)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+	if req.VolumePath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "VolumePath cannot be empty")
 	}
-	md, err := v.GetMetadata()
+	rec, err := d.journal.Get(req.VolumeId)
 	if err != nil {
-		return nil, status.Errorf(codes.Unknown, err.Error())
-	}
-	cr := req.CapacityRange
-	if cr != nil && cr.LimitBytes == 0 {
-		cr.LimitBytes = cr.RequiredBytes
+		return nil, status.Errorf(codes.Internal, "Could not read staging journal: %s", err)
+	}
+	// Without a record the filesystem is read from the device
+	fsType := ""
+	if rec != nil {
+		fsType = rec.FsType
+	}
+	// The controller has already grown the volume, possibly past
+	// RequiredBytes to the next allocation unit.  Without a CapacityRange
+	// the filesystem is grown to whatever size the device has
+	size := 0
+	if req.CapacityRange != nil {
+		if size, err = volumeSize(req.CapacityRange, 0); err != nil {
+			return nil, err
+		}
 	}
-	size := int(cr.RequiredBytes / units.GiB)
-	if err := v.ExpandFs(req.VolumePath, (*md)["fs_type"], int64(size)); err != nil {
+	v := d.client(ctxt).LocalVolume(req.VolumeId)
+	// The device's size is reported, it may be larger than requested
+	capacity, err := v.ExpandFs(req.VolumePath, fsType, int64(size))
+	if err != nil {
 		return nil, status.Errorf(codes.FailedPrecondition, err.Error())
 	}
 	resp := &csi.NodeExpandVolumeResponse{
-		CapacityBytes: req.GetCapacityRange().RequiredBytes,
+		CapacityBytes: capacity,
 	}
 	return resp, nil
 }
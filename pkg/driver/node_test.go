@@ -1,31 +1,761 @@
 package driver
 
 import (
-	"context"
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	units "github.com/docker/go-units"
+	unix "golang.org/x/sys/unix"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
 
+	dc "github.com/Datera/datera-csi/pkg/client"
 	co "github.com/Datera/datera-csi/pkg/common"
-	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
-	udc "github.com/Datera/go-udc/pkg/udc"
+	fake "github.com/Datera/datera-csi/pkg/fakeapi"
+	fh "github.com/Datera/datera-csi/pkg/fakehost"
 )
 
-func getDriverNode(t *testing.T) *Driver {
-	conf, err := udc.GetConfig()
+func getDriverNode(t *testing.T) (*Driver, *fh.Host) {
+	d := getDriverController(t)
+	h := fh.New()
+	d.dc.SetHostExecutor(h)
+	return d, h
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return mountCapabilityFs(co.Ext4)
+}
+
+func mountCapabilityFs(fs string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				FsType: fs,
+			},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+// stageVolume creates, publishes and stages a volume on the fake host
+func stageVolume(t *testing.T, d *Driver) (string, string, func()) {
+	return stageVolumeFs(t, d, co.Ext4)
+}
+
+func stageVolumeFs(t *testing.T, d *Driver, fs string) (string, string, func()) {
+	return stageVolumeCap(t, d, mountCapabilityFs(fs), nil)
+}
+
+// stageVolumeCap stages a volume with vc after setting md in its metadata
+func stageVolumeCap(t *testing.T, d *Driver, vc *csi.VolumeCapability, md dc.VolMetadata) (string, string, func()) {
+	id, _, cleanf := createVolume(t, d)
+	if len(md) > 0 {
+		vol, err := d.dc.GetVolume(id, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = vol.SetMetadata(&md); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := d.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: vc,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	d, err := NewDateraDriver(conf)
+	staging := filepath.Join("/var/lib/kubelet/plugins/kubernetes.io/csi/pv", id, "globalmount")
+	if _, err = d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		PublishContext:    pub.PublishContext,
+		StagingTargetPath: staging,
+		VolumeCapability:  vc,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return id, staging, func() {
+		if _, err := d.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: staging,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: id,
+			NodeId:   info.NodeId,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		cleanf()
+	}
+}
+
+func TestNodeUnstageVolumeLegacy(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	rec, err := d.journal.Get(id)
+	if err != nil || rec == nil {
+		t.Fatalf("No staging journal record: %v", err)
+	}
+	// Staged before the journal existed
+	if err = d.journal.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	cleanf()
+	if dev := h.Mounted(staging); dev != "" {
+		t.Fatalf("Staging path still mounted after unstage: %s", dev)
+	}
+	if n := h.Ran("multipath -f " + h.MultipathMap); n != 1 {
+		t.Fatalf("Expected the map to be flushed once, found %d calls", n)
+	}
+	disconnects, portals := h.Disconnects(), h.DisconnectPortals()
+	if len(disconnects) != 1 || disconnects[0] != rec.Iqn {
+		t.Fatalf("Expected a logout of %s, got %v", rec.Iqn, disconnects)
+	}
+	if !reflect.DeepEqual(portals[0], rec.Portals) {
+		t.Fatalf("Expected a logout of portals %v, got %v", rec.Portals, portals[0])
+	}
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	n, _ := getDriverNode(t)
+	resp, err := n.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	return d
+	if _, iqn := co.ParseNodeId(resp.NodeId); iqn != FakeIqn {
+		t.Fatalf("NodeId did not contain initiator IQN: [%s] != [%s]", iqn, FakeIqn)
+	}
 }
 
 func TestNodeStageVolumeUnstageVolume(t *testing.T) {
-	c := getDriverController(t)
-	n := getDriverNode(t)
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	if n := len(h.Connects()); n != 1 {
+		t.Fatalf("Expected 1 iSCSI login, found %d", n)
+	}
+	if n := h.Ran("mkfs.ext4"); n != 1 {
+		t.Fatalf("Expected volume to be formatted once, found %d mkfs calls", n)
+	}
+	if dev := h.Mounted(staging); dev != h.MultipathDevice() {
+		t.Fatalf("Staging path not mounted: [%s] != [%s]", dev, h.MultipathDevice())
+	}
+	rec, err := d.journal.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.Step != stepStaged || rec.StagingPath != staging || rec.DevicePath != h.MultipathDevice() || rec.FsType != co.Ext4 {
+		t.Fatalf("Staging journal not updated after stage: %#v", rec)
+	}
+	cleanf()
+	if rec, err = d.journal.Get(id); err != nil || rec != nil {
+		t.Fatalf("Staging journal not removed after unstage: %#v, %v", rec, err)
+	}
+	if dev := h.Mounted(staging); dev != "" {
+		t.Fatalf("Staging path still mounted after unstage: %s", dev)
+	}
+	if n := len(h.Disconnects()); n != 1 {
+		t.Fatalf("Expected 1 iSCSI logout, found %d", n)
+	}
+	if paths := h.MultipathPaths(h.MultipathMap); paths != nil {
+		t.Fatalf("Multipath map not flushed after unstage, left with paths %v", paths)
+	}
+}
+
+func TestNodePublishVolumeUnpublishVolume(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	defer cleanf()
+	target := filepath.Join("/var/lib/kubelet/pods/fake-pod/volumes/kubernetes.io~csi", id, "mount")
+	if _, err := d.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if dev := h.Mounted(target); dev != h.MultipathDevice() {
+		t.Fatalf("Target path not bind-mounted: [%s] != [%s]", dev, h.MultipathDevice())
+	}
+	if _, err := d.NodeUnpublishVolume(getCtxt(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   id,
+		TargetPath: target,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if dev := h.Mounted(target); dev != "" {
+		t.Fatalf("Target path still mounted after unpublish: %s", dev)
+	}
+}
+
+func TestNodeNoArrayRequests(t *testing.T) {
+	d, h := getDriverNode(t)
+	// Started without a Datera config
+	d.noApi = true
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	vol, err := d.dc.GetVolume(id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vol.SetMetadata(&dc.VolMetadata{"fs_args": "-b 4096", "mount_options": "discard", "fsck_mode": dc.FsckModeCheck}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: mountCapability(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: info.NodeId})
+	staging := filepath.Join("/var/lib/kubelet/plugins/kubernetes.io/csi/pv", id, "globalmount")
+	target := filepath.Join("/var/lib/kubelet/pods/fake-pod/volumes/kubernetes.io~csi", id, "mount")
+	calls := srv.Calls("", ".*")
+	if _, err = d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		PublishContext:    pub.PublishContext,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if opts := h.MountOptions(staging); !reflect.DeepEqual(opts, []string{"discard"}) {
+		t.Errorf("Staging mount options from the PublishContext: %v", opts)
+	}
+	if _, err = d.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h.SetDeviceSize(h.MultipathDevice(), 10*units.GiB)
+	if _, err = d.NodeExpandVolume(getCtxt(), &csi.NodeExpandVolumeRequest{
+		VolumeId:   id,
+		VolumePath: staging,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.NodeUnpublishVolume(getCtxt(), &csi.NodeUnpublishVolumeRequest{VolumeId: id, TargetPath: target}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: staging}); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("", ".*") - calls; n != 0 {
+		t.Fatalf("Node operations made %d array requests", n)
+	}
+	// The parameters came with the PublishContext
+	for _, cmd := range []string{"mkfs.ext4 -b 4096", "e2fsck -n"} {
+		if h.Ran(cmd) != 1 {
+			t.Errorf("Expected %s once, got %v", cmd, h.Commands())
+		}
+	}
+}
+
+func TestNodeStageVolumeIdempotent(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	defer cleanf()
+	info, err := d.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: mountCapability(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := func(path string) error {
+		_, err := d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+			VolumeId:          id,
+			PublishContext:    pub.PublishContext,
+			StagingTargetPath: path,
+			VolumeCapability:  mountCapability(),
+		})
+		return err
+	}
+	calls := srv.Calls("", ".*")
+	if err = stage(staging); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Calls("", ".*") - calls; n != 0 {
+		t.Fatalf("Staging a staged volume made %d array requests", n)
+	}
+	if err = stage(staging + "-other"); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("Expected AlreadyExists staging at another path, got: %v", err)
+	}
+	// Crash after mounting, before the journal recorded it
+	rec, err := d.journal.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Step = stepLoggedIn
+	if err = d.journal.Put(rec); err != nil {
+		t.Fatal(err)
+	}
+	if err = stage(staging); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.Ran("mkfs.ext4"); n != 1 {
+		t.Fatalf("Expected volume to be formatted once, found %d mkfs calls", n)
+	}
+	if n := h.Ran("mount -t ext4"); n != 1 {
+		t.Fatalf("Expected volume to be mounted once, found %d mounts", n)
+	}
+	if rec, err = d.journal.Get(id); err != nil || rec.Step != stepStaged {
+		t.Fatalf("Resumed stage not recorded: %#v, %v", rec, err)
+	}
+}
+
+func TestNodeStageVolumeNotEmpty(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	info, err := d.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: mountCapability(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: info.NodeId})
+	h.SetDeviceData(h.MultipathDevice(), 512, []byte("EFI PART"))
+	staging := filepath.Join("/var/lib/kubelet/plugins/kubernetes.io/csi/pv", id, "globalmount")
+	_, err = d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		PublishContext:    pub.PublishContext,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability(),
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition staging a partitioned device, got: %v", err)
+	}
+	if n := h.Ran("mkfs"); n != 0 {
+		t.Fatalf("Partitioned device was formatted")
+	}
+	d.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: staging})
+}
+
+func TestNodeStageVolumeOtherFs(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	info, err := d.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: mountCapability(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: info.NodeId})
+	// Formatted with xfs before, ext4 is requested now
+	h.AddDevice(h.MultipathDevice(), 10*units.GiB, co.Xfs)
+	staging := filepath.Join("/var/lib/kubelet/plugins/kubernetes.io/csi/pv", id, "globalmount")
+	if _, err = d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		PublishContext:    pub.PublishContext,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapabilityFs(co.Ext4),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: staging})
+	if n := h.Ran("mkfs"); n != 0 {
+		t.Fatalf("Formatted volume was formatted again")
+	}
+	if n := h.Ran("mount -t xfs"); n != 1 {
+		t.Fatalf("Expected the volume to be mounted as xfs, found %d xfs mounts in %v", n, h.Commands())
+	}
+	if rec, err := d.journal.Get(id); err != nil || rec.FsType != co.Xfs {
+		t.Fatalf("Expected xfs to be recorded in the journal: %#v, %v", rec, err)
+	}
+}
+
+func TestNodeStageVolumeIscsiSettings(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolumeCap(t, d, mountCapability(), dc.VolMetadata{
+		"iscsi_port":          "3261",
+		"replacement_timeout": "5",
+	})
+	defer cleanf()
+	applied := func(n int) {
+		for _, ip := range fake.FakeIps {
+			update := fmt.Sprintf("iscsiadm -m node -T %s -p %s:3261 -o update -n node.session.timeo.replacement_timeout -v 5", h.Connects()[0].Targets[0].Iqn, ip)
+			if got := h.Ran(update); got != n {
+				t.Fatalf("Expected the settings to be applied to %s %d times, found %d", ip, n, got)
+			}
+		}
+	}
+	applied(1)
+	rec, err := d.journal.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.Port != 3261 {
+		t.Fatalf("Portal port not recorded in the staging journal: %#v", rec)
+	}
+	if _, err = d.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId: id,
+		PublishContext: map[string]string{
+			PubIqn:                rec.Iqn,
+			PubPortals:            strings.Join(rec.Portals, ","),
+			"iscsi_port":          "3261",
+			"replacement_timeout": "5",
+		},
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	applied(2)
+}
+
+func TestNodeStageVolumeFsck(t *testing.T) {
+	d, h := getDriverNode(t)
+	h.On("e2fsck -p", fh.Response{Err: &fh.ExitError{Cmd: "e2fsck", Code: 1}})
+	_, _, unstagef := stageVolumeCap(t, d, mountCapability(), dc.VolMetadata{"fsck_mode": dc.FsckModeRepair})
+	unstagef()
+	if n := h.Ran("e2fsck -p"); n != 1 {
+		t.Fatalf("Expected the filesystem to be checked once before mounting, found %d e2fsck calls", n)
+	}
+	if n := h.Ran("e2fsck -n"); n != 0 {
+		t.Fatalf("Read-only check run in repair mode")
+	}
+	// A check finding errors fails the stage and is recorded
+	d, h = getDriverNode(t)
+	h.On("e2fsck -n", fh.Response{Out: "Inode 12 has illegal blocks", Err: &fh.ExitError{Cmd: "e2fsck", Code: 4}})
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	vol, err := d.dc.GetVolume(id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vol.SetMetadata(&dc.VolMetadata{"fsck_mode": dc.FsckModeCheck}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := d.NodeGetInfo(getCtxt(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := d.ControllerPublishVolume(getCtxt(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           info.NodeId,
+		VolumeCapability: mountCapability(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.ControllerUnpublishVolume(getCtxt(), &csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: info.NodeId})
+	staging := filepath.Join("/var/lib/kubelet/plugins/kubernetes.io/csi/pv", id, "globalmount")
+	defer d.NodeUnstageVolume(getCtxt(), &csi.NodeUnstageVolumeRequest{VolumeId: id, StagingTargetPath: staging})
+	_, err = d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		PublishContext:    pub.PublishContext,
+		StagingTargetPath: staging,
+		VolumeCapability:  mountCapability(),
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition for a filesystem with errors, got: %v", err)
+	}
+	if dev := h.Mounted(staging); dev != "" {
+		t.Fatal("Filesystem with errors was mounted")
+	}
+	rec, err := d.journal.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.FsckResult != string(co.FsckErrors) || rec.FsckTime == "" {
+		t.Fatalf("Fsck result not recorded: %#v", rec)
+	}
+	md, err := vol.GetMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (*md)["fsck_result"] != rec.FsckResult || (*md)["fsck_time"] != rec.FsckTime {
+		t.Fatalf("Fsck result not recorded in the volume's metadata: %v", *md)
+	}
+}
+
+func TestNodeStageVolumeMountOptions(t *testing.T) {
+	d, h := getDriverNode(t)
+	d.env.MountOptions = []string{"nosuid", "nodev", "relatime"}
+	vc := mountCapability()
+	vc.GetMount().MountFlags = []string{"noatime", "data=ordered"}
+	_, staging, cleanf := stageVolumeCap(t, d, vc, dc.VolMetadata{"mount_options": "discard,data=writeback"})
+	defer cleanf()
+	expected := []string{"nosuid", "nodev", "noatime", "discard", "data=ordered"}
+	if opts := h.MountOptions(staging); !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("Staging mount options: %v != %v", opts, expected)
+	}
+}
+
+func TestNodeStageVolumeForbiddenMountOptions(t *testing.T) {
+	d, _ := getDriverNode(t)
+	id, _, cleanf := createVolume(t, d)
+	defer cleanf()
+	vc := mountCapability()
+	vc.GetMount().MountFlags = []string{"noatime,suid"}
+	_, err := d.NodeStageVolume(getCtxt(), &csi.NodeStageVolumeRequest{
+		VolumeId:          id,
+		PublishContext:    map[string]string{PubIqn: "iqn", PubPortals: "172.28.0.1"},
+		StagingTargetPath: "/var/lib/kubelet/plugins/kubernetes.io/csi/pv/forbidden/globalmount",
+		VolumeCapability:  vc,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument for a suid mount, got: %v", err)
+	}
+}
+
+func TestNodePublishVolumeReadonly(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	defer cleanf()
+	target := filepath.Join("/var/lib/kubelet/pods/fake-pod/volumes/kubernetes.io~csi", id, "mount")
+	if _, err := d.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+		Readonly:          true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.NodeUnpublishVolume(getCtxt(), &csi.NodeUnpublishVolumeRequest{VolumeId: id, TargetPath: target})
+	if n := h.Ran("mount -o remount,bind,ro " + target); n != 1 {
+		t.Fatalf("Expected target to be remounted read-only once, found %d remounts", n)
+	}
+	st, err := d.dc.PathStats(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.ReadOnly {
+		t.Fatal("Target path is not read-only")
+	}
+	if st, err = d.dc.PathStats(staging); err != nil || st.ReadOnly {
+		t.Fatalf("Staging path should stay writable: %v, %v", st, err)
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	defer cleanf()
+	size := int64(11 * units.GiB)
+	if _, err := d.ControllerExpandVolume(getCtxt(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      id,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h.SetDeviceSize(h.MultipathDevice(), size)
+	resp, err := d.NodeExpandVolume(getCtxt(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      id,
+		VolumePath:    staging,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.CapacityBytes != size {
+		t.Fatalf("Expected capacity %d, got %d", size, resp.CapacityBytes)
+	}
+	if n := h.Ran("resize2fs " + h.MultipathDevice()); n != 1 {
+		t.Fatalf("Expected filesystem to be grown once, found %d resize2fs calls", n)
+	}
+	// Without a CapacityRange the device's size is reported
+	if resp, err = d.NodeExpandVolume(getCtxt(), &csi.NodeExpandVolumeRequest{
+		VolumeId:   id,
+		VolumePath: staging,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if resp.CapacityBytes != size {
+		t.Fatalf("Expected capacity %d without a CapacityRange, got %d", size, resp.CapacityBytes)
+	}
+}
+
+func TestNodeStageExpandBtrfs(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolumeFs(t, d, co.Btrfs)
+	defer cleanf()
+	if n := h.Ran("mkfs.btrfs -f " + h.MultipathDevice()); n != 1 {
+		t.Fatalf("Expected volume to be formatted with btrfs once, found %d mkfs calls", n)
+	}
+	size := int64(11 * units.GiB)
+	if _, err := d.ControllerExpandVolume(getCtxt(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      id,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	h.SetDeviceSize(h.MultipathDevice(), size)
+	if _, err := d.NodeExpandVolume(getCtxt(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      id,
+		VolumePath:    staging,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := h.Ran("btrfs filesystem resize max " + staging); n != 1 {
+		t.Fatalf("Expected btrfs to be grown once, found %d resize calls", n)
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	defer cleanf()
+	h.SetStatfs(staging, unix.Statfs_t{Bsize: 4096, Blocks: 1000, Bfree: 400, Bavail: 300, Files: 100, Ffree: 60})
+	resp, err := d.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   id,
+		VolumePath: staging,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bytes, inodes *csi.VolumeUsage
+	for _, u := range resp.Usage {
+		switch u.Unit {
+		case csi.VolumeUsage_BYTES:
+			bytes = u
+		case csi.VolumeUsage_INODES:
+			inodes = u
+		}
+	}
+	if bytes == nil || bytes.Total != 1000*4096 || bytes.Available != 300*4096 || bytes.Used != 600*4096 {
+		t.Fatalf("Unexpected byte usage: %v", bytes)
+	}
+	if inodes == nil || inodes.Total != 100 || inodes.Available != 60 || inodes.Used != 40 {
+		t.Fatalf("Unexpected inode usage: %v", inodes)
+	}
+	if resp.VolumeCondition.Abnormal {
+		t.Fatalf("Expected a healthy volume, got %v", resp.VolumeCondition)
+	}
+	_, err = d.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   id,
+		VolumePath: "/var/lib/kubelet/pods/fake-pod/missing",
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for a missing path, got: %v", err)
+	}
+}
+
+func TestNodeGetVolumeStatsCondition(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	defer cleanf()
+	target := filepath.Join("/var/lib/kubelet/pods/fake-pod/volumes/kubernetes.io~csi", id, "mount")
+	if _, err := d.NodePublishVolume(getCtxt(), &csi.NodePublishVolumeRequest{
+		VolumeId:          id,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  mountCapability(),
+		Readonly:          true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer d.NodeUnpublishVolume(getCtxt(), &csi.NodeUnpublishVolumeRequest{VolumeId: id, TargetPath: target})
+	condition := func(path string) *csi.VolumeCondition {
+		resp, err := d.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   id,
+			VolumePath: path,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.VolumeCondition
+	}
+	// Published read-only on purpose
+	if c := condition(target); c.Abnormal {
+		t.Fatalf("Expected a volume published read-only to be normal, got %v", c)
+	}
+	// The filesystem went read-only after an error
+	if _, err := h.Run(getCtxt(), "mount", "-o", "remount,ro", staging); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{staging, target} {
+		if c := condition(path); !c.Abnormal {
+			t.Fatalf("Expected a read-only filesystem to be abnormal at %s, got %v", path, c)
+		}
+	}
+	empty := "/var/lib/kubelet/pods/fake-pod/volumes/kubernetes.io~csi/empty/mount"
+	if err := h.MkdirAll(empty, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if c := condition(empty); !c.Abnormal {
+		t.Fatalf("Expected nothing mounted to be abnormal, got %v", c)
+	}
+}
+
+func TestNodeGetVolumeStatsMultipath(t *testing.T) {
+	d, h := getDriverNode(t)
+	id, staging, cleanf := stageVolume(t, d)
+	paths := h.MultipathPaths(h.MultipathMap)
+	if len(paths) != len(fake.FakeIps) {
+		t.Fatalf("Expected a path per portal, got %v", paths)
+	}
+	h.FailPath(paths[0])
+	resp, err := d.NodeGetVolumeStats(getCtxt(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   id,
+		VolumePath: staging,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.VolumeCondition.Abnormal {
+		t.Errorf("Expected a degraded volume to be abnormal, got %v", resp.VolumeCondition)
+	}
+	body := scrapeMetrics(t)
+	for _, line := range []string{
+		fmt.Sprintf(`datera_csi_multipath_paths{state="active",volume_id="%s"} 1`, id),
+		fmt.Sprintf(`datera_csi_multipath_paths{state="failed",volume_id="%s"} 1`, id),
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Missing from /metrics: %s", line)
+		}
+	}
+	cleanf()
+	if body = scrapeMetrics(t); strings.Contains(body, id) {
+		t.Errorf("Multipath metrics left behind after unstage")
+	}
 }
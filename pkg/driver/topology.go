@@ -0,0 +1,220 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+	co "github.com/Datera/datera-csi/pkg/common"
+)
+
+const (
+	// Topology segment keys are namespaced by driver name, eg:
+	// topology.dsp.csi.daterainc.io/rack
+	topologyKeyPrefix = "topology."
+	topologyMdKey     = "topology"
+)
+
+func topologyKey(driverName, key string) string {
+	return fmt.Sprintf("%s%s/%s", topologyKeyPrefix, driverName, key)
+}
+
+// Parses segments of the form "key1=value1,key2=value2".  Keys are
+// namespaced with the driver name unless driverName is empty
+func parseSegments(driverName, s string) (map[string]string, error) {
+	segs := map[string]string{}
+	for _, seg := range strings.Split(s, ",") {
+		seg = strings.TrimSpace(seg)
+		if seg == "" {
+			continue
+		}
+		parts := strings.SplitN(seg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid topology segment '%s', must be of the form key=value", seg)
+		}
+		k := parts[0]
+		if driverName != "" {
+			k = topologyKey(driverName, k)
+		}
+		segs[k] = parts[1]
+	}
+	return segs, nil
+}
+
+func segmentsToString(segs map[string]string) string {
+	keys := []string{}
+	for k := range segs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := []string{}
+	for _, k := range keys {
+		result = append(result, strings.Join([]string{k, segs[k]}, "="))
+	}
+	return strings.Join(result, ",")
+}
+
+// Parses a segment to resource mapping of the form
+// "rack=rack1:pool-a,rack=rack2:pool-b".  The returned map is keyed by the
+// namespaced "key=value" segment string
+func parseTopologyMap(driverName, s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		idx := strings.LastIndex(entry, ":")
+		if idx < 1 || idx == len(entry)-1 {
+			return nil, fmt.Errorf("Invalid topology mapping '%s', must be of the form key=value:name", entry)
+		}
+		segs, err := parseSegments(driverName, entry[:idx])
+		if err != nil {
+			return nil, err
+		}
+		m[segmentsToString(segs)] = entry[idx+1:]
+	}
+	return m, nil
+}
+
+// Looks up the first segment in topo with an entry in m, returning the
+// matching segment and the mapped name
+func lookupSegment(topo *csi.Topology, m map[string]string) (string, string, string, bool) {
+	keys := []string{}
+	for k := range topo.GetSegments() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := topo.Segments[k]
+		if name, ok := m[segmentsToString(map[string]string{k: v})]; ok {
+			return k, v, name, true
+		}
+	}
+	return "", "", "", false
+}
+
+// Returns the segments m maps to name, in the same order every time
+func mappedSegments(m map[string]string, name string) []map[string]string {
+	keys := []string{}
+	for k, v := range m {
+		if v == name {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	result := []map[string]string{}
+	for _, k := range keys {
+		if segs, err := parseSegments("", k); err == nil {
+			result = append(result, segs)
+		}
+	}
+	return result
+}
+
+// Combines the segments an ip_pool and a placement_policy are accessible
+// from into topologies.  No segments for one of them means it doesn't
+// restrict where the volume is accessible from
+func combineSegments(pools, policies []map[string]string) []*csi.Topology {
+	if len(pools) == 0 && len(policies) == 0 {
+		return nil
+	}
+	if len(pools) == 0 {
+		pools = []map[string]string{{}}
+	}
+	if len(policies) == 0 {
+		policies = []map[string]string{{}}
+	}
+	result := []*csi.Topology{}
+	for _, pool := range pools {
+		for _, policy := range policies {
+			segs := map[string]string{}
+			for k, v := range pool {
+				segs[k] = v
+			}
+			for k, v := range policy {
+				segs[k] = v
+			}
+			result = append(result, &csi.Topology{Segments: segs})
+		}
+	}
+	return result
+}
+
+// Maps requisite and preferred topologies to a Datera ip_pool and/or
+// placement_policy.  Preferred topologies are tried first, in order, then
+// requisite ones.  An explicitly provided StorageClass ip_pool or
+// placement_policy always wins, the volume is then accessible from the
+// segments mapped to it, or from everywhere if none are.  Returns the
+// topologies the volume will be accessible from, nil meaning it is
+// accessible from everywhere.
+func (d *Driver) handleTopologyRequirement(ctxt context.Context, tr *csi.TopologyRequirement, vo *dc.VolOpts, params map[string]string) ([]*csi.Topology, error) {
+	if tr == nil || (len(tr.Requisite) == 0 && len(tr.Preferred) == 0) {
+		return nil, nil
+	}
+	if len(d.env.TopologyIpPools) == 0 && len(d.env.TopologyPlacementPolicies) == 0 {
+		co.Debugf(ctxt, "No topology mappings configured, volume will be accessible from all segments")
+		return nil, nil
+	}
+	_, explicitPool := params["ip_pool"]
+	_, explicitPolicy := params["placement_policy"]
+	candidates := append(append([]*csi.Topology{}, tr.Preferred...), tr.Requisite...)
+	for _, topo := range candidates {
+		pk, pv, pool, pok := lookupSegment(topo, d.env.TopologyIpPools)
+		ppk, ppv, policy, ppok := lookupSegment(topo, d.env.TopologyPlacementPolicies)
+		if !pok && !ppok {
+			continue
+		}
+		var pools, policies []map[string]string
+		if explicitPool {
+			pools = mappedSegments(d.env.TopologyIpPools, vo.IpPool)
+			co.Debugf(ctxt, "Keeping explicit ip_pool %s over topology ip_pool %s, accessible from %v", vo.IpPool, pool, pools)
+		} else if pok {
+			co.Debugf(ctxt, "Using ip_pool %s for topology %s=%s", pool, pk, pv)
+			vo.IpPool = pool
+			pools = []map[string]string{{pk: pv}}
+		}
+		if explicitPolicy {
+			policies = mappedSegments(d.env.TopologyPlacementPolicies, vo.PlacementPolicy)
+			co.Debugf(ctxt, "Keeping explicit placement_policy %s over topology placement_policy %s, accessible from %v", vo.PlacementPolicy, policy, policies)
+		} else if ppok {
+			co.Debugf(ctxt, "Using placement_policy %s for topology %s=%s", policy, ppk, ppv)
+			vo.PlacementPolicy = policy
+			policies = []map[string]string{{ppk: ppv}}
+		}
+		return combineSegments(pools, policies), nil
+	}
+	return nil, fmt.Errorf("No ip_pool or placement_policy is mapped to any of the requested topologies: %s", candidates)
+}
+
+// Records the accessible topologies in volume metadata, separated by ';'
+func topologyToMetadata(topo []*csi.Topology) string {
+	result := []string{}
+	for _, t := range topo {
+		result = append(result, segmentsToString(t.Segments))
+	}
+	return strings.Join(result, ";")
+}
+
+// Reads back the accessible topologies recorded in volume metadata
+func topologyFromMetadata(md *dc.VolMetadata) []*csi.Topology {
+	if md == nil || (*md)[topologyMdKey] == "" {
+		return nil
+	}
+	result := []*csi.Topology{}
+	for _, s := range strings.Split((*md)[topologyMdKey], ";") {
+		segs, err := parseSegments("", s)
+		if err != nil || len(segs) == 0 {
+			continue
+		}
+		result = append(result, &csi.Topology{Segments: segs})
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
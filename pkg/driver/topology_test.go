@@ -0,0 +1,258 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+
+	dc "github.com/Datera/datera-csi/pkg/client"
+)
+
+const testDriverName = "dsp.csi.daterainc.io"
+
+func TestParseSegments(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		driver string
+		in     string
+		want   map[string]string
+		err    bool
+	}{
+		{"empty", testDriverName, "", map[string]string{}, false},
+		{"namespaced", testDriverName, "rack=rack1, zone=a", map[string]string{
+			"topology.dsp.csi.daterainc.io/rack": "rack1",
+			"topology.dsp.csi.daterainc.io/zone": "a",
+		}, false},
+		{"raw", "", "topology.x/rack=rack1", map[string]string{"topology.x/rack": "rack1"}, false},
+		{"value with =", "", "rack=a=b", map[string]string{"rack": "a=b"}, false},
+		{"trailing comma", "", "rack=rack1,", map[string]string{"rack": "rack1"}, false},
+		{"no value", testDriverName, "rack=", nil, true},
+		{"no key", testDriverName, "=rack1", nil, true},
+		{"no =", testDriverName, "rack1", nil, true},
+	} {
+		got, err := parseSegments(tc.driver, tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTopologyMap(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want map[string]string
+		err  bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"two racks", "rack=rack1:pool-a, rack=rack2:pool-b", map[string]string{
+			"topology.dsp.csi.daterainc.io/rack=rack1": "pool-a",
+			"topology.dsp.csi.daterainc.io/rack=rack2": "pool-b",
+		}, false},
+		{"colon in value", "zone=a:b:pool-c", map[string]string{
+			"topology.dsp.csi.daterainc.io/zone=a:b": "pool-c",
+		}, false},
+		{"no name", "rack=rack1:", nil, true},
+		{"no segment", ":pool-a", nil, true},
+		{"no colon", "rack=rack1", nil, true},
+		{"bad segment", "rack:pool-a", nil, true},
+	} {
+		got, err := parseTopologyMap(testDriverName, tc.in)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLookupSegment(t *testing.T) {
+	m, err := parseTopologyMap(testDriverName, "rack=rack1:pool-a,zone=z2:pool-z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rack, zone := topologyKey(testDriverName, "rack"), topologyKey(testDriverName, "zone")
+	for _, tc := range []struct {
+		name  string
+		segs  map[string]string
+		key   string
+		value string
+		pool  string
+		ok    bool
+	}{
+		{"match", map[string]string{rack: "rack1"}, rack, "rack1", "pool-a", true},
+		{"other value", map[string]string{rack: "rack2"}, "", "", "", false},
+		{"unmapped key", map[string]string{"other": "rack1"}, "", "", "", false},
+		{"nil", nil, "", "", "", false},
+		// Keys are tried in sorted order
+		{"first key wins", map[string]string{zone: "z2", rack: "rack1"}, rack, "rack1", "pool-a", true},
+		{"second key", map[string]string{zone: "z2", rack: "rack9"}, zone, "z2", "pool-z", true},
+	} {
+		k, v, pool, ok := lookupSegment(&csi.Topology{Segments: tc.segs}, m)
+		if k != tc.key || v != tc.value || pool != tc.pool || ok != tc.ok {
+			t.Errorf("%s: got (%s, %s, %s, %t), want (%s, %s, %s, %t)", tc.name, k, v, pool, ok, tc.key, tc.value, tc.pool, tc.ok)
+		}
+	}
+}
+
+func TestHandleTopologyRequirement(t *testing.T) {
+	pools, err := parseTopologyMap(testDriverName, "rack=rack1:pool-a,rack=rack2:pool-b,rack=rack3:pool-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := parseTopologyMap(testDriverName, "zone=z1:flash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rack, zone := topologyKey(testDriverName, "rack"), topologyKey(testDriverName, "zone")
+	topo := func(segs ...map[string]string) []*csi.Topology {
+		result := []*csi.Topology{}
+		for _, s := range segs {
+			result = append(result, &csi.Topology{Segments: s})
+		}
+		return result
+	}
+	for _, tc := range []struct {
+		name       string
+		pools      map[string]string
+		policies   map[string]string
+		tr         *csi.TopologyRequirement
+		params     map[string]string
+		wantPool   string
+		wantPolicy string
+		want       []*csi.Topology
+		err        bool
+	}{
+		{
+			name:       "no requirement",
+			pools:      pools,
+			wantPool:   "default",
+			wantPolicy: "default",
+		},
+		{
+			name:       "no mappings",
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack1"})},
+			wantPool:   "default",
+			wantPolicy: "default",
+		},
+		{
+			name:       "requisite",
+			pools:      pools,
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack1"})},
+			wantPool:   "pool-a",
+			wantPolicy: "default",
+			want:       topo(map[string]string{rack: "rack1"}),
+		},
+		{
+			name:  "preferred first",
+			pools: pools,
+			tr: &csi.TopologyRequirement{
+				Requisite: topo(map[string]string{rack: "rack1"}, map[string]string{rack: "rack2"}),
+				Preferred: topo(map[string]string{rack: "rack2"}),
+			},
+			wantPool:   "pool-b",
+			wantPolicy: "default",
+			want:       topo(map[string]string{rack: "rack2"}),
+		},
+		{
+			name:       "unmapped segments are skipped",
+			pools:      pools,
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack9"}, map[string]string{rack: "rack1"})},
+			wantPool:   "pool-a",
+			wantPolicy: "default",
+			want:       topo(map[string]string{rack: "rack1"}),
+		},
+		{
+			name:       "pool and policy",
+			pools:      pools,
+			policies:   policies,
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack1", zone: "z1"})},
+			wantPool:   "pool-a",
+			wantPolicy: "flash",
+			want:       topo(map[string]string{rack: "rack1", zone: "z1"}),
+		},
+		{
+			name:       "nothing mapped",
+			pools:      pools,
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack9"})},
+			wantPool:   "default",
+			wantPolicy: "default",
+			err:        true,
+		},
+		{
+			// The volume is where the explicit pool is, not where it was
+			// asked to be
+			name:       "explicit ip_pool",
+			pools:      pools,
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack1"})},
+			params:     map[string]string{"ip_pool": "pool-b"},
+			wantPool:   "pool-b",
+			wantPolicy: "default",
+			want:       topo(map[string]string{rack: "rack2"}, map[string]string{rack: "rack3"}),
+		},
+		{
+			name:       "explicit unmapped ip_pool",
+			pools:      pools,
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack1"})},
+			params:     map[string]string{"ip_pool": "pool-x"},
+			wantPool:   "pool-x",
+			wantPolicy: "default",
+		},
+		{
+			name:       "explicit placement_policy",
+			pools:      pools,
+			policies:   policies,
+			tr:         &csi.TopologyRequirement{Requisite: topo(map[string]string{rack: "rack1", zone: "z1"})},
+			params:     map[string]string{"placement_policy": "hybrid"},
+			wantPool:   "pool-a",
+			wantPolicy: "hybrid",
+			want:       topo(map[string]string{rack: "rack1"}),
+		},
+	} {
+		d := &Driver{env: &EnvVars{TopologyIpPools: tc.pools, TopologyPlacementPolicies: tc.policies}}
+		vo := &dc.VolOpts{IpPool: "default", PlacementPolicy: "default"}
+		if p, ok := tc.params["ip_pool"]; ok {
+			vo.IpPool = p
+		}
+		if p, ok := tc.params["placement_policy"]; ok {
+			vo.PlacementPolicy = p
+		}
+		got, err := d.handleTopologyRequirement(getCtxt(), tc.tr, vo, tc.params)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if vo.IpPool != tc.wantPool || vo.PlacementPolicy != tc.wantPolicy {
+			t.Errorf("%s: got ip_pool %s and placement_policy %s, want %s and %s", tc.name, vo.IpPool, vo.PlacementPolicy, tc.wantPool, tc.wantPolicy)
+		}
+		if !tc.err && topologyToMetadata(got) != topologyToMetadata(tc.want) {
+			t.Errorf("%s: got topology %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTopologyMetadata(t *testing.T) {
+	topo := []*csi.Topology{
+		{Segments: map[string]string{"rack": "rack2", "zone": "z1"}},
+		{Segments: map[string]string{"rack": "rack3"}},
+	}
+	md := dc.VolMetadata{topologyMdKey: topologyToMetadata(topo)}
+	if got := topologyFromMetadata(&md); !reflect.DeepEqual(got, topo) {
+		t.Fatalf("Got %v, want %v", got, topo)
+	}
+	// Volumes created before several topologies were recorded
+	md = dc.VolMetadata{topologyMdKey: "rack=rack1"}
+	if got := topologyFromMetadata(&md); len(got) != 1 || got[0].Segments["rack"] != "rack1" {
+		t.Fatalf("Got %v, want rack=rack1", got)
+	}
+	if got := topologyFromMetadata(&dc.VolMetadata{}); got != nil {
+		t.Fatalf("Got %v for no topology", got)
+	}
+}
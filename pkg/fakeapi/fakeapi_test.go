@@ -0,0 +1,149 @@
+package fakeapi
+
+import (
+	"net/http"
+	"testing"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+func getSDK(t *testing.T, s *Server) *dsdk.SDK {
+	sdk, err := dsdk.NewSDKWithHTTPClient(s.UDC(), true, s.HTTPClient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sdk
+}
+
+func createAi(t *testing.T, sdk *dsdk.SDK, name string) *dsdk.AppInstance {
+	ai, apierr, err := sdk.AppInstances.Create(&dsdk.AppInstancesCreateRequest{
+		Ctxt: sdk.NewContext(),
+		Name: name,
+		StorageInstances: []*dsdk.StorageInstance{{
+			Name:    "storage-1",
+			Volumes: []*dsdk.Volume{{Name: "volume-1", Size: 5, ReplicaCount: 1}},
+		}},
+	})
+	if err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	return ai
+}
+
+func TestAppInstanceRoundTrip(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	sdk := getSDK(t, s)
+	ai := createAi(t, sdk, "fake-ai")
+	if ai.Name != "fake-ai" || ai.Id == "" {
+		t.Fatalf("Unexpected AppInstance created: %#v", ai)
+	}
+	si := ai.StorageInstances[0]
+	if si.Access == nil || si.Access.Iqn == "" || len(si.Access.Ips) != len(FakeIps) {
+		t.Fatalf("Storage instance has no target: %#v", si.Access)
+	}
+	if v := si.Volumes[0]; v.Size != 5 || v.ReplicaCount != 1 {
+		t.Fatalf("Volume not created as requested: %#v", v)
+	}
+
+	got, apierr, err := sdk.AppInstances.Get(&dsdk.AppInstancesGetRequest{Ctxt: sdk.NewContext(), Id: ai.Id})
+	if err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	if got.Name != ai.Name || got.Path != ai.Path {
+		t.Fatalf("Got %s at %s, want %s at %s", got.Name, got.Path, ai.Name, ai.Path)
+	}
+	createAi(t, sdk, "fake-ai-2")
+	ais, apierr, err := sdk.AppInstances.List(&dsdk.AppInstancesListRequest{Ctxt: sdk.NewContext()})
+	if err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	if len(ais) != 2 || ais[0].Name != "fake-ai" || ais[1].Name != "fake-ai-2" {
+		t.Fatalf("Expected both AppInstances in creation order, got %d", len(ais))
+	}
+
+	if _, apierr, err = ai.SetMetadata(&dsdk.AppInstanceMetadataSetRequest{
+		Ctxt:     sdk.NewContext(),
+		Metadata: map[string]string{"fs_type": "xfs"},
+	}); err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	md, apierr, err := ai.GetMetadata(&dsdk.AppInstanceMetadataGetRequest{Ctxt: sdk.NewContext()})
+	if err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	if (*md)["fs_type"] != "xfs" {
+		t.Fatalf("Metadata not stored: %v", *md)
+	}
+
+	// Online AppInstances can't be deleted
+	if _, apierr, _ = ai.Delete(&dsdk.AppInstanceDeleteRequest{Ctxt: sdk.NewContext()}); apierr == nil {
+		t.Fatal("Expected deleting an online AppInstance to fail")
+	}
+	if _, apierr, err = ai.Set(&dsdk.AppInstanceSetRequest{Ctxt: sdk.NewContext(), AdminState: "offline"}); err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	if cp := s.AppInstance("fake-ai"); cp.AdminState != "offline" || cp.StorageInstances[0].AdminState != "offline" {
+		t.Fatalf("AppInstance not offlined: %s", cp.AdminState)
+	}
+	if _, apierr, err = ai.Delete(&dsdk.AppInstanceDeleteRequest{Ctxt: sdk.NewContext()}); err != nil || apierr != nil {
+		t.Fatal(err, apierr)
+	}
+	if s.AppInstance("fake-ai") != nil {
+		t.Fatal("AppInstance still exists after delete")
+	}
+	if _, apierr, _ = sdk.AppInstances.Get(&dsdk.AppInstancesGetRequest{Ctxt: sdk.NewContext(), Id: ai.Id}); apierr == nil || apierr.Http != http.StatusNotFound {
+		t.Fatalf("Expected a deleted AppInstance to be not found, got %#v", apierr)
+	}
+}
+
+func TestAppInstanceCopy(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	createAi(t, getSDK(t, s), "fake-ai")
+	s.AppInstance("fake-ai").AdminState = "offline"
+	if s.AppInstance("fake-ai").AdminState == "offline" {
+		t.Fatal("Changing the returned AppInstance changed the server")
+	}
+	if s.AppInstance("does-not-exist") != nil {
+		t.Fatal("Expected nil for an unknown AppInstance")
+	}
+}
+
+func TestInjectFault(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	sdk := getSDK(t, s)
+	s.InjectFault(http.MethodGet, "^/app_instances$", 2, &dsdk.ApiErrorResponse{Name: "InternalError", Message: "injected"})
+	list := func() *dsdk.ApiErrorResponse {
+		_, apierr, _ := sdk.AppInstances.List(&dsdk.AppInstancesListRequest{Ctxt: sdk.NewContext()})
+		return apierr
+	}
+	if apierr := list(); apierr != nil {
+		t.Fatalf("First call failed: %#v", apierr)
+	}
+	apierr := list()
+	if apierr == nil || apierr.Name != "InternalError" || apierr.Http != http.StatusInternalServerError {
+		t.Fatalf("Expected the second call to fail with the injected error, got %#v", apierr)
+	}
+	if apierr := list(); apierr != nil {
+		t.Fatalf("Fault was injected more than once: %#v", apierr)
+	}
+	// Other methods and paths aren't affected
+	createAi(t, sdk, "fake-ai")
+	if n := s.Calls(http.MethodGet, "^/app_instances$"); n != 3 {
+		t.Fatalf("Expected 3 listings, found %d", n)
+	}
+	if n := s.Calls("", "^/app_instances"); n != 4 {
+		t.Fatalf("Expected 4 AppInstance calls, found %d", n)
+	}
+}
+
+func TestUnknownPath(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	sdk := getSDK(t, s)
+	if _, apierr, _ := sdk.AppInstances.Get(&dsdk.AppInstancesGetRequest{Ctxt: sdk.NewContext(), Id: "does-not-exist"}); apierr == nil || apierr.Http != http.StatusNotFound {
+		t.Fatalf("Expected not found, got %#v", apierr)
+	}
+}
@@ -0,0 +1,466 @@
+package fakeapi
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+)
+
+var (
+	FakeIps = []string{"172.28.0.1", "172.28.0.2"}
+)
+
+func (s *Server) appInstances(r *http.Request, parts []string, body map[string]interface{}) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) == 0 || parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list := []interface{}{}
+			for _, id := range s.aiOrder {
+				list = append(list, s.ais[id])
+			}
+			return list, nil
+		case http.MethodPost:
+			return s.createAi(body)
+		}
+		return nil, notFound(r.URL.Path)
+	}
+	ai := s.findAi(parts[0])
+	if ai == nil {
+		return nil, notFound(r.URL.Path)
+	}
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			return ai, nil
+		case http.MethodPut:
+			req := &dsdk.AppInstanceSetRequest{}
+			decode(body, req)
+			if req.AdminState != "" {
+				ai.AdminState = req.AdminState
+				for _, si := range ai.StorageInstances {
+					si.AdminState = req.AdminState
+				}
+			}
+			if req.Descr != "" {
+				ai.Descr = req.Descr
+			}
+			return ai, nil
+		case http.MethodDelete:
+			if ai.AdminState != "offline" {
+				return nil, invalid("AppInstance %s must be offline before it can be deleted", ai.Name)
+			}
+			delete(s.ais, ai.Id)
+			delete(s.metadata, ai.Id)
+			for i, id := range s.aiOrder {
+				if id == ai.Id {
+					s.aiOrder = append(s.aiOrder[:i], s.aiOrder[i+1:]...)
+					break
+				}
+			}
+			return ai, nil
+		}
+		return nil, notFound(r.URL.Path)
+	}
+	switch {
+	case parts[1] == "metadata" && len(parts) == 2:
+		md := s.metadata[ai.Id]
+		if r.Method == http.MethodPut {
+			for k, v := range body {
+				md[k] = fmt.Sprintf("%v", v)
+			}
+		}
+		result := map[string]interface{}{}
+		for k, v := range md {
+			result[k] = v
+		}
+		return result, nil
+	case parts[1] == "storage_instances" && len(parts) >= 3:
+		for _, si := range ai.StorageInstances {
+			if si.Name == parts[2] {
+				return s.storageInstance(r, si, parts[3:], body)
+			}
+		}
+	}
+	return nil, notFound(r.URL.Path)
+}
+
+func (s *Server) createAi(body map[string]interface{}) (interface{}, *dsdk.ApiErrorResponse) {
+	req := &dsdk.AppInstancesCreateRequest{}
+	decode(body, req)
+	if req.Name == "" {
+		return nil, invalid("AppInstance name is required")
+	}
+	if s.findAi(req.Name) != nil {
+		return nil, conflict("AppInstance %s already exists", req.Name)
+	}
+	id := s.nextId()
+	ai := &dsdk.AppInstance{
+		Id:          id,
+		Uuid:        id,
+		Name:        req.Name,
+		Path:        "/app_instances/" + id,
+		AdminState:  "online",
+		CreateMode:  req.CreateMode,
+		Descr:       req.Descr,
+		Health:      "ok",
+		OpState:     "available",
+		AppTemplate: &dsdk.AppInstanceAppTemplate{},
+	}
+	si := &dsdk.StorageInstance{Name: "storage-1"}
+	vol := &dsdk.Volume{Name: "volume-1", ReplicaCount: 3, PlacementMode: "hybrid"}
+	switch {
+	case req.CloneVolumeSrc != nil:
+		src := s.findVolume(req.CloneVolumeSrc.Path)
+		if src == nil {
+			return nil, notFound(req.CloneVolumeSrc.Path)
+		}
+		vol.Size, vol.ReplicaCount, vol.PlacementMode = src.Size, src.ReplicaCount, src.PlacementMode
+	case req.CloneSnapshotSrc != nil:
+		src, snap := s.findSnapshot(req.CloneSnapshotSrc.Path)
+		if snap == nil {
+			return nil, notFound(req.CloneSnapshotSrc.Path)
+		}
+		vol.Size, vol.ReplicaCount, vol.PlacementMode = src.Size, src.ReplicaCount, src.PlacementMode
+	case req.AppTemplate != nil:
+		ai.AppTemplate = req.AppTemplate
+		vol.Size = 1
+		if sz, ok := templateOverrideSize(req.TemplateOverride); ok {
+			vol.Size = sz
+		}
+	case len(req.StorageInstances) > 0 && len(req.StorageInstances[0].Volumes) > 0:
+		rsi, rvol := req.StorageInstances[0], req.StorageInstances[0].Volumes[0]
+		if rsi.Name != "" {
+			si.Name = rsi.Name
+		}
+		if rvol.Name != "" {
+			vol.Name = rvol.Name
+		}
+		if rvol.Size <= 0 {
+			return nil, invalid("Volume size must be greater than 0")
+		}
+		vol.Size = rvol.Size
+		if rvol.ReplicaCount != 0 {
+			vol.ReplicaCount = rvol.ReplicaCount
+		}
+		if rvol.PlacementMode != "" {
+			vol.PlacementMode = rvol.PlacementMode
+		}
+		vol.PlacementPolicy = rvol.PlacementPolicy
+		if rvol.PerformancePolicy != nil {
+			vol.PerformancePolicy = rvol.PerformancePolicy
+		}
+		if rsi.IpPool != nil {
+			name := strings.TrimPrefix(rsi.IpPool.Path, "/access_network_ip_pools/")
+			ipp, ok := s.ipPools[name]
+			if !ok {
+				return nil, notFound(rsi.IpPool.Path)
+			}
+			si.IpPool = ipp
+		}
+		si.Auth = rsi.Auth
+	default:
+		return nil, invalid("One of storage_instances, app_template, clone_volume_src or clone_snapshot_src is required")
+	}
+	si.Path = ai.Path + "/storage_instances/" + si.Name
+	si.Uuid = s.nextId()
+	si.AdminState = ai.AdminState
+	si.OpState = "available"
+	si.Health = "ok"
+	si.Access = &dsdk.Access{
+		Path: si.Path + "/access",
+		Iqn:  fmt.Sprintf("iqn.2013-05.com.daterainc:tc:01:sn:%s", strings.Replace(si.Uuid[:18], "-", "", -1)),
+		Ips:  append([]string{}, FakeIps...),
+	}
+	si.AclPolicy = &dsdk.AclPolicy{Path: si.Path + "/acl_policy"}
+	if si.IpPool == nil {
+		si.IpPool = s.ipPools["default"]
+	}
+	vol.Path = si.Path + "/volumes/" + vol.Name
+	vol.Uuid = s.nextId()
+	vol.OpState = "available"
+	vol.Health = "ok"
+	if vol.PerformancePolicy == nil {
+		vol.PerformancePolicy = &dsdk.PerformancePolicy{}
+	}
+	vol.PerformancePolicy.Path = vol.Path + "/performance_policy"
+	si.Volumes = []*dsdk.Volume{vol}
+	ai.StorageInstances = []*dsdk.StorageInstance{si}
+	s.ais[id] = ai
+	s.aiOrder = append(s.aiOrder, id)
+	s.metadata[id] = map[string]string{}
+	return ai, nil
+}
+
+func templateOverrideSize(to map[string]interface{}) (int, bool) {
+	cur := interface{}(to)
+	for _, k := range []string{"storage_instances", "storage-1", "volumes", "volume-1", "size"} {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		cur = m[k]
+	}
+	switch v := cur.(type) {
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	case float64:
+		return int(v), true
+	}
+	return 0, false
+}
+
+func (s *Server) storageInstance(r *http.Request, si *dsdk.StorageInstance, parts []string, body map[string]interface{}) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			return si, nil
+		case http.MethodPut:
+			req := &dsdk.StorageInstance{}
+			decode(body, req)
+			if req.IpPool != nil {
+				name := strings.TrimPrefix(req.IpPool.Path, "/access_network_ip_pools/")
+				ipp, ok := s.ipPools[name]
+				if !ok {
+					return nil, notFound(req.IpPool.Path)
+				}
+				si.IpPool = ipp
+			}
+			return si, nil
+		}
+		return nil, notFound(r.URL.Path)
+	}
+	switch {
+	case parts[0] == "acl_policy" && len(parts) == 1:
+		if r.Method == http.MethodPut {
+			req := &dsdk.AclPolicySetRequest{}
+			decode(body, req)
+			inits := []*dsdk.Initiator{}
+			for _, ri := range req.Initiators {
+				if ri.Tenant != "" {
+					return nil, invalid("Only the path of an initiator can be given")
+				}
+				init, ok := s.initiators[strings.TrimPrefix(ri.Path, "/initiators/")]
+				if !ok {
+					return nil, notFound(ri.Path)
+				}
+				inits = append(inits, &dsdk.Initiator{Path: init.Path, Id: init.Id, Name: init.Name, Tenant: s.InitiatorTenant})
+			}
+			si.AclPolicy.Initiators = inits
+		}
+		return si.AclPolicy, nil
+	case parts[0] == "volumes" && len(parts) >= 2:
+		for _, vol := range si.Volumes {
+			if vol.Name == parts[1] {
+				return s.volume(r, vol, parts[2:], body)
+			}
+		}
+	}
+	return nil, notFound(r.URL.Path)
+}
+
+func (s *Server) volume(r *http.Request, vol *dsdk.Volume, parts []string, body map[string]interface{}) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			return vol, nil
+		case http.MethodPut:
+			req := &dsdk.VolumeSetRequest{}
+			decode(body, req)
+			if req.Size != 0 {
+				if req.Size < vol.Size {
+					return nil, invalid("Volume size cannot be decreased from %d to %d", vol.Size, req.Size)
+				}
+				vol.Size = req.Size
+			}
+			if req.ReplicaCount != 0 {
+				vol.ReplicaCount = req.ReplicaCount
+			}
+			if req.PlacementMode != "" {
+				vol.PlacementMode = req.PlacementMode
+			}
+			return vol, nil
+		}
+		return nil, notFound(r.URL.Path)
+	}
+	switch {
+	case parts[0] == "performance_policy" && len(parts) == 1:
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			pp := &dsdk.PerformancePolicy{}
+			decode(body, pp)
+			pp.Path = vol.PerformancePolicy.Path
+			vol.PerformancePolicy = pp
+		}
+		return vol.PerformancePolicy, nil
+	case parts[0] == "snapshots" && len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			list := []interface{}{}
+			for _, snap := range vol.Snapshots {
+				s.advanceSnapshot(snap)
+				list = append(list, snap)
+			}
+			return list, nil
+		case http.MethodPost:
+			return s.createSnapshot(vol, body)
+		}
+	case parts[0] == "snapshots" && len(parts) == 2:
+		for i, snap := range vol.Snapshots {
+			if snap.UtcTs != parts[1] {
+				continue
+			}
+			switch r.Method {
+			case http.MethodGet:
+				s.advanceSnapshot(snap)
+				return snap, nil
+			case http.MethodDelete:
+				vol.Snapshots = append(vol.Snapshots[:i], vol.Snapshots[i+1:]...)
+				delete(s.snapPending, snap.Path)
+				return snap, nil
+			}
+		}
+	}
+	return nil, notFound(r.URL.Path)
+}
+
+func (s *Server) createSnapshot(vol *dsdk.Volume, body map[string]interface{}) (interface{}, *dsdk.ApiErrorResponse) {
+	req := &dsdk.SnapshotsCreateRequest{}
+	decode(body, req)
+	if req.Uuid != "" {
+		for _, snap := range vol.Snapshots {
+			if snap.Uuid == req.Uuid {
+				apierr := invalid("Snapshot with uuid %s already exists", req.Uuid)
+				apierr.Code = 15
+				return nil, apierr
+			}
+		}
+	} else {
+		req.Uuid = s.nextId()
+	}
+	// Timestamps must be unique per volume, so never hand out the same one twice
+	now := time.Now().UnixNano()
+	if now <= s.lastTs {
+		now = s.lastTs + 1
+	}
+	s.lastTs = now
+	ts := fmt.Sprintf("%d.%09d", now/int64(time.Second), now%int64(time.Second))
+	snap := &dsdk.Snapshot{
+		Path:      vol.Path + "/snapshots/" + ts,
+		Timestamp: ts,
+		UtcTs:     ts,
+		Uuid:      req.Uuid,
+		OpState:   "available",
+		Local:     req.RemoteProviderUuid == "",
+	}
+	if s.SnapshotAvailableAfter > 0 {
+		snap.OpState = "creating"
+		s.snapPending[snap.Path] = s.SnapshotAvailableAfter
+	}
+	vol.Snapshots = append(vol.Snapshots, snap)
+	return snap, nil
+}
+
+func (s *Server) allSnapshots() []interface{} {
+	list := []interface{}{}
+	for _, id := range s.aiOrder {
+		for _, si := range s.ais[id].StorageInstances {
+			for _, vol := range si.Volumes {
+				for _, snap := range vol.Snapshots {
+					s.advanceSnapshot(snap)
+					list = append(list, snap)
+				}
+			}
+		}
+	}
+	return list
+}
+
+// advanceSnapshot counts a GET against a pending snapshot, making it available
+// once SnapshotAvailableAfter GETs have been seen
+func (s *Server) advanceSnapshot(snap *dsdk.Snapshot) {
+	n, ok := s.snapPending[snap.Path]
+	if !ok {
+		return
+	}
+	if n <= 1 {
+		delete(s.snapPending, snap.Path)
+		snap.OpState = "available"
+	} else {
+		s.snapPending[snap.Path] = n - 1
+	}
+}
+
+func (s *Server) findVolume(path string) *dsdk.Volume {
+	for _, ai := range s.ais {
+		for _, si := range ai.StorageInstances {
+			for _, vol := range si.Volumes {
+				if vol.Path == path {
+					return vol
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) findSnapshot(path string) (*dsdk.Volume, *dsdk.Snapshot) {
+	for _, ai := range s.ais {
+		for _, si := range ai.StorageInstances {
+			for _, vol := range si.Volumes {
+				for _, snap := range vol.Snapshots {
+					if snap.Path == path {
+						return vol, snap
+					}
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) initiatorsEp(r *http.Request, parts []string, body map[string]interface{}) (interface{}, *dsdk.ApiErrorResponse) {
+	if len(parts) == 0 || parts[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			list := []interface{}{}
+			for _, k := range sortedKeys(s.initiators) {
+				list = append(list, s.initiators[k])
+			}
+			return list, nil
+		case http.MethodPost:
+			req := &dsdk.InitiatorsCreateRequest{}
+			decode(body, req)
+			if req.Id == "" {
+				return nil, invalid("Initiator id is required")
+			}
+			if init, ok := s.initiators[req.Id]; ok && !req.Force {
+				return nil, conflict("Initiator %s already exists", init.Id)
+			}
+			init := &dsdk.Initiator{Path: "/initiators/" + req.Id, Id: req.Id, Name: req.Name}
+			s.initiators[req.Id] = init
+			return init, nil
+		}
+		return nil, notFound(r.URL.Path)
+	}
+	init, ok := s.initiators[parts[0]]
+	if !ok || len(parts) != 1 {
+		return nil, notFound(r.URL.Path)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return init, nil
+	case http.MethodPut:
+		req := &dsdk.InitiatorSetRequest{}
+		decode(body, req)
+		init.Name = req.Name
+		return init, nil
+	case http.MethodDelete:
+		delete(s.initiators, init.Id)
+		return init, nil
+	}
+	return nil, notFound(r.URL.Path)
+}
@@ -0,0 +1,329 @@
+// Package fakeapi provides an in-process stand-in for the Datera v2.2 REST
+// API.  It is intended for unit tests, so the client and driver can be
+// exercised without a live array.
+package fakeapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	dsdk "github.com/Datera/go-sdk/pkg/dsdk"
+	udc "github.com/Datera/go-udc/pkg/udc"
+)
+
+const (
+	ApiVersion = "2.2"
+	ApiKey     = "fake-api-key"
+	Tenant     = "/root"
+)
+
+type fault struct {
+	method string
+	path   *regexp.Regexp
+	nth    int
+	seen   int
+	apierr *dsdk.ApiErrorResponse
+}
+
+// Server is a fake Datera array.  All state is kept in memory and is
+// protected by a single mutex, requests are served one at a time.
+type Server struct {
+	m   sync.Mutex
+	srv *httptest.Server
+
+	ais        map[string]*dsdk.AppInstance
+	aiOrder    []string
+	metadata   map[string]map[string]string
+	initiators map[string]*dsdk.Initiator
+	ipPools    map[string]*dsdk.AccessNetworkIpPool
+	system     *dsdk.System
+	faults     []*fault
+	calls      []string
+	seq        int64
+	lastTs     int64
+
+	// Number of snapshot GETs (single or listed) before a newly created snapshot reports
+	// op_state "available".  Zero means snapshots are available immediately
+	SnapshotAvailableAfter int
+	snapPending            map[string]int
+	// Answer the tenant wide snapshot listing with a 404, like arrays
+	// predating it
+	NoTenantSnapshots bool
+	// List AclPolicy initiators as belonging to this tenant, like arrays
+	// with multi-tenancy enabled
+	InitiatorTenant string
+}
+
+// NewServer starts a fake array listening on a random local port
+func NewServer() *Server {
+	s := &Server{
+		ais:        map[string]*dsdk.AppInstance{},
+		metadata:   map[string]map[string]string{},
+		initiators: map[string]*dsdk.Initiator{},
+		ipPools: map[string]*dsdk.AccessNetworkIpPool{
+			"default": {Path: "/access_network_ip_pools/default", Name: "default"},
+		},
+		system: &dsdk.System{
+			Path:                  "/system",
+			BuildVersion:          "3.3.5-fake",
+			SwVersion:             "3.3.5",
+			Health:                "ok",
+			Name:                  "fake-array",
+			OpState:               "running",
+			Timezone:              "UTC",
+			Uuid:                  "8f5a5bd8-7b5e-4ab0-a1b6-5a3c64d5a6f1",
+			TotalCapacity:         100 * 1024 * 1024 * 1024 * 1024,
+			AllFlashTotalCapacity: 20 * 1024 * 1024 * 1024 * 1024,
+			HybridTotalCapacity:   80 * 1024 * 1024 * 1024 * 1024,
+		},
+		snapPending: map[string]int{},
+	}
+	s.srv = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// UDC returns a config pointing at the fake array
+func (s *Server) UDC() *udc.UDC {
+	return &udc.UDC{
+		Username:   "admin",
+		Password:   "password",
+		MgmtIp:     "127.0.0.1",
+		Tenant:     Tenant,
+		ApiVersion: ApiVersion,
+	}
+}
+
+// HTTPClient returns a client that routes every request to the fake array,
+// regardless of the port the SDK derives from the UDC config
+func (s *Server) HTTPClient() *http.Client {
+	c := s.srv.Client()
+	tr := c.Transport.(*http.Transport).Clone()
+	addr := s.srv.Listener.Addr().String()
+	tr.DialContext = func(ctxt context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctxt, network, addr)
+	}
+	c.Transport = tr
+	return c
+}
+
+// InjectFault makes the nth request (starting at 1) matching method and the
+// path regular expression fail with apierr.  Paths are relative to the API
+// version, eg: "^/app_instances$"
+func (s *Server) InjectFault(method, path string, nth int, apierr *dsdk.ApiErrorResponse) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if apierr.Http == 0 {
+		apierr.Http = http.StatusInternalServerError
+	}
+	s.faults = append(s.faults, &fault{
+		method: method,
+		path:   regexp.MustCompile(path),
+		nth:    nth,
+		apierr: apierr,
+	})
+}
+
+// Calls returns the number of requests served matching method and the path
+// regular expression.  An empty method matches every method
+func (s *Server) Calls(method, path string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := regexp.MustCompile(path)
+	n := 0
+	for _, c := range s.calls {
+		parts := strings.SplitN(c, " ", 2)
+		if (method == "" || parts[0] == method) && r.MatchString(parts[1]) {
+			n++
+		}
+	}
+	return n
+}
+
+// SetSystem allows tests to tweak the reported system, eg: SwVersion
+func (s *Server) SetSystem(f func(*dsdk.System)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f(s.system)
+}
+
+// AppInstance returns a copy of the named AppInstance or nil
+func (s *Server) AppInstance(name string) *dsdk.AppInstance {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ai := s.findAi(name)
+	if ai == nil {
+		return nil
+	}
+	cp := &dsdk.AppInstance{}
+	b, _ := json.Marshal(ai)
+	json.Unmarshal(b, cp)
+	return cp
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	p := strings.TrimPrefix(r.URL.Path, "/v"+ApiVersion)
+	s.calls = append(s.calls, r.Method+" "+p)
+	for _, f := range s.faults {
+		if f.method != r.Method || !f.path.MatchString(p) {
+			continue
+		}
+		f.seen++
+		if f.seen == f.nth {
+			writeErr(w, f.apierr)
+			return
+		}
+	}
+	if p != "/login" && r.Header.Get("Auth-Token") != ApiKey {
+		writeErr(w, &dsdk.ApiErrorResponse{Name: "AuthFailedError", Http: http.StatusUnauthorized, Message: "Invalid api key"})
+		return
+	}
+	body := map[string]interface{}{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	var (
+		data   interface{}
+		apierr *dsdk.ApiErrorResponse
+	)
+	switch {
+	case p == "/login" && r.Method == http.MethodPut:
+		writeJSON(w, &dsdk.ApiLogin{Key: ApiKey, Version: "v" + ApiVersion})
+		return
+	case p == "/system" && r.Method == http.MethodGet:
+		data = s.system
+	case p == "/storage_nodes" && r.Method == http.MethodGet:
+		data = []interface{}{}
+	case p == "/snapshots" && r.Method == http.MethodGet && !s.NoTenantSnapshots:
+		data = s.allSnapshots()
+	case parts[0] == "app_instances":
+		data, apierr = s.appInstances(r, parts[1:], body)
+	case parts[0] == "initiators":
+		data, apierr = s.initiatorsEp(r, parts[1:], body)
+	case parts[0] == "access_network_ip_pools" && len(parts) == 2 && r.Method == http.MethodGet:
+		if ipp, ok := s.ipPools[parts[1]]; ok {
+			data = ipp
+		} else {
+			apierr = notFound(p)
+		}
+	default:
+		apierr = notFound(p)
+	}
+	if apierr != nil {
+		writeErr(w, apierr)
+		return
+	}
+	if list, ok := data.([]interface{}); ok {
+		writeList(w, r, p, list)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"data":    data,
+		"version": "v" + ApiVersion,
+		"tenant":  Tenant,
+		"path":    p,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeErr(w http.ResponseWriter, apierr *dsdk.ApiErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apierr.Http)
+	json.NewEncoder(w).Encode(apierr)
+}
+
+func writeList(w http.ResponseWriter, r *http.Request, p string, list []interface{}) {
+	total := len(list)
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	writeJSON(w, map[string]interface{}{
+		"data":     list[offset:end],
+		"version":  "v" + ApiVersion,
+		"tenant":   Tenant,
+		"path":     p,
+		"metadata": map[string]interface{}{"total_count": total},
+	})
+}
+
+func notFound(p string) *dsdk.ApiErrorResponse {
+	return &dsdk.ApiErrorResponse{
+		Name:    "NotFoundError",
+		Http:    http.StatusNotFound,
+		Message: fmt.Sprintf("No data at %s", p),
+		Path:    p,
+	}
+}
+
+func invalid(msg string, args ...interface{}) *dsdk.ApiErrorResponse {
+	return &dsdk.ApiErrorResponse{
+		Name:    "InvalidRequestError",
+		Http:    http.StatusBadRequest,
+		Message: fmt.Sprintf(msg, args...),
+	}
+}
+
+func conflict(msg string, args ...interface{}) *dsdk.ApiErrorResponse {
+	return &dsdk.ApiErrorResponse{
+		Name:    "ConflictError",
+		Http:    http.StatusConflict,
+		Message: fmt.Sprintf(msg, args...),
+	}
+}
+
+// decode round-trips a request body into one of the SDK request structs
+func decode(body map[string]interface{}, v interface{}) {
+	b, _ := json.Marshal(body)
+	json.Unmarshal(b, v)
+}
+
+func (s *Server) nextId() string {
+	s.seq++
+	return fmt.Sprintf("%08x-0000-4000-8000-%012x", s.seq, s.seq)
+}
+
+func (s *Server) findAi(id string) *dsdk.AppInstance {
+	if ai, ok := s.ais[id]; ok {
+		return ai
+	}
+	for _, ai := range s.ais {
+		if ai.Name == id {
+			return ai
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]*dsdk.Initiator) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
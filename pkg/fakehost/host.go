@@ -0,0 +1,719 @@
+// Package fakehost provides a scripted stand-in for client.HostExecutor.  It
+// records every command and keeps just enough state (mounts, filesystems,
+// block device sizes, multipath maps) to replay what lsblk, blockdev, mount,
+// multipath and iscsiadm would print on a real node.
+package fakehost
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	iscsi "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	unix "golang.org/x/sys/unix"
+)
+
+// Response is a canned result for a scripted command
+type Response struct {
+	Out string
+	Err error
+}
+
+type rule struct {
+	prefix string
+	resps  []Response
+	n      int
+}
+
+type mpathPath struct {
+	iqn    string
+	device string
+	// "ready" or "faulty"
+	state string
+}
+
+type mpathMap struct {
+	paths []*mpathPath
+}
+
+type mountEntry struct {
+	device string
+	path   string
+	fs     string
+	opts   []string
+}
+
+// Host is a fake node.  The zero value is not usable, use New
+type Host struct {
+	m        sync.Mutex
+	rules    []*rule
+	commands [][]string
+	dirs     map[string]bool
+	devices  map[string][2]uint32
+	fs       map[string]string
+	sizes    map[string]int64
+	mounts   []*mountEntry
+	statfs   map[string]unix.Statfs_t
+	data     map[string][]byte
+
+	discovers   []iscsi.Connector
+	connects    []iscsi.Connector
+	disconnects []string
+	// Portals passed along with each of disconnects
+	disconnectPortals [][]string
+	maps              map[string]*mpathMap
+
+	// Device path returned by IscsiConnect
+	DevicePath string
+	// Name of the dm-multipath map a multipath IscsiConnect assembles, ""
+	// for none (as if multipathd wasn't running)
+	MultipathMap string
+	// Error returned by IscsiConnect, if any
+	ConnectErr error
+}
+
+// ExitError is returned for commands that "fail" on the fake host
+type ExitError struct {
+	Cmd  string
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s: exit status %d", e.Cmd, e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+func New() *Host {
+	return &Host{
+		dirs:       map[string]bool{"/": true},
+		devices:    map[string][2]uint32{},
+		fs:         map[string]string{},
+		sizes:      map[string]int64{},
+		statfs:     map[string]unix.Statfs_t{},
+		data:       map[string][]byte{},
+		maps:       map[string]*mpathMap{},
+		DevicePath: "/dev/disk/by-path/ip-172.28.0.1:3260-iscsi-fake-lun-0",
+
+		MultipathMap: "mpatha",
+	}
+}
+
+// On scripts the result of every command whose space-joined form starts with
+// prefix.  Responses are replayed in order and the last one repeats.  Later
+// rules take precedence over earlier ones and over the built-in behavior
+func (h *Host) On(prefix string, resps ...Response) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if len(resps) == 0 {
+		resps = []Response{{}}
+	}
+	h.rules = append(h.rules, &rule{prefix: prefix, resps: resps})
+}
+
+// AddDevice registers a block device of size bytes, optionally already
+// holding filesystem fs
+func (h *Host) AddDevice(path string, size int64, fs string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.devices[path] = [2]uint32{8, uint32(len(h.devices))}
+	h.sizes[path] = size
+	if fs != "" {
+		h.fs[path] = fs
+	}
+}
+
+// SetDeviceSize changes what blockdev reports for path, eg: after an expand
+func (h *Host) SetDeviceSize(path string, size int64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.sizes[path] = size
+}
+
+// SetDeviceData writes data at offset off of the device at path, the rest
+// of the device reads as zeros
+func (h *Host) SetDeviceData(path string, off int64, data []byte) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	b := h.data[path]
+	if end := off + int64(len(data)); int64(len(b)) < end {
+		b = append(b, make([]byte, end-int64(len(b)))...)
+	}
+	copy(b[off:], data)
+	h.data[path] = b
+}
+
+// SetStatfs scripts what statfs reports for the filesystem mounted at path
+func (h *Host) SetStatfs(path string, st unix.Statfs_t) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.statfs[filepath.Clean(path)] = st
+}
+
+// Commands returns a copy of every command run so far
+func (h *Host) Commands() [][]string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	result := make([][]string, len(h.commands))
+	copy(result, h.commands)
+	return result
+}
+
+// Ran returns how many commands starting with prefix were run
+func (h *Host) Ran(prefix string) int {
+	n := 0
+	for _, c := range h.Commands() {
+		if strings.HasPrefix(strings.Join(c, " "), prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// Mounted returns the device mounted at path, or "" if nothing is
+func (h *Host) Mounted(path string) string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if me := h.findMount(path); me != nil {
+		return me.device
+	}
+	return ""
+}
+
+// MountOptions returns the options the mount at path was mounted (or last
+// remounted) with, nil if nothing is mounted there
+func (h *Host) MountOptions(path string) []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if me := h.findMount(path); me != nil {
+		return append([]string{}, me.opts...)
+	}
+	return nil
+}
+
+// Discovers returns every connector passed to IscsiDiscover
+func (h *Host) Discovers() []iscsi.Connector {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return append([]iscsi.Connector{}, h.discovers...)
+}
+
+// Connects returns every connector passed to IscsiConnect
+func (h *Host) Connects() []iscsi.Connector {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return append([]iscsi.Connector{}, h.connects...)
+}
+
+// MultipathPaths returns the path devices of map name, nil if it doesn't
+// exist
+func (h *Host) MultipathPaths(name string) []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	mp, ok := h.maps[name]
+	if !ok {
+		return nil
+	}
+	paths := []string{}
+	for _, p := range mp.paths {
+		paths = append(paths, p.device)
+	}
+	return paths
+}
+
+// MultipathDevice is the /dev/mapper device of MultipathMap
+func (h *Host) MultipathDevice() string {
+	return "/dev/mapper/" + h.MultipathMap
+}
+
+// FailPath marks a path of every map it belongs to faulty
+func (h *Host) FailPath(device string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for _, mp := range h.maps {
+		for _, p := range mp.paths {
+			if p.device == device {
+				p.state = "faulty"
+			}
+		}
+	}
+}
+
+// Disconnects returns the IQNs passed to IscsiDisconnect
+func (h *Host) Disconnects() []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return append([]string{}, h.disconnects...)
+}
+
+// DisconnectPortals returns the portals passed to each IscsiDisconnect
+func (h *Host) DisconnectPortals() [][]string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return append([][]string{}, h.disconnectPortals...)
+}
+
+func (h *Host) Run(ctxt context.Context, cmd ...string) (string, error) {
+	ncmd := []string{}
+	for _, c := range cmd {
+		if c = strings.TrimSpace(c); c != "" {
+			ncmd = append(ncmd, c)
+		}
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.commands = append(h.commands, ncmd)
+	joined := strings.Join(ncmd, " ")
+	for i := len(h.rules) - 1; i >= 0; i-- {
+		r := h.rules[i]
+		if !strings.HasPrefix(joined, r.prefix) {
+			continue
+		}
+		resp := r.resps[len(r.resps)-1]
+		if r.n < len(r.resps) {
+			resp = r.resps[r.n]
+		}
+		r.n++
+		return resp.Out, resp.Err
+	}
+	return h.builtin(ncmd)
+}
+
+func (h *Host) builtin(cmd []string) (string, error) {
+	fail := func(code int) (string, error) {
+		return "", &ExitError{Cmd: cmd[0], Code: code}
+	}
+	switch {
+	case strings.HasPrefix(cmd[0], "mkfs."):
+		dev := cmd[len(cmd)-1]
+		if h.findMountByDevice(dev) != nil {
+			return fmt.Sprintf("%s is mounted; will not make a filesystem here!", dev), &ExitError{Cmd: cmd[0], Code: 1}
+		}
+		h.fs[dev] = strings.TrimPrefix(cmd[0], "mkfs.")
+		delete(h.data, dev)
+		return "", nil
+	case cmd[0] == "lsblk" && len(cmd) >= 4 && cmd[len(cmd)-1] == "--json":
+		dev := cmd[2]
+		if _, ok := h.devices[dev]; !ok {
+			return fail(32)
+		}
+		return Lsblk(filepath.Base(dev), h.fs[dev]), nil
+	case cmd[0] == "udevadm" && len(cmd) == 4 && cmd[1] == "info" && cmd[2] == "--query=symlink":
+		// Only iSCSI paths have links, their devices are named after them
+		name := strings.TrimPrefix(cmd[3], "--name=")
+		for dev := range h.devices {
+			if dev == name || filepath.Base(dev) == name {
+				if strings.HasPrefix(dev, "/dev/disk/by-path/") {
+					return strings.TrimPrefix(dev, "/dev/") + "\n", nil
+				}
+				return "\n", nil
+			}
+		}
+		return fail(4)
+	case cmd[0] == "blockdev" && len(cmd) == 3 && cmd[1] == "--getsize64":
+		size, ok := h.sizes[cmd[2]]
+		if !ok {
+			return fail(1)
+		}
+		return strconv.FormatInt(size, 10) + "\n", nil
+	case cmd[0] == "blkid" && len(cmd) == 5 && cmd[1] == "-p":
+		dev := cmd[4]
+		if _, ok := h.devices[dev]; !ok || h.fs[dev] == "" {
+			return fail(2)
+		}
+		return fmt.Sprintf("DEVNAME=%s\nTYPE=%s\nUSAGE=filesystem\n", dev, h.fs[dev]), nil
+	case cmd[0] == "wipefs" && len(cmd) == 4:
+		dev := cmd[3]
+		if _, ok := h.devices[dev]; !ok {
+			return fail(1)
+		}
+		if h.fs[dev] == "" {
+			return "", nil
+		}
+		return fmt.Sprintf("# offset,uuid,label,type\n0x438,fake-uuid,,%s\n", h.fs[dev]), nil
+	case cmd[0] == "mount":
+		return h.mount(cmd[1:])
+	case cmd[0] == "umount" && len(cmd) == 2:
+		for i, me := range h.mounts {
+			if me.path == cmd[1] {
+				h.mounts = append(h.mounts[:i], h.mounts[i+1:]...)
+				return "", nil
+			}
+		}
+		return fmt.Sprintf("umount: %s: not mounted.", cmd[1]), &ExitError{Cmd: cmd[0], Code: 32}
+	case cmd[0] == "multipath":
+		return h.multipath(cmd[1:])
+	case cmd[0] == "readlink" && len(cmd) == 3:
+		return cmd[2] + "\n", nil
+	}
+	// Everything else (iscsiadm, resize2fs, xfs_growfs, mknod...) succeeds
+	// silently unless scripted
+	return "", nil
+}
+
+func (h *Host) mount(args []string) (string, error) {
+	var (
+		fs   string
+		pos  []string
+		opts []string
+		bind bool
+	)
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-t" && i+1 < len(args):
+			fs = args[i+1]
+			i++
+		case args[i] == "-o" && i+1 < len(args):
+			opts = append(opts, strings.Split(args[i+1], ",")...)
+			i++
+		case args[i] == "--bind":
+			bind = true
+		case strings.HasPrefix(args[i], "-"):
+		default:
+			pos = append(pos, args[i])
+		}
+	}
+	for _, o := range opts {
+		if o != "remount" || len(pos) != 1 {
+			continue
+		}
+		me := h.findMount(pos[0])
+		if me == nil {
+			return fmt.Sprintf("mount: %s: mount point not mounted or bad option.", pos[0]), &ExitError{Cmd: "mount", Code: 32}
+		}
+		me.opts = opts
+		return "", nil
+	}
+	if len(pos) < 2 {
+		return "mount: bad usage", &ExitError{Cmd: "mount", Code: 1}
+	}
+	src, dest := pos[0], pos[1]
+	if !h.dirs[dest] {
+		return fmt.Sprintf("mount: %s: mount point does not exist.", dest), &ExitError{Cmd: "mount", Code: 32}
+	}
+	if me := h.findMount(src); me != nil {
+		// Bind mount of an existing mount point
+		h.mounts = append(h.mounts, &mountEntry{device: me.device, path: dest, fs: me.fs, opts: opts})
+		return "", nil
+	}
+	if bind {
+		h.mounts = append(h.mounts, &mountEntry{device: src, path: dest, fs: "none", opts: opts})
+		return "", nil
+	}
+	if _, ok := h.devices[src]; !ok {
+		return fmt.Sprintf("mount: %s: special device %s does not exist.", dest, src), &ExitError{Cmd: "mount", Code: 32}
+	}
+	if h.fs[src] == "" || (fs != "" && h.fs[src] != fs) {
+		return fmt.Sprintf("mount: %s: wrong fs type, bad option, bad superblock on %s.", dest, src), &ExitError{Cmd: "mount", Code: 32}
+	}
+	h.mounts = append(h.mounts, &mountEntry{device: src, path: dest, fs: h.fs[src], opts: opts})
+	return "", nil
+}
+
+func (h *Host) multipath(args []string) (string, error) {
+	fail := func(out string) (string, error) {
+		return out, &ExitError{Cmd: "multipath", Code: 1}
+	}
+	switch {
+	case len(args) == 3 && args[0] == "-v1" && args[1] == "-l":
+		// Name of the map the device is, or is a path of
+		for name, mp := range h.maps {
+			if args[2] == name || args[2] == "/dev/mapper/"+name {
+				return name + "\n", nil
+			}
+			for _, p := range mp.paths {
+				if p.device == args[2] {
+					return name + "\n", nil
+				}
+			}
+		}
+		return "", nil
+	case len(args) == 2 && args[0] == "-ll":
+		mp, ok := h.maps[args[1]]
+		if !ok {
+			return "", nil
+		}
+		out := fmt.Sprintf("%s (36001405fake) dm-0 DATERA,IBLOCK\n", args[1])
+		out += "size=5.0G features='0' hwhandler='1 alua' wp=rw\n"
+		out += "`-+- policy='service-time 0' prio=50 status=active\n"
+		for i, p := range mp.paths {
+			dm, online := "active", "running"
+			if p.state != "ready" {
+				dm, online = "failed", "offline"
+			}
+			out += fmt.Sprintf("  |- %d:0:0:0 %s 8:%d %s %s %s\n", i+3, filepath.Base(p.device), i*16, dm, p.state, online)
+		}
+		return out, nil
+	case len(args) == 2 && args[0] == "-f":
+		if _, ok := h.maps[args[1]]; !ok {
+			return fail(fmt.Sprintf("%s: map does not exist", args[1]))
+		}
+		if h.findMountByDevice("/dev/mapper/"+args[1]) != nil {
+			return fail(fmt.Sprintf("%s: map in use", args[1]))
+		}
+		delete(h.maps, args[1])
+		delete(h.devices, "/dev/mapper/"+args[1])
+		return "", nil
+	}
+	return fail("multipath: bad usage")
+}
+
+// The kernel escapes whitespace in /proc/mounts
+var procMountsEscapes = strings.NewReplacer(" ", `\040`, "\t", `\011`, "\n", `\012`, `\`, `\134`)
+
+// procMounts returns the contents of /proc/mounts
+func (h *Host) procMounts() []byte {
+	out := ""
+	for _, me := range h.mounts {
+		out += fmt.Sprintf("%s %s %s %s 0 0\n", procMountsEscapes.Replace(me.device), procMountsEscapes.Replace(me.path), me.fs, me.procOpts())
+	}
+	return []byte(out)
+}
+
+// procOpts returns the options as /proc/mounts would show them
+func (me *mountEntry) procOpts() string {
+	opts := []string{"rw", "relatime"}
+	for _, o := range me.opts {
+		switch o {
+		case "ro":
+			opts[0] = o
+		case "rw", "remount", "bind", "defaults":
+		default:
+			opts = append(opts, o)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+func (h *Host) findMount(path string) *mountEntry {
+	for _, me := range h.mounts {
+		if me.path == path {
+			return me
+		}
+	}
+	return nil
+}
+
+func (h *Host) findMountByDevice(dev string) *mountEntry {
+	for _, me := range h.mounts {
+		if me.device == dev {
+			return me
+		}
+	}
+	return nil
+}
+
+func (h *Host) Stat(path string) (os.FileInfo, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	path = filepath.Clean(path)
+	if h.dirs[path] {
+		return &fileInfo{name: filepath.Base(path), dir: true}, nil
+	}
+	if _, ok := h.devices[path]; ok {
+		return &fileInfo{name: filepath.Base(path), size: h.sizes[path]}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+func (h *Host) MkdirAll(path string, perm os.FileMode) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for p := filepath.Clean(path); p != "/" && p != "."; p = filepath.Dir(p) {
+		h.dirs[p] = true
+	}
+	return nil
+}
+
+func (h *Host) RemoveAll(path string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	path = filepath.Clean(path)
+	if me := h.findMount(path); me != nil {
+		return &os.PathError{Op: "unlinkat", Path: path, Err: fmt.Errorf("device or resource busy")}
+	}
+	for p := range h.dirs {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			delete(h.dirs, p)
+		}
+	}
+	return nil
+}
+
+func (h *Host) MajorMinor(device string) (uint32, uint32, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	mm, ok := h.devices[device]
+	if !ok {
+		return 0, 0, &os.PathError{Op: "stat", Path: device, Err: os.ErrNotExist}
+	}
+	return mm[0], mm[1], nil
+}
+
+// Statfs reports what was scripted with SetStatfs, otherwise an empty
+// filesystem filling the device mounted at path
+func (h *Host) Statfs(path string, buf *unix.Statfs_t) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	path = filepath.Clean(path)
+	if st, ok := h.statfs[path]; ok {
+		*buf = st
+		return nil
+	}
+	if !h.dirs[path] {
+		return &os.PathError{Op: "statfs", Path: path, Err: os.ErrNotExist}
+	}
+	*buf = unix.Statfs_t{Bsize: 4096, Files: 65536, Ffree: 65536}
+	if me := h.findMount(path); me != nil {
+		blocks := uint64(h.sizes[me.device] / 4096)
+		buf.Blocks, buf.Bfree, buf.Bavail = blocks, blocks, blocks
+		if strings.HasPrefix(me.procOpts(), "ro,") {
+			buf.Flags |= unix.ST_RDONLY
+		}
+	}
+	return nil
+}
+
+// ReadAt reads what was written with SetDeviceData, zeros otherwise
+func (h *Host) ReadAt(path string, buf []byte, off int64) (int, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if path == "/proc/mounts" {
+		b := h.procMounts()
+		if off >= int64(len(b)) {
+			return 0, io.EOF
+		}
+		n := copy(buf, b[off:])
+		if n < len(buf) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if _, ok := h.devices[path]; !ok {
+		return 0, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	// Devices without a size set read as large enough
+	n := len(buf)
+	if size, ok := h.sizes[path]; ok && off >= size {
+		return 0, io.EOF
+	} else if ok && int64(n) > size-off {
+		n = int(size - off)
+	}
+	for i := range buf[:n] {
+		buf[i] = 0
+	}
+	if b := h.data[path]; off < int64(len(b)) {
+		copy(buf[:n], b[off:])
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *Host) IscsiDiscover(c iscsi.Connector) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.discovers = append(h.discovers, c)
+	return h.ConnectErr
+}
+
+func (h *Host) IscsiConnect(c iscsi.Connector) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.connects = append(h.connects, c)
+	if h.ConnectErr != nil {
+		return "", h.ConnectErr
+	}
+	if _, ok := h.devices[h.DevicePath]; !ok {
+		h.devices[h.DevicePath] = [2]uint32{8, uint32(len(h.devices))}
+	}
+	if !c.Multipath || h.MultipathMap == "" {
+		return h.DevicePath, nil
+	}
+	// Every portal gets its own path device, assembled into one map
+	mp, ok := h.maps[h.MultipathMap]
+	if !ok {
+		mp = &mpathMap{}
+		h.maps[h.MultipathMap] = mp
+		h.devices["/dev/mapper/"+h.MultipathMap] = [2]uint32{253, uint32(len(h.maps))}
+	}
+	for _, t := range c.Targets {
+		dev := fmt.Sprintf("/dev/disk/by-path/ip-%s:%s-iscsi-%s-lun-%d", t.Portal, t.Port, t.Iqn, c.Lun)
+		found := false
+		for _, p := range mp.paths {
+			found = found || p.device == dev
+		}
+		if !found {
+			mp.paths = append(mp.paths, &mpathPath{iqn: t.Iqn, device: dev, state: "ready"})
+			h.devices[dev] = [2]uint32{8, uint32(len(h.devices))}
+		}
+	}
+	return mp.paths[0].device, nil
+}
+
+// IscsiDisconnect logs out of iqn.  Its paths leave any map they were in, a
+// map that wasn't flushed first is left behind without them
+func (h *Host) IscsiDisconnect(iqn string, portals []string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.disconnects = append(h.disconnects, iqn)
+	h.disconnectPortals = append(h.disconnectPortals, append([]string{}, portals...))
+	for _, mp := range h.maps {
+		paths := []*mpathPath{}
+		for _, p := range mp.paths {
+			if p.iqn != iqn {
+				paths = append(paths, p)
+			} else {
+				delete(h.devices, p.device)
+			}
+		}
+		mp.paths = paths
+	}
+	return nil
+}
+
+// Lsblk renders `lsblk -f <device> --json` output for a single device
+func Lsblk(name, fs string) string {
+	var fstype interface{}
+	if fs != "" {
+		fstype = fs
+	}
+	b, _ := json.MarshalIndent(map[string]interface{}{
+		"blockdevices": []map[string]interface{}{{
+			"name":       name,
+			"fstype":     fstype,
+			"label":      nil,
+			"uuid":       nil,
+			"mountpoint": nil,
+		}},
+	}, "", "   ")
+	return string(b) + "\n"
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (f *fileInfo) Name() string { return f.name }
+func (f *fileInfo) Size() int64  { return f.size }
+func (f *fileInfo) Mode() os.FileMode {
+	if f.dir {
+		return os.ModeDir | 0755
+	}
+	return os.ModeDevice | 0660
+}
+func (f *fileInfo) ModTime() time.Time { return time.Time{} }
+func (f *fileInfo) IsDir() bool        { return f.dir }
+func (f *fileInfo) Sys() interface{}   { return nil }
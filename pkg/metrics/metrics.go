@@ -0,0 +1,222 @@
+package metrics
+
+// Prometheus metrics for the plugin.  Everything is registered with a
+// dedicated Registry (instead of the global default one) so tests can scrape
+// it without picking up collectors registered by our dependencies.
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "datera_csi"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpc_requests_total",
+		Help:      "CSI RPCs handled, by method and gRPC status code",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "CSI RPC latency, by method",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"method"})
+	rpcInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rpc_in_flight",
+		Help:      "CSI RPCs currently being handled, by method",
+	}, []string{"method"})
+
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Datera API requests, by HTTP method, endpoint and HTTP status code (\"error\" if no response was received)",
+	}, []string{"method", "endpoint", "code"})
+	apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_duration_seconds",
+		Help:      "Datera API request latency, by HTTP method and endpoint",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	heartbeatHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "heartbeat_healthy",
+		Help:      "1 if the last heartbeat against the Datera system succeeded",
+	})
+	heartbeats = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "heartbeats_total",
+		Help:      "Heartbeats against the Datera system, by result",
+	}, []string{"result"})
+	logPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logpush_total",
+		Help:      "Log pushes to the Datera system, by result",
+	}, []string{"result"})
+
+	multipathPaths = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "multipath_paths",
+		Help:      "Paths of the multipath devices staged on this node, by volume and state (\"active\" or \"failed\"), as of the last NodeGetVolumeStats",
+	}, []string{"volume_id", "state"})
+)
+
+func init() {
+	Registry.MustRegister(
+		rpcRequests,
+		rpcDuration,
+		rpcInFlight,
+		apiRequests,
+		apiDuration,
+		heartbeatHealthy,
+		heartbeats,
+		logPushes,
+		multipathPaths,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// StartRPC marks an RPC as in flight.  The returned function records its
+// outcome and must be called once it completes
+func StartRPC(method string) func(code string) {
+	ts := time.Now()
+	rpcInFlight.WithLabelValues(method).Inc()
+	return func(code string) {
+		rpcInFlight.WithLabelValues(method).Dec()
+		rpcRequests.WithLabelValues(method, code).Inc()
+		rpcDuration.WithLabelValues(method).Observe(time.Since(ts).Seconds())
+	}
+}
+
+// Heartbeat records the outcome of a heartbeat
+func Heartbeat(err error) {
+	if err != nil {
+		heartbeatHealthy.Set(0)
+	} else {
+		heartbeatHealthy.Set(1)
+	}
+	heartbeats.WithLabelValues(result(err)).Inc()
+}
+
+// LogPush records the outcome of a log push
+func LogPush(err error) {
+	logPushes.WithLabelValues(result(err)).Inc()
+}
+
+// MultipathPaths records how many of a volume's paths are active
+func MultipathPaths(vid string, active, total int) {
+	multipathPaths.WithLabelValues(vid, "active").Set(float64(active))
+	multipathPaths.WithLabelValues(vid, "failed").Set(float64(total - active))
+}
+
+// ForgetMultipath drops the path series of a volume no longer staged here
+func ForgetMultipath(vid string) {
+	multipathPaths.DeleteLabelValues(vid, "active")
+	multipathPaths.DeleteLabelValues(vid, "failed")
+}
+
+// Endpoint collapses the object ids in a Datera API path so requests can be
+// grouped without creating a series per volume, eg:
+// /v2.2/app_instances/CSI-1234/storage_instances/storage-1 becomes
+// /app_instances/{id}/storage_instances/{id}.  Every collection in the API is
+// plural, so a segment following one ending in "s" is treated as an id
+func Endpoint(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "v") {
+		if _, err := strconv.ParseFloat(parts[0][1:], 64); err == nil {
+			parts = parts[1:]
+		}
+	}
+	for i := 1; i < len(parts); i++ {
+		if parts[i-1] != "{id}" && strings.HasSuffix(parts[i-1], "s") {
+			parts[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	ep := Endpoint(req.URL.Path)
+	ts := time.Now()
+	resp, err := next.RoundTrip(req)
+	apiDuration.WithLabelValues(req.Method, ep).Observe(time.Since(ts).Seconds())
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	apiRequests.WithLabelValues(req.Method, ep, code).Inc()
+	return resp, err
+}
+
+// InstrumentClient returns a copy of hc recording Datera API metrics for
+// every request.  A nil hc instruments http.DefaultClient
+func InstrumentClient(hc *http.Client) *http.Client {
+	c := http.Client{}
+	if hc != nil {
+		c = *hc
+	}
+	c.Transport = &instrumentedTransport{next: c.Transport}
+	return &c
+}
+
+// Serve exposes the Registry on addr at /metrics.  It blocks until the
+// listener fails
+func Serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, Handler())
+}
+
+// Handler returns the http.Handler serving /metrics
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// RegisterGaugeFunc exports a gauge whose value is read at scrape time
+func RegisterGaugeFunc(name, help string, f func() float64) error {
+	return Registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
+
+// RegisterCounterFunc exports a counter whose value is read at scrape time
+func RegisterCounterFunc(name, help string, f func() float64) error {
+	return Registry.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f))
+}
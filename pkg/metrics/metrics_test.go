@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEndpoint(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/v2.2/app_instances":          "/app_instances",
+		"/v2.2/app_instances/CSI-1234": "/app_instances/{id}",
+		"/v2.2/app_instances/CSI-1234/storage_instances/storage-1/volumes/volume-1": "/app_instances/{id}/storage_instances/{id}/volumes/{id}",
+		"/v2.2/app_instances/CSI-1234/storage_instances/storage-1/acl_policy":       "/app_instances/{id}/storage_instances/{id}/acl_policy",
+		"/v2.2/app_instances/CSI-1234/snapshots/1565212345.123456789":               "/app_instances/{id}/snapshots/{id}",
+		"/v2.2/initiators/iqn.1993-08.org.debian:01:abcdef":                         "/initiators/{id}",
+		"/v2.2/system":  "/system",
+		"/v2.2/login":   "/login",
+		"/logs_upload/": "/logs_upload",
+	} {
+		if ep := Endpoint(path); ep != expected {
+			t.Errorf("Endpoint(%s): [%s] != [%s]", path, ep, expected)
+		}
+	}
+}
+
+func TestInstrumentClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "missing") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	hc := &http.Client{}
+	c := InstrumentClient(hc)
+	if c == hc || hc.Transport != nil {
+		t.Fatal("InstrumentClient modified the client passed in")
+	}
+	for _, p := range []string{"/v2.2/app_instances/a", "/v2.2/app_instances/b", "/v2.2/app_instances/missing"} {
+		resp, err := c.Get(ts.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := testutil.ToFloat64(apiRequests.WithLabelValues("GET", "/app_instances/{id}", "200")); n != 2 {
+		t.Fatalf("Expected 2 successful requests, found %f", n)
+	}
+	if n := testutil.ToFloat64(apiRequests.WithLabelValues("GET", "/app_instances/{id}", "404")); n != 1 {
+		t.Fatalf("Expected 1 failed request, found %f", n)
+	}
+}
+
+func TestStartRPC(t *testing.T) {
+	done := StartRPC("NodeStageVolume")
+	if n := testutil.ToFloat64(rpcInFlight.WithLabelValues("NodeStageVolume")); n != 1 {
+		t.Fatalf("Expected 1 RPC in flight, found %f", n)
+	}
+	done("Internal")
+	if n := testutil.ToFloat64(rpcInFlight.WithLabelValues("NodeStageVolume")); n != 0 {
+		t.Fatalf("Expected no RPCs in flight, found %f", n)
+	}
+	if n := testutil.ToFloat64(rpcRequests.WithLabelValues("NodeStageVolume", "Internal")); n != 1 {
+		t.Fatalf("Expected 1 failed RPC, found %f", n)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Heartbeat(errors.New("connection refused"))
+	LogPush(nil)
+	ts := httptest.NewServer(Handler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"datera_csi_heartbeat_healthy 0",
+		`datera_csi_heartbeats_total{result="failure"} 1`,
+		`datera_csi_logpush_total{result="success"} 1`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("Missing from /metrics: %s", line)
+		}
+	}
+}
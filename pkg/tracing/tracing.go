@@ -0,0 +1,229 @@
+package tracing
+
+// OpenTelemetry tracing for the plugin.  Tracing is off (every span is a
+// no-op) until Setup is called with an endpoint.  Spans are created for each
+// CSI RPC, each Datera API request and each host command, so the time spent
+// in a slow RPC can be broken down.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+	apitrace "go.opentelemetry.io/otel/api/trace"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/label"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+
+	metrics "github.com/Datera/datera-csi/pkg/metrics"
+)
+
+const (
+	tracerName = "github.com/Datera/datera-csi"
+
+	EndpointStdout = "stdout"
+	prefixFile     = "file://"
+	prefixOtlp     = "otlp://"
+)
+
+type Kind int
+
+const (
+	Internal Kind = iota
+	Server
+	Client
+)
+
+var kinds = map[Kind]apitrace.SpanKind{
+	Internal: apitrace.SpanKindInternal,
+	Server:   apitrace.SpanKindServer,
+	Client:   apitrace.SpanKindClient,
+}
+
+// Setup installs the global tracer provider.  endpoint is one of:
+//   - "stdout"            -- spans are written to stdout as JSON
+//   - "file:///some/path" -- spans are appended to the file as JSON
+//   - "otlp://host:port"  -- spans are sent to an OTLP gRPC collector
+//     (a bare "host:port" works too)
+//
+// An empty endpoint leaves tracing disabled.  The returned function flushes
+// any buffered spans and must be called before exiting
+func Setup(endpoint, service string) (func(), error) {
+	var (
+		exp export.SpanExporter
+		f   *os.File
+		err error
+		now bool
+	)
+	switch {
+	case endpoint == "":
+		return func() {}, nil
+	case endpoint == EndpointStdout:
+		exp, err = stdout.NewExporter(stdout.WithWriter(os.Stdout), stdout.WithoutMetricExport())
+		now = true
+	case strings.HasPrefix(endpoint, prefixFile):
+		f, err = os.OpenFile(strings.TrimPrefix(endpoint, prefixFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exp, err = stdout.NewExporter(stdout.WithWriter(f), stdout.WithoutMetricExport())
+		now = true
+	default:
+		exp, err = otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(strings.TrimPrefix(endpoint, prefixOtlp)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create trace exporter for %s: %s", endpoint, err)
+	}
+	stop := install(exp, now, service)
+	return func() {
+		stop()
+		if f != nil {
+			f.Close()
+		}
+	}, nil
+}
+
+// SetupWithExporter installs a global tracer provider exporting every span
+// to exp as soon as it ends, eg: an in-memory exporter in tests
+func SetupWithExporter(exp export.SpanExporter, service string) func() {
+	return install(exp, true, service)
+}
+
+// install exports spans in batches unless now is set, batching only makes
+// sense when sending them over the network
+func install(exp export.SpanExporter, now bool, service string) func() {
+	var sp sdktrace.SpanProcessor
+	if now {
+		sp = sdktrace.NewSimpleSpanProcessor(exp)
+	} else {
+		sp = sdktrace.NewBatchSpanProcessor(exp)
+	}
+	host, _ := os.Hostname()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithResource(resource.New(
+			semconv.ServiceNameKey.String(service),
+			semconv.HostNameKey.String(host),
+		)),
+		sdktrace.WithSpanProcessor(sp),
+	)
+	global.SetTracerProvider(tp)
+	return func() {
+		// Shuts down the processor, flushing anything still queued
+		tp.UnregisterSpanProcessor(sp)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		exp.Shutdown(ctx)
+	}
+}
+
+// Start starts a span as a child of any span in ctx.  The returned function
+// ends it, recording err as the span status if non-nil
+func Start(ctx context.Context, name string, kind Kind) (context.Context, func(error)) {
+	ctx, span := global.Tracer(tracerName).Start(ctx, name, apitrace.WithSpanKind(kinds[kind]))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(ctx, err)
+			span.SetStatus(otelcodes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// Annotate sets key=value pairs as attributes on the span in ctx.  Empty
+// values are skipped
+func Annotate(ctx context.Context, kvs ...string) {
+	span := apitrace.SpanFromContext(ctx)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if kvs[i+1] != "" {
+			span.SetAttributes(label.String(kvs[i], kvs[i+1]))
+		}
+	}
+}
+
+// Inherit returns dst with the span from src, without inheriting src's
+// deadline or cancellation
+func Inherit(dst, src context.Context) context.Context {
+	if src == nil {
+		return dst
+	}
+	return apitrace.ContextWithSpan(dst, apitrace.SpanFromContext(src))
+}
+
+// Operation names a Datera API request after the SDK call that makes it,
+// eg: POST /app_instances is "AppInstances.Create" and PUT
+// /app_instances/{id}/storage_instances/{id}/acl_policy is "AclPolicy.Set"
+func Operation(method, endpoint string) string {
+	parts := strings.Split(strings.Trim(endpoint, "/"), "/")
+	item := len(parts) > 1 && parts[len(parts)-1] == "{id}"
+	res := parts[len(parts)-1]
+	if item {
+		res = parts[len(parts)-2]
+	}
+	name := ""
+	for _, w := range strings.Split(res, "_") {
+		if w != "" {
+			name += strings.ToUpper(w[:1]) + w[1:]
+		}
+	}
+	verb := method
+	switch method {
+	case http.MethodGet:
+		verb = "Get"
+		if !item && strings.HasSuffix(res, "s") {
+			verb = "List"
+		}
+	case http.MethodPost:
+		verb = "Create"
+	case http.MethodPut:
+		verb = "Set"
+	case http.MethodDelete:
+		verb = "Delete"
+	}
+	return name + "." + verb
+}
+
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	ep := metrics.Endpoint(req.URL.Path)
+	ctx, end := Start(req.Context(), Operation(req.Method, ep), Client)
+	Annotate(ctx, "http.method", req.Method, "http.target", req.URL.Path, "datera.endpoint", ep)
+	resp, err := next.RoundTrip(req.WithContext(ctx))
+	spanErr := err
+	if err == nil {
+		Annotate(ctx, "http.status_code", strconv.Itoa(resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			spanErr = fmt.Errorf("%s", resp.Status)
+		}
+	}
+	end(spanErr)
+	return resp, err
+}
+
+// InstrumentClient returns a copy of hc creating a span for every request.
+// A nil hc instruments http.DefaultClient
+func InstrumentClient(hc *http.Client) *http.Client {
+	c := http.Client{}
+	if hc != nil {
+		c = *hc
+	}
+	c.Transport = &tracingTransport{next: c.Transport}
+	return &c
+}
@@ -0,0 +1,118 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/export/trace/tracetest"
+)
+
+func TestOperation(t *testing.T) {
+	for _, c := range []struct{ method, endpoint, expected string }{
+		{"POST", "/app_instances", "AppInstances.Create"},
+		{"GET", "/app_instances", "AppInstances.List"},
+		{"GET", "/app_instances/{id}", "AppInstances.Get"},
+		{"PUT", "/app_instances/{id}", "AppInstances.Set"},
+		{"DELETE", "/app_instances/{id}", "AppInstances.Delete"},
+		{"PUT", "/app_instances/{id}/storage_instances/{id}/acl_policy", "AclPolicy.Set"},
+		{"GET", "/app_instances/{id}/storage_instances/{id}/acl_policy", "AclPolicy.Get"},
+		{"POST", "/app_instances/{id}/storage_instances/{id}/volumes/{id}/snapshots", "Snapshots.Create"},
+		{"GET", "/system", "System.Get"},
+	} {
+		if op := Operation(c.method, c.endpoint); op != c.expected {
+			t.Errorf("Operation(%s, %s): [%s] != [%s]", c.method, c.endpoint, op, c.expected)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	stop := SetupWithExporter(exp, "test")
+	defer stop()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer ts.Close()
+
+	ctx, end := Start(context.Background(), "/csi.v1.Controller/CreateVolume", Server)
+	Annotate(ctx, "csi.volume_id", "CSI-vol", "csi.node", "")
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v2.2/app_instances", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := InstrumentClient(nil).Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	end(errors.New("failed"))
+
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, found %d", len(spans))
+	}
+	api, rpc := spans[0], spans[1]
+	if api.Name != "AppInstances.Create" || rpc.Name != "/csi.v1.Controller/CreateVolume" {
+		t.Fatalf("Unexpected span names: [%s], [%s]", api.Name, rpc.Name)
+	}
+	if api.ParentSpanID != rpc.SpanContext.SpanID || api.SpanContext.TraceID != rpc.SpanContext.TraceID {
+		t.Fatal("API span is not a child of the RPC span")
+	}
+	if api.StatusCode != otelcodes.Error || rpc.StatusCode != otelcodes.Error {
+		t.Fatalf("Errors not recorded: [%s], [%s]", api.StatusCode, rpc.StatusCode)
+	}
+	if len(rpc.Attributes) != 1 || rpc.Attributes[0].Value.AsString() != "CSI-vol" {
+		t.Fatalf("Unexpected RPC span attributes: %v", rpc.Attributes)
+	}
+}
+
+func TestInherit(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	stop := SetupWithExporter(exp, "test")
+	defer stop()
+	parent, cancel := context.WithCancel(context.Background())
+	parent, end := Start(parent, "parent", Server)
+	ctx := Inherit(context.Background(), parent)
+	cancel()
+	if ctx.Err() != nil {
+		t.Fatal("Inherit carried over the parent cancellation")
+	}
+	_, endChild := Start(ctx, "child", Internal)
+	endChild(nil)
+	end(nil)
+	spans := exp.GetSpans()
+	if len(spans) != 2 || spans[0].ParentSpanID != spans[1].SpanContext.SpanID {
+		t.Fatal("Span not inherited")
+	}
+}
+
+func TestSetupFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traces.json")
+	stop, err := Setup("file://"+path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, end := Start(context.Background(), "exec mkfs.ext4", Internal)
+	end(nil)
+	stop()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "exec mkfs.ext4") {
+		t.Fatalf("Span not written to file: %s", b)
+	}
+}